@@ -9,6 +9,7 @@ import (
 	"strconv"
 	sha1Hash "crypto/sha1"
 	"io"
+	"sort"
 )
 
 // Function map for decoding
@@ -86,6 +87,9 @@ func decodeByteString(buf []byte) (interface{}, []byte) {
 	// Calculate length of string & discard length bytes
 	strLen, _ := strconv.ParseUint(string(buf[:i]), 10, intSize)
 	buf = buf[i+1:]
+	if strLen > uint64(len(buf)) {
+		panic(errors.New("Failed to decode byte string as insufficient data remains"))
+	}
 	return string(buf[:strLen]), buf[strLen:]
 }
 
@@ -134,6 +138,9 @@ func sha1(buf []byte) []byte {
 }
 
 func nextRune(buf []byte) rune {
+	if len(buf) == 0 {
+		panic(errors.New("Unexpected end of data"))
+	}
 	return rune(buf[0])
 }
 
@@ -145,6 +152,96 @@ func decodeFnFor(r rune) func([]byte) (interface{}, []byte) {
 	return fn
 }
 
+// Encodes the value to the writer. Supported types are strings, byte slices, integers,
+// lists ([]interface{}, []string) & dictionaries (map[string]interface{}).
+func Encode(w io.Writer, v interface{}) (err error) {
+
+	// Recover from any encoding panics & return error
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+
+	var buf bytes.Buffer
+	encode(&buf, v)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func EncodeBytes(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := Encode(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case string: encodeByteString(buf, []byte(val))
+	case []byte: encodeByteString(buf, val)
+	case int: encodeInteger(buf, int64(val))
+	case int32: encodeInteger(buf, int64(val))
+	case int64: encodeInteger(buf, val)
+	case uint: encodeInteger(buf, int64(val))
+	case uint16: encodeInteger(buf, int64(val))
+	case uint32: encodeInteger(buf, int64(val))
+	case uint64: encodeInteger(buf, int64(val))
+	case bool:
+		if val {
+			encodeInteger(buf, 1)
+		} else {
+			encodeInteger(buf, 0)
+		}
+	case []interface{}:
+		buf.WriteRune('l')
+		for _, e := range val {
+			encode(buf, e)
+		}
+		buf.WriteRune(typeTerminator)
+	case []string:
+		buf.WriteRune('l')
+		for _, e := range val {
+			encodeByteString(buf, []byte(e))
+		}
+		buf.WriteRune(typeTerminator)
+	case map[string]interface{}:
+
+		// Keys must appear in sorted order
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteRune('d')
+		for _, k := range keys {
+			encodeByteString(buf, []byte(k))
+			encode(buf, val[k])
+		}
+		buf.WriteRune(typeTerminator)
+	default:
+		panic(fmt.Errorf("No encoding function found for type: %T", v))
+	}
+}
+
+func encodeInteger(buf *bytes.Buffer, i int64) {
+	buf.WriteRune('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteRune(typeTerminator)
+}
+
+func encodeByteString(buf *bytes.Buffer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteRune(byteStringSeparator)
+	buf.Write(b)
+}
+
 // Build function map
 func init() {
 	decodeFunctions = map[rune]func([]byte) (interface{}, []byte){
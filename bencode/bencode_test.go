@@ -40,6 +40,44 @@ func TestDecodeBigTorrent(t *testing.T) {
 
 }
 
+func TestEncodeRoundTrip(t *testing.T) {
+	in := map[string] interface {} {
+		"t" : "aa",
+		"y" : "q",
+		"q" : "get_peers",
+		"a" : map[string] interface {} {
+			"id" : "abcdefghij0123456789",
+			"port" : 6881,
+			"values" : []interface {} { "\x7f\x00\x00\x01\x1a\xe1" },
+		},
+	}
+
+	buf, err := EncodeBytes(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d1:ad2:id20:abcdefghij01234567894:porti6881e6:valuesl6:\x7f\x00\x00\x01\x1a\xe1ee1:q9:get_peers1:t2:aa1:y1:qe"
+	stringEquals(t, expected, string(buf))
+
+	out, err := DecodeAsDict(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := checkKey(t, out, "a").(map[string] interface {})
+	stringEquals(t, "abcdefghij0123456789", checkKey(t, a, "id"))
+	if checkKey(t, a, "port") != int64(6881) {
+		t.Errorf("Port not decoded correctly")
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, s := range []string { "d1:ad2:id20:abc", "l4:spam", "10:abc", "" } {
+		if _, err := Decode(bytes.NewReader([]byte(s))); err == nil {
+			t.Errorf("Expected error decoding: %q", s)
+		}
+	}
+}
+
 func BenchmarkDecodeBigTorrent(b *testing.B) {
 	b.StopTimer()
 	r, err := ioutil.ReadFile("./test/CentOS 6.5 x86_64 bin DVD1to2.torrent")
@@ -6,7 +6,8 @@ import (
 	"errors"
 )
 
-var bitMasks = [8]byte{ 1, 2, 4, 8, 16, 32, 64, 128 }
+// Bit 0 is the high bit of the first byte (as per the wire format)
+var bitMasks = [8]byte{ 128, 64, 32, 16, 8, 4, 2, 1 }
 
 type BitSet struct {
 	bits []byte
@@ -14,7 +15,10 @@ type BitSet struct {
 	complete bool
 }
 
-var errSpareBitsSet = errors.New("Detected one or more spare bits set.")
+var (
+	errSpareBitsSet = errors.New("Detected one or more spare bits set.")
+	errBitfieldLength = errors.New("Bitfield length does not match number of pieces.")
+)
 
 func NewBitSet(size uint32) *BitSet {
 
@@ -29,10 +33,15 @@ func NewBitSet(size uint32) *BitSet {
 
 func NewBitSetFrom(bits []byte, size uint32) (*BitSet, error) {
 
+	// Ensure length is correct
+	if uint32(len(bits)) != (size + 7) / 8 {
+		return nil, errBitfieldLength
+	}
+
 	// Ensure spare bits are not set
 	if i := uint32(size % 8); i != 0 {
 		for ; i < 8; i++ {
-			if bits[len(bits)-1]|bitMasks[i] != 0 {
+			if bits[len(bits)-1] & bitMasks[i] != 0 {
 				return nil, errSpareBitsSet
 			}
 		}
@@ -61,6 +70,26 @@ func (bs *BitSet) Set(i uint32) {
 	}
 }
 
+// Sets all bits
+func (bs *BitSet) SetAll() {
+	for i := uint32(0); i < bs.size; i++ {
+		bs.Set(i)
+	}
+}
+
+func (bs BitSet) IsEmpty() bool {
+	for _, b := range bs.bits {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bs BitSet) Bytes() []byte {
+	return bs.bits
+}
+
 func (bs BitSet) IsValid(i uint32) bool {
 	return i >= 0 && i < bs.size
 }
@@ -73,7 +102,7 @@ func (bs *BitSet) IsComplete() bool {
 	}
 
 	// Check all but last byte
-	for i := 0 ; i < len(bs.bits)-2 ; i++ {
+	for i := 0 ; i < len(bs.bits)-1 ; i++ {
 		if bs.bits[i] != 0xFF {
 			return false
 		}
@@ -84,7 +113,7 @@ func (bs *BitSet) IsComplete() bool {
 	if bs.size%8 != 0 {
 		b = uint8(bs.size%8)
 	}
-	bs.complete = bs.bits[len(bs.bits)-1] == (0xFF >> (8-b))
+	bs.complete = bs.bits[len(bs.bits)-1] == byte(0xFF << (8-b))
 	return bs.complete
 }
 
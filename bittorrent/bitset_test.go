@@ -0,0 +1,57 @@
+package bittorrent
+
+import "testing"
+
+func TestBitSetWireOrder(t *testing.T) {
+	bs := NewBitSet(10)
+	bs.Set(0)
+	bs.Set(9)
+	if bs.bits[0] != 0x80 || bs.bits[1] != 0x40 {
+		t.Errorf("Expected: [0x80 0x40], Actual: %#v", bs.bits)
+	}
+	if !bs.Have(0) || bs.Have(1) || !bs.Have(9) {
+		t.Errorf("Unexpected bits: %v", bs)
+	}
+}
+
+func TestNewBitSetFromSpareBits(t *testing.T) {
+	if _, err := NewBitSetFrom([]byte { 0xE0 }, 3); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := NewBitSetFrom([]byte { 0xE1 }, 3); err != errSpareBitsSet {
+		t.Errorf("Expected: %v, Actual: %v", errSpareBitsSet, err)
+	}
+}
+
+func TestBitSetIsComplete(t *testing.T) {
+	tests := []struct {
+		bits []byte
+		size uint32
+		complete bool
+	} {
+		{ []byte { 0xFF, 0xFF, 0xC0 }, 18, true },
+		{ []byte { 0xFF, 0x7F, 0xC0 }, 18, false },
+		{ []byte { 0x7F, 0xFF }, 16, false },
+		{ []byte { 0xFF, 0xFF, 0x80 }, 18, false },
+		{ []byte { 0xFF, 0xFF }, 16, true },
+		{ []byte { 0xF0 }, 4, true },
+	}
+	for _, test := range tests {
+		bs := NewBitSet(test.size)
+		copy(bs.bits, test.bits)
+		if complete := bs.IsComplete(); complete != test.complete {
+			t.Errorf("%#v - Expected: %v, Actual: %v", test.bits, test.complete, complete)
+		}
+	}
+}
+
+func TestNewBitSetFromLength(t *testing.T) {
+	for _, bits := range [][]byte { {}, { 0xFF }, { 0xFF, 0xFF, 0x00 } } {
+		if _, err := NewBitSetFrom(bits, 16); err != errBitfieldLength {
+			t.Errorf("%#v - Expected: %v, Actual: %v", bits, errBitfieldLength, err)
+		}
+	}
+	if _, err := NewBitSetFrom([]byte { 0xFF, 0xFF }, 16); err != nil {
+		t.Errorf("Expected: <nil>, Actual: %v", err)
+	}
+}
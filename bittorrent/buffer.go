@@ -41,7 +41,7 @@ func (rb * RingBuffer) Fill(in <-chan ProtocolMessage) {
 	for !rb.IsFull() {
 		select {
 			case msg := <- in: rb.Add(msg)
-			default: break
+			default: return
 		}
 	}
 }
@@ -0,0 +1,28 @@
+package bittorrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingBufferFillReturnsWhenInputEmpty(t *testing.T) {
+	in := make(chan ProtocolMessage, 3)
+	in <- Have(1)
+	in <- Have(2)
+
+	rb := NewRingBuffer(5)
+	done := make(chan struct{})
+	go func() {
+		rb.Fill(in)
+		close(done)
+	}()
+
+	select {
+	case <- done:
+	case <- time.After(time.Second):
+		t.Fatal("Fill did not return with no input available")
+	}
+	if rb.size != 2 {
+		t.Errorf("Expected: 2, Actual: %v", rb.size)
+	}
+}
@@ -0,0 +1,145 @@
+package bittorrent
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var (
+	CHOKE_INTERVAL = 10 * time.Second
+	OPTIMISTIC_UNCHOKE_INTERVAL = 30 * time.Second
+	UNCHOKE_SLOTS = 4                 // regular unchokes, in addition to the optimistic one
+	NEW_PEER_PERIOD = 1 * time.Minute // peers connected this recently are new...
+	NEW_PEER_WEIGHT = 3               // ...& this many times as likely to be optimistically unchoked
+)
+
+// ----------------------------------------------------------------------------------
+// Choker - decides which peers we upload to (tit-for-tat). Run every CHOKE_INTERVAL
+// it unchokes the interested peers we download fastest from or, once seeding, each
+// interested peer in turn. One further peer is unchoked optimistically & rotated
+// every OPTIMISTIC_UNCHOKE_INTERVAL so new peers can prove themselves. Peers snubbing
+// us may only be unchoked optimistically.
+// ----------------------------------------------------------------------------------
+
+type Choker struct {
+	slots int
+	peers map[*Peer]*chokeState
+	optimistic *Peer
+	rounds int // since the optimistic unchoke rotated
+	rand *rand.Rand
+}
+
+type chokeState struct {
+	seen time.Time    // first run the peer was present at
+	downloaded uint64 // total at the previous run
+	rate uint64       // downloaded since the previous run
+	served time.Time  // last run the peer held a slot at
+}
+
+// Creates a choker with the given number of regular slots (0 = default)
+func NewChoker(slots int) *Choker {
+	if slots == 0 {
+		slots = UNCHOKE_SLOTS
+	}
+	return &Choker {
+		slots : slots,
+		peers : make(map[*Peer]*chokeState),
+		rand : rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Chokes & unchokes peers. Messages are queued on each peer & sent as it is processed.
+func (c * Choker) Run(peers []*Peer, seeding bool) {
+	now := time.Now()
+	c.update(peers, now)
+
+	// Candidates are interested peers, best first
+	var interested []*Peer
+	for _, p := range peers {
+		if p.state.remoteInterest {
+			interested = append(interested, p)
+		}
+	}
+	if seeding {
+		sort.SliceStable(interested, func(i, j int) bool {
+			return c.peers[interested[i]].served.Before(c.peers[interested[j]].served)
+		})
+	} else {
+		sort.SliceStable(interested, func(i, j int) bool {
+			return c.peers[interested[i]].rate > c.peers[interested[j]].rate
+		})
+	}
+
+	unchoke := make(map[*Peer]bool)
+	for _, p := range interested {
+		if len(unchoke) == c.slots {
+			break
+		}
+		if seeding || !p.snubbed {
+			unchoke[p] = true
+		}
+	}
+
+	// Rotate optimistic unchoke when due or when it no longer needs a slot
+	c.rounds++
+	if c.optimistic == nil || c.optimistic.closed || !c.optimistic.state.remoteInterest ||
+	   unchoke[c.optimistic] || time.Duration(c.rounds) * CHOKE_INTERVAL >= OPTIMISTIC_UNCHOKE_INTERVAL {
+		c.optimistic = c.pickOptimistic(interested, unchoke, now)
+		c.rounds = 0
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, p := range peers {
+		if unchoke[p] {
+			c.peers[p].served = now
+			p.UnchokeRemote()
+		} else {
+			p.ChokeRemote()
+		}
+	}
+}
+
+// Returns the peer currently optimistically unchoked, if any
+func (c * Choker) Optimistic() *Peer {
+	return c.optimistic
+}
+
+// Records download since the previous run & forgets closed peers
+func (c * Choker) update(peers []*Peer, now time.Time) {
+	current := make(map[*Peer]*chokeState, len(peers))
+	for _, p := range peers {
+		cs, ok := c.peers[p]
+		if !ok {
+			cs = &chokeState { seen : now, downloaded : p.Statistics().totalBytesDownloaded }
+		}
+		total := p.Statistics().totalBytesDownloaded
+		cs.rate, cs.downloaded = total - cs.downloaded, total
+		current[p] = cs
+	}
+	c.peers = current
+}
+
+// Picks a random interested peer without a regular slot. New peers are more likely
+// to be picked.
+func (c * Choker) pickOptimistic(interested []*Peer, unchoke map[*Peer]bool, now time.Time) *Peer {
+	var candidates []*Peer
+	for _, p := range interested {
+		if unchoke[p] {
+			continue
+		}
+		weight := 1
+		if now.Sub(c.peers[p].seen) < NEW_PEER_PERIOD {
+			weight = NEW_PEER_WEIGHT
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[c.rand.Intn(len(candidates))]
+}
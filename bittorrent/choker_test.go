@@ -0,0 +1,128 @@
+package bittorrent
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newTestChokePeers(n int) []*Peer {
+	peers := make([]*Peer, n)
+	for i := range peers {
+		peers[i] = &Peer {
+			localQ : NewMessageQueue(RequestQueueSize),
+			remoteQ : NewMessageQueue(RequestQueueSize),
+			state : NewPeerState(NewBitSet(4)),
+			statistics : &Statistics{},
+		}
+		peers[i].state.remoteInterest = true
+	}
+	return peers
+}
+
+func newTestChoker(slots int) *Choker {
+	c := NewChoker(slots)
+	c.rand = rand.New(rand.NewSource(1))
+	return c
+}
+
+func unchoked(peers []*Peer) map[*Peer]bool {
+	m := make(map[*Peer]bool)
+	for _, p := range peers {
+		if !p.state.remoteChoke {
+			m[p] = true
+		}
+	}
+	return m
+}
+
+func TestChokerLeeching(t *testing.T) {
+	peers := newTestChokePeers(7)
+	peers[6].state.remoteInterest = false
+	c := newTestChoker(3)
+	c.Run(peers, false)
+	before := unchoked(peers)
+	for _, p := range peers {
+		p.localQ.other = nil
+	}
+
+	// Download from 1, 3 & 5 fastest
+	for i, n := range []uint { 10, 50, 20, 40, 0, 30 } {
+		peers[i].Statistics().Downloaded(n * 1024)
+	}
+	c.Run(peers, false)
+
+	u := unchoked(peers)
+	if len(u) != 4 || !u[peers[1]] || !u[peers[3]] || !u[peers[5]] || u[peers[6]] {
+		t.Errorf("Expected 1, 3, 5 & one optimistic unchoked, Actual: %v", u)
+	}
+	if o := c.Optimistic(); o == nil || !u[o] || o == peers[1] || o == peers[3] || o == peers[5] {
+		t.Errorf("Unexpected optimistic unchoke: %v", o)
+	}
+
+	// Messages are queued only on changes
+	for i, p := range peers {
+		want := 0
+		if u[p] != before[p] {
+			want = 1
+		}
+		if len(p.localQ.other) != want {
+			t.Errorf("Peer %v - Expected: %v messages, Actual: %v", i, want, p.localQ.other)
+		}
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	peers := newTestChokePeers(20)
+	c := newTestChoker(1)
+	c.Run(peers, false)
+	first := c.Optimistic()
+
+	// Kept until the interval passes
+	rounds := int(OPTIMISTIC_UNCHOKE_INTERVAL / CHOKE_INTERVAL)
+	for i := 1; i < rounds; i++ {
+		if c.Run(peers, false); c.Optimistic() != first {
+			t.Fatalf("Optimistic unchoke rotated after %v rounds", i)
+		}
+	}
+
+	// Replaced once it closes
+	first.closed = true
+	c.Run(peers, false)
+	if c.Optimistic() == first {
+		t.Error("Closed peer still optimistically unchoked")
+	}
+}
+
+func TestChokerSeedingRoundRobin(t *testing.T) {
+	peers := newTestChokePeers(6)
+	c := newTestChoker(2)
+	c.optimistic = peers[5] // fixed, so only regular slots rotate
+
+	served := make(map[*Peer]bool)
+	for i := 0; i < 3; i++ {
+		c.Run(peers, true)
+		for p := range unchoked(peers) {
+			served[p] = true
+		}
+	}
+	if len(served) != len(peers) {
+		t.Errorf("Expected all peers served, Actual: %v of %v", len(served), len(peers))
+	}
+}
+
+func TestChokerSnubbed(t *testing.T) {
+	peers := newTestChokePeers(3)
+	c := newTestChoker(1)
+	c.Run(peers, false)
+
+	// Fastest, but snubbing us
+	peers[0].Statistics().Downloaded(50 * 1024)
+	peers[1].Statistics().Downloaded(10 * 1024)
+	peers[0].snubbed = true
+	c.optimistic = peers[2]
+	c.Run(peers, false)
+
+	if u := unchoked(peers); len(u) != 2 || u[peers[0]] || !u[peers[1]] {
+		t.Errorf("Expected 1 & optimistic unchoked, Actual: %v", u)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"errors"
 	"crypto/rand"
+	"crypto/sha1"
 	"bytes"
+	"net"
 )
 
 const (
@@ -22,6 +24,20 @@ const (
 	cancelId
 )
 
+const (
+	// Fast extension (BEP 6) message ids (13 ... 17)
+	suggestPieceId byte = iota + 0x0D
+	haveAllId
+	haveNoneId
+	rejectRequestId
+	allowedFastId
+)
+
+const (
+	// Extension protocol (BEP 10)
+	extendedId byte = 20
+)
+
 const (
 	// Fixed message lengths
 	chokeLength uint32        = 1
@@ -32,6 +48,17 @@ const (
 	cancelLength uint32       = 13
 	requestLength uint32      = 13
 	handshakeLength uint32    = 68
+	suggestPieceLength uint32 = 5
+	haveAllLength uint32      = 1
+	haveNoneLength uint32     = 1
+	rejectLength uint32       = 13
+	allowedFastLength uint32  = 5
+)
+
+const (
+	// Minimum message lengths
+	blockMinLength uint32    = 9
+	extendedMinLength uint32 = 2
 )
 
 ////////////////////////////////////////////////////////////////////////////////////////////////
@@ -76,6 +103,16 @@ func init() {
 	PeerId = append(clientId, randBytes...)
 }
 
+var errUnknownProtocol = errors.New("Handshake protocol is not BitTorrent")
+
+// Reserved bits we support
+var supportedReserved = [8]byte { 5 : extensionBit, 7 : fastBit }
+
+const (
+	extensionBit byte = 0x10 // reserved[5], BEP 10
+	fastBit byte = 0x04      // reserved[7], BEP 6
+)
+
 // TODO: This isn't great!
 type HandshakeMessage struct {
 	msg
@@ -86,15 +123,23 @@ type HandshakeMessage struct {
 }
 
 func (m HandshakeMessage) String() string {
-	return fmt.Sprintf("Handshake [%x, %v]", m.infoHash, m.peerId)
+	return fmt.Sprintf("Handshake [%x, %v, %x]", m.infoHash, m.peerId, m.reserved)
+}
+
+func (m HandshakeMessage) SupportsExtensions() bool {
+	return m.reserved[5] & extensionBit != 0
+}
+
+func (m HandshakeMessage) SupportsFast() bool {
+	return m.reserved[7] & fastBit != 0
 }
 
 // Incoming handshake
-func handshake(infoHash []byte, peerId []byte) *HandshakeMessage {
+func handshake(reserved [8]byte, infoHash []byte, peerId []byte) *HandshakeMessage {
 	return &HandshakeMessage{
 		msg { uint32(handshakeLength-4), 0}, // What a hack!...(sigh)
 		protocolName,
-		[8]byte {},
+		reserved,
 		infoHash,
 		string(peerId),
 	}
@@ -106,7 +151,7 @@ func Handshake(infoHash []byte) *HandshakeMessage {
 		panic(errors.New("Invalid info_hash length."))
 	}
 
-	return handshake(infoHash, PeerId)
+	return handshake(supportedReserved, infoHash, PeerId)
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////
@@ -307,20 +352,186 @@ func Cancel(index, begin, length uint32) *CancelMessage {
 	}
 }
 
+////////////////////////////////////////////////////////////////////////////////////////////////
+// Fast extension (BEP 6)
+//
+// Suggest Piece  <len=0005><id=13><index>
+// Have All       <len=0001><id=14>
+// Have None      <len=0001><id=15>
+// Reject Request <len=0013><id=16><index><begin><length>
+// Allowed Fast   <len=0005><id=17><index>
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+type SuggestPieceMessage struct {
+	msg
+	index uint32
+}
+
+func (m SuggestPieceMessage) Index() uint32 {
+	return m.index
+}
+
+func (m SuggestPieceMessage) String() string {
+	return fmt.Sprintf("SuggestPiece [%v]", m.index)
+}
+
+func SuggestPiece(i uint32) *SuggestPieceMessage {
+	return &SuggestPieceMessage { msg { len : suggestPieceLength, id : suggestPieceId }, i }
+}
+
+type HaveAllMessage struct {
+	msg
+}
+
+func (m HaveAllMessage) String() string {
+	return "HaveAll"
+}
+
+type HaveNoneMessage struct {
+	msg
+}
+
+func (m HaveNoneMessage) String() string {
+	return "HaveNone"
+}
+
+var (
+	HaveAll = &HaveAllMessage{ msg{ len : haveAllLength, id : haveAllId } }
+	HaveNone = &HaveNoneMessage{ msg{ len : haveNoneLength, id : haveNoneId } }
+)
+
+type RejectRequestMessage struct {
+	msg
+	index, begin, length uint32
+}
+
+func (m RejectRequestMessage) Index() uint32 {
+	return m.index
+}
+
+func (m RejectRequestMessage) Begin() uint32 {
+	return m.begin
+}
+
+func (m RejectRequestMessage) Length() uint32 {
+	return m.length
+}
+
+func (m RejectRequestMessage) String() string {
+	return fmt.Sprintf("RejectRequest [index:%v, begin:%v, length:%v]", m.index, m.begin, m.length)
+}
+
+func RejectRequest(index, begin, length uint32) *RejectRequestMessage {
+	return &RejectRequestMessage {
+		msg { len : rejectLength, id : rejectRequestId },
+		index,
+		begin,
+		length,
+	}
+}
+
+type AllowedFastMessage struct {
+	msg
+	index uint32
+}
+
+func (m AllowedFastMessage) Index() uint32 {
+	return m.index
+}
+
+func (m AllowedFastMessage) String() string {
+	return fmt.Sprintf("AllowedFast [%v]", m.index)
+}
+
+func AllowedFast(i uint32) *AllowedFastMessage {
+	return &AllowedFastMessage { msg { len : allowedFastLength, id : allowedFastId }, i }
+}
+
+// Calculates the canonical allowed fast set of k pieces for a peer (BEP 6). Only
+// IPv4 peers are supported.
+func AllowedFastSet(ip net.IP, infoHash []byte, numPieces uint32, k int) []uint32 {
+	ip = ip.To4()
+	if ip == nil || numPieces == 0 {
+		return nil
+	}
+	if uint32(k) > numPieces {
+		k = int(numPieces)
+	}
+
+	// x = SHA-1((0xFFFFFF00 & ip) + info_hash)
+	x := append([]byte { ip[0], ip[1], ip[2], 0 }, infoHash...)
+	set := make([]uint32, 0, k)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % numPieces
+			if !containsIndex(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+func containsIndex(set []uint32, index uint32) bool {
+	for _, i := range set {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////
+// Extended <len=0002+X><id=20><extended message id><payload>
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+type ExtendedMessage struct {
+	msg
+	extId byte
+	payload []byte
+}
+
+func (m ExtendedMessage) ExtId() byte {
+	return m.extId
+}
+
+func (m ExtendedMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m ExtendedMessage) String() string {
+	return fmt.Sprintf("Extended [id:%v, %v bytes]", m.extId, len(m.payload))
+}
+
+func Extended(extId byte, payload []byte) *ExtendedMessage {
+	return &ExtendedMessage {
+		msg { len : uint32(2+len(payload)), id : extendedId },
+		extId,
+		payload,
+	}
+}
+
 func ReadHandshake(buf []byte) ([]byte, ProtocolMessage) {
 
 	// Do we have enough data for handshake?
 	if len(buf) < int(handshakeLength) {
-		return nil, nil
+		return buf, nil
 	}
 
 	// Calculate handshake data & any remaining
 	data := buf[0:handshakeLength]
 	remainingBuf := buf[handshakeLength:]
 
-	// TODO: Assert the protocol & reserved bytes?
+	// Assert protocol, nothing else can follow
+	if !bytes.Equal(data[:len(plaintextPrefix)], plaintextPrefix) {
+		panic(errUnknownProtocol)
+	}
+	var reserved [8]byte
+	copy(reserved[:], data[20:28])
 
-	return remainingBuf, handshake(data[28:48], data[48:handshakeLength])
+	return remainingBuf, handshake(reserved, data[28:48], data[48:handshakeLength])
 }
 
 func Marshal(pm ProtocolMessage) []byte {
@@ -345,12 +556,18 @@ func Marshal(pm ProtocolMessage) []byte {
 		marshal(w, binary.BigEndian, msg.id)
 		marshal(w, binary.BigEndian, msg.bits)
 
+	case *ExtendedMessage:
+		marshal(w, binary.BigEndian, msg.len)
+		marshal(w, binary.BigEndian, msg.id)
+		marshal(w, binary.BigEndian, msg.extId)
+		marshal(w, binary.BigEndian, msg.payload)
+
 	case *HandshakeMessage:
 		marshal(w, binary.BigEndian, uint8(len(msg.protocol)))
 		marshal(w, binary.BigEndian, []byte(msg.protocol))
 		marshal(w, binary.BigEndian, msg.reserved)
 		marshal(w, binary.BigEndian, msg.infoHash)
-		marshal(w, binary.BigEndian, []byte(PeerId))
+		marshal(w, binary.BigEndian, []byte(msg.peerId))
 
 	default:
 		marshal(w, binary.BigEndian, pm)
@@ -382,9 +599,12 @@ func Unmarshal(buf []byte) ([]byte, ProtocolMessage) {
 	data := remainingBuf[:msgLen]
 	remainingBuf = remainingBuf[msgLen:]
 
-	// Build a message
+	// Build a message, skipping any with the wrong length for their id
 	messageId := data[0]
 	data = data[1:]
+	if !isValidLength(messageId, msgLen) {
+		return remainingBuf, nil
+	}
 	switch messageId {
 	case chokeId: return remainingBuf, Choke
 	case unchokeId: return remainingBuf, Unchoke
@@ -409,12 +629,47 @@ func Unmarshal(buf []byte) ([]byte, ProtocolMessage) {
 		begin := toUint32(data[4:8])
 		length := toUint32(data[8:12])
 		return remainingBuf, Cancel(index, begin, length)
+	case suggestPieceId:
+		return remainingBuf, SuggestPiece(toUint32(data[0:4]))
+	case haveAllId: return remainingBuf, HaveAll
+	case haveNoneId: return remainingBuf, HaveNone
+	case rejectRequestId:
+		index := toUint32(data[0:4])
+		begin := toUint32(data[4:8])
+		length := toUint32(data[8:12])
+		return remainingBuf, RejectRequest(index, begin, length)
+	case allowedFastId:
+		return remainingBuf, AllowedFast(toUint32(data[0:4]))
+	case extendedId:
+		return remainingBuf, Extended(data[0], data[1:])
 	default:
-		fmt.Printf("Unknown message: %v", data)
+		// Unsupported message - skip it. Extensions must use extended messages.
 		return remainingBuf, nil
 	}
 }
 
+// Returns whether a message length (including the id) is valid for the message id.
+// Unsupported ids may be any length.
+func isValidLength(id byte, msgLen uint32) bool {
+	switch id {
+	case chokeId: return msgLen == chokeLength
+	case unchokeId: return msgLen == unchokeLength
+	case interestedId: return msgLen == interestedLength
+	case uninterestedId: return msgLen == uninterestedLength
+	case haveId: return msgLen == haveLength
+	case requestId: return msgLen == requestLength
+	case blockId: return msgLen >= blockMinLength
+	case cancelId: return msgLen == cancelLength
+	case suggestPieceId: return msgLen == suggestPieceLength
+	case haveAllId: return msgLen == haveAllLength
+	case haveNoneId: return msgLen == haveNoneLength
+	case rejectRequestId: return msgLen == rejectLength
+	case allowedFastId: return msgLen == allowedFastLength
+	case extendedId: return msgLen >= extendedMinLength
+	default: return true
+	}
+}
+
 func toUint32(bytes []byte) uint32 {
 
 	var a uint32
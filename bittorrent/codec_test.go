@@ -0,0 +1,75 @@
+package bittorrent
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+
+	// Example from BEP 6
+	infoHash := bytes.Repeat([]byte { 0xaa }, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	expected := []uint32 { 1059, 431, 808, 1217, 287, 376, 1188 }
+	if set := AllowedFastSet(ip, infoHash, 1313, 7); !reflect.DeepEqual(set, expected) {
+		t.Errorf("Expected: %v, Actual: %v", expected, set)
+	}
+	expected = append(expected, 353, 508)
+	if set := AllowedFastSet(ip, infoHash, 1313, 9); !reflect.DeepEqual(set, expected) {
+		t.Errorf("Expected: %v, Actual: %v", expected, set)
+	}
+}
+
+func TestFastMessagesRoundTrip(t *testing.T) {
+	msgs := []ProtocolMessage {
+		SuggestPiece(7),
+		HaveAll,
+		HaveNone,
+		RejectRequest(1, 16384, 16384),
+		AllowedFast(42),
+	}
+	for _, msg := range msgs {
+		buf := Marshal(msg)
+		_, actual := Unmarshal(buf)
+		if !reflect.DeepEqual(msg, actual) {
+			t.Errorf("Expected: %v, Actual: %v", msg, actual)
+		}
+	}
+}
+
+func TestUnmarshalWrongLength(t *testing.T) {
+	msgs := [][]byte {
+		{ 0, 0, 0, 2, chokeId, 0 },
+		{ 0, 0, 0, 1, haveId },
+		{ 0, 0, 0, 4, haveId, 0, 0, 1 },
+		{ 0, 0, 0, 5, requestId, 0, 0, 0, 1 },
+		{ 0, 0, 0, 8, blockId, 0, 0, 0, 1, 0, 0, 0 },
+		{ 0, 0, 0, 9, cancelId, 0, 0, 0, 1, 0, 0, 0, 2 },
+		{ 0, 0, 0, 1, suggestPieceId },
+		{ 0, 0, 0, 2, haveAllId, 0 },
+		{ 0, 0, 0, 12, rejectRequestId, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0 },
+		{ 0, 0, 0, 1, allowedFastId },
+		{ 0, 0, 0, 1, extendedId },
+	}
+	for _, msg := range msgs {
+		next := append(msg, 0, 0, 0, 0)
+		remaining, actual := Unmarshal(next)
+		if actual != nil {
+			t.Errorf("%v - Expected: <nil>, Actual: %v", msg, actual)
+		}
+		if !bytes.Equal(remaining, []byte { 0, 0, 0, 0 }) {
+			t.Errorf("%v - Expected message to be skipped, Remaining: %v", msg, remaining)
+		}
+	}
+}
+
+func TestUnmarshalEmptyBlock(t *testing.T) {
+	_, msg := Unmarshal([]byte { 0, 0, 0, 9, blockId, 0, 0, 0, 1, 0, 0, 0, 2 })
+	block, ok := msg.(*BlockMessage)
+	if !ok || block.Index() != 1 || block.Begin() != 2 || len(block.Block()) != 0 {
+		t.Errorf("Unexpected message: %v", msg)
+	}
+}
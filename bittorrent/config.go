@@ -0,0 +1,73 @@
+package bittorrent
+
+import (
+	"github.com/g-dx/chimera/dht"
+	"github.com/g-dx/chimera/utp"
+)
+
+// ----------------------------------------------------------------------------------
+// Config - settings & shared services used by every PeerCoordinator
+// ----------------------------------------------------------------------------------
+
+type Config struct {
+
+	// Identifies us in handshakes & tracker announces (nil = PeerId). Allows many clients in one process.
+	PeerId []byte
+
+	// Directory torrent data is read from & saved to (empty = the coordinator's dir)
+	DownloadDir string
+
+	// Port on which we accept peer connections (0 = not accepting)
+	Port int
+
+	// Message stream encryption of peer connections
+	Encryption EncryptionPolicy
+
+	// Socket used to connect to & accept peers over uTP (nil = TCP only)
+	UTP *utp.Socket
+
+	// Proxy through which peers are connected to (nil = connect directly). uTP is
+	// not used when proxied.
+	Proxy *Proxy
+
+	// Makes outgoing peer connections (nil = through Proxy or over UTP & TCP). Takes
+	// precedence over UTP & Proxy.
+	Dialer Dialer
+
+	// Accepts incoming peer connections on Port (nil = not accepting)
+	Listener *PeerListener
+
+	// Blocks peers learned from any source (nil = no filter). Incoming connections
+	// are filtered by the listener.
+	IPFilter *IPFilter
+
+	// Bounds connections across every torrent (nil = each torrent has its own)
+	Connections *ConnectionManager
+
+	// Session wide bandwidth limits shared by every torrent (nil = unlimited)
+	RateLimits *RateLimits
+
+	// Aggregates transfer statistics of every torrent sharing it (nil = none)
+	Statistics *SessionStatistics
+
+	// Only count block payload, not protocol overhead, towards bandwidth limits
+	ExcludeOverhead bool
+
+	// Start super seeding (BEP 16), may be changed later with SetSuperSeeding
+	SuperSeed bool
+
+	// Mainline DHT node used to find peers (nil = disabled). Must not be started when
+	// using a proxy with NoDHT.
+	DHT *dht.Node
+
+	// Queries trackers (nil = DefaultTrackerClient). When proxied, build it from
+	// Proxy.TrackerConfig so announces are proxied too.
+	Tracker *TrackerClient
+
+	// Local service discovery used to find peers on the LAN (nil = disabled). Ignored
+	// when using a proxy.
+	LSD *LocalServiceDiscovery
+
+	// Additional extension protocol handlers registered for every torrent
+	Extensions []ExtensionHandler
+}
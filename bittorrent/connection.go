@@ -10,88 +10,150 @@ import (
 	"errors"
 	"log"
 	"os"
+	"io/ioutil"
+	"bufio"
+	"context"
+	"sync"
+	"encoding/binary"
 )
 
 var (
 	MAX_OUTGOING_BUFFER = 25 // max pending messages to write out on connection
 	MAX_INCOMING_BUFFER = 25 // max pending messages to send upstream
 	READ_BUFFER_SIZE = 4096
+	MAX_MESSAGE_LENGTH = 1 << 20 // larger than any block, bitfield or metadata piece
 
-	ONE_SECOND = 1 * time.Second
-	KEEP_ALIVE_PERIOD = 1 * time.Minute
+	KEEP_ALIVE_PERIOD = 1 * time.Minute  // idle time before we send a keep-alive
+	KEEP_ALIVE_TIMEOUT = 2 * time.Minute // idle time before the remote is dropped
+	WRITE_TIMEOUT = 1 * time.Minute      // time for a remote to accept one message
 	DIAL_TIMEOUT = 10 * time.Second
+	UTP_DIAL_TIMEOUT = 3 * time.Second
 	HANDSHAKE_TIMEOUT = 5 * time.Second
-	ONE_HUNDRED_MILLIS = 100 * time.Millisecond
-	FIVE_HUNDRED_MILLIS = 5 * ONE_HUNDRED_MILLIS
 
 	errHashesNotEquals = errors.New("Info hashes not equal")
 	errHandshakeNotReceived =
 		errors.New(fmt.Sprintf("Handshake not received in: %v", HANDSHAKE_TIMEOUT))
-	errFirstMessageNotHandshake =
-		errors.New("First message is not handshake")
 	errKeepAliveExpired =
 		errors.New("Read KeepAlive expired")
+	errSelfConnection =
+		errors.New("Connected to ourself")
+	errMessageTooLong =
+		errors.New(fmt.Sprintf("Message longer than: %v", MAX_MESSAGE_LENGTH))
+	errInvalidMessageLength =
+		errors.New("Message length invalid for message id")
 )
 
 type PeerIdentity struct {
-	id []byte      // from handshake
-	address string // ip:port
+	id []byte         // from handshake
+	address string    // ip:port
+	reserved [8]byte  // from handshake
+}
+
+func (pi PeerIdentity) SupportsExtensions() bool {
+	return pi.reserved[5] & supportedReserved[5] & extensionBit != 0
+}
+
+func (pi PeerIdentity) SupportsFast() bool {
+	return pi.reserved[7] & supportedReserved[7] & fastBit != 0
 }
 
 func (pi PeerIdentity) String() string {
 	return pi.address
 }
 
+// ----------------------------------------------------------------------------------
+// PeerConnection - reads & writes protocol messages on its own goroutines. Messages
+// read are sent to a bounded channel & messages to write are received from another,
+// so a slow peer or consumer applies backpressure rather than buffering without
+// limit. The first error is reported once & stops both goroutines.
+// ----------------------------------------------------------------------------------
+
 type PeerConnection struct {
-	close chan<- struct{}
-	in IncomingPeerConnection
-	out OutgoingPeerConnection
+	conn net.Conn
+	r *bufio.Reader
+	remote *HandshakeMessage // read before ours is sent on incoming connections
 	logger *log.Logger
+
+	// Bandwidth limiters, most specific first
+	up, down []*RateLimiter
+	excludeOverhead bool
+
+	ctx context.Context
+	cancel context.CancelFunc
+	wg sync.WaitGroup
+	errOnce sync.Once
+	closeOnce sync.Once
+	closeErr error
 }
 
-func NewConnection(addr string) (*PeerConnection, error) {
+func NewConnection(addr string,
+				   infoHash []byte,
+				   policy EncryptionPolicy,
+				   d Dialer) (*PeerConnection, error) {
 
 	fmt.Printf("Connecting to: %v\n", addr)
-	conn, err := net.DialTimeout("tcp", addr, DIAL_TIMEOUT)
+	conn, err := dial(addr, infoHash, policy, d)
 	if err != nil {
 		return nil, err
 	}
+	return newPeerConnection(conn), nil
+}
+
+// Wraps an accepted connection, completing an encrypted handshake if the remote
+// initiated one for any of the given info hashes
+func NewIncomingConnection(conn net.Conn,
+						   policy EncryptionPolicy,
+						   infoHashes [][]byte) (*PeerConnection, error) {
 
-	c := make(chan struct{}, 2) // 2 close messages - one for reader, other for writer
-	pc := &PeerConnection{
-		close : c,
-		in : IncomingPeerConnection {
-			close : c,
-			c : nil,
-			conn : conn,
-			buffer : make([]byte, 0),
-			pending : make([]ProtocolMessage, 0, MAX_INCOMING_BUFFER),
-			readHandshake : false,
-		},
-		out : OutgoingPeerConnection {
-			close : c,
-			c : nil,
-			conn : conn,
-			curr : make([]byte, 0),
-		},
+	ec, err := acceptMse(conn, policy, infoHashes)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	return pc, nil
+	return newPeerConnection(ec), nil
 }
 
-func (pc * PeerConnection) Establish(in <-chan ProtocolMessage,
-									 out chan<- ProtocolMessage,
+func newPeerConnection(conn net.Conn) *PeerConnection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeerConnection{
+		conn : conn,
+		r : bufio.NewReaderSize(conn, READ_BUFFER_SIZE),
+		logger : log.New(ioutil.Discard, "", 0), // until Establish creates log file
+		ctx : ctx,
+		cancel : cancel,
+	}
+}
+
+func (pc * PeerConnection) RemoteAddr() net.Addr {
+	return pc.conn.RemoteAddr()
+}
+
+// Limits bandwidth by each of the given limits (nil = unlimited), most specific first.
+// Must be called before Establish.
+func (pc * PeerConnection) SetRateLimits(excludeOverhead bool, limits ...*RateLimits) {
+	pc.excludeOverhead = excludeOverhead
+	for _, l := range limits {
+		if l != nil {
+			pc.up = append(pc.up, l.Upload)
+			pc.down = append(pc.down, l.Download)
+		}
+	}
+}
+
+// Completes the handshake & starts reading messages to in & writing messages from out.
+// The first error to occur is sent to e.
+func (pc * PeerConnection) Establish(out <-chan ProtocolMessage,
+									 in chan<- ProtocolMessage,
 									 e chan<- error,
                                      handshake *HandshakeMessage,
 									 logDir string) (*PeerIdentity, error) {
 
 	// Create log file & create loggers
-	f, err := os.Create(fmt.Sprintf("%v/%v.log", logDir, pc.in.conn.RemoteAddr()))
+	f, err := os.Create(fmt.Sprintf("%v/%v.log", logDir, pc.conn.RemoteAddr()))
 	if err != nil {
 		return nil, err
 	}
-	pc.in.logger  = log.New(f, " in  ->", log.Ldate | log.Ltime)
-	pc.out.logger = log.New(f, " out <-", log.Ldate | log.Ltime)
-	pc.logger     = log.New(f, "  -  --", log.Ldate | log.Ltime)
+	pc.logger = log.New(f, "  -  --", log.Ldate | log.Ltime)
 
 	// Ensure we handshake properly
 	id, err := pc.completeHandshake(handshake)
@@ -100,20 +162,45 @@ func (pc * PeerConnection) Establish(in <-chan ProtocolMessage,
 		return nil, err
 	}
 
-	// Connect up channels
-	pc.in.c = out
-	pc.out.c = in
-
 	// Start goroutines
-	go pc.in.loop(e)
-	go pc.out.loop(e)
+	pc.wg.Add(2)
+	go pc.readLoop(in, e, log.New(f, " in  ->", log.Ldate | log.Ltime))
+	go pc.writeLoop(out, e, log.New(f, " out <-", log.Ldate | log.Ltime))
 
 	pc.logger.Println("Established")
 	return id, nil
 }
 
-func (pc *PeerConnection) completeHandshake(outHandshake *HandshakeMessage) (pi *PeerIdentity, err error) {
-	// TODO: Refactor this to common logic...
+func (pc *PeerConnection) completeHandshake(outHandshake *HandshakeMessage) (*PeerIdentity, error) {
+
+	// Write outgoing handshake & read incoming handshake, unless already read
+	pc.conn.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if _, err := pc.conn.Write(Marshal(outHandshake)); err != nil {
+		return nil, err
+	}
+	pc.conn.SetWriteDeadline(time.Time{})
+	inHandshake := pc.remote
+	if inHandshake == nil {
+		var err error
+		inHandshake, err = pc.ReceiveHandshake([]byte(outHandshake.peerId))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Assert hashes & that we didn't connect to ourself
+	if !bytes.Equal(outHandshake.infoHash, inHandshake.infoHash) {
+		return nil, errHashesNotEquals
+	}
+	if inHandshake.peerId == outHandshake.peerId {
+		return nil, errSelfConnection
+	}
+	return &PeerIdentity { []byte(inHandshake.peerId), pc.conn.RemoteAddr().String(), inHandshake.reserved }, nil
+}
+
+// Reads the remote handshake, rejecting any from one of our own peer ids. Incoming
+// connections call this before Establish to find which torrent the remote wants.
+func (pc *PeerConnection) ReceiveHandshake(localIds ...[]byte) (hs *HandshakeMessage, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(runtime.Error); ok {
@@ -123,227 +210,164 @@ func (pc *PeerConnection) completeHandshake(outHandshake *HandshakeMessage) (pi
 		}
 	}()
 
-	// TODO: we should possibly be first reading if this is an incoming connection
-	// Write outgoing handshake & attempt to read incoming handshake
-	pc.out.append(outHandshake)
-	pc.out.writeOrReceiveFor(HANDSHAKE_TIMEOUT)
-	pc.in.readOrSleepFor(HANDSHAKE_TIMEOUT)
-	if len(pc.in.pending) == 0 {
-		return nil, errHandshakeNotReceived
-	}
-	msg := pc.in.pending[0]
-	pc.in.pending = pc.in.pending[1:]
-
-	// Assert handshake
-	inHandshake, ok := msg.(*HandshakeMessage)
-	if !ok {
-		return nil, errFirstMessageNotHandshake
+	pc.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	buf := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(pc.r, buf); err != nil {
+		if isTimeout(err) {
+			return nil, errHandshakeNotReceived
+		}
+		return nil, err
 	}
-
-	// Assert hashes
-	if !bytes.Equal(outHandshake.infoHash, inHandshake.infoHash) {
-		return nil, errHashesNotEquals
+	_, msg := ReadHandshake(buf)
+	pc.logger.Print(msg)
+
+	// Assert that we didn't connect to ourself
+	hs = msg.(*HandshakeMessage)
+	for _, id := range localIds {
+		if hs.peerId == string(id) {
+			return nil, errSelfConnection
+		}
 	}
-	return &PeerIdentity { inHandshake.infoHash, pc.in.conn.RemoteAddr().String() }, nil
+	pc.remote = hs
+	return hs, nil
 }
 
+// Stops reading & writing & closes the connection. Safe to call more than once & from
+// any goroutine.
 func (pc *PeerConnection) Close() error {
+	pc.closeOnce.Do(func() {
+		pc.logger.Println("Closing connection")
 
-	pc.logger.Println("Closing connection")
+		// Unblock reader & writer then wait for them to exit
+		pc.cancel()
+		if err := pc.conn.Close(); !errors.Is(err, net.ErrClosed) {
+			pc.closeErr = err // already closed on error
+		}
+		pc.wg.Wait()
 
-	// Shutdown reader & writer
-	pc.close <- struct{}{}
-	pc.close <- struct{}{}
+		if pc.closeErr != nil {
+			pc.logger.Println(pc.closeErr)
+		}
+		pc.logger.Println("Connection closed")
+	})
+	return pc.closeErr
+}
 
-	// Finally, shutdown connection
-	err := pc.in.conn.Close()
-	if err != nil {
-		pc.logger.Println(err)
-		return err
-	}
-	pc.logger.Println("Connection closed")
-	return nil
+// Reports the first error to occur, unless closed, & stops reader & writer
+func (pc *PeerConnection) fail(err error, e chan<- error) {
+	pc.errOnce.Do(func() {
+		if pc.ctx.Err() == nil {
+			pc.logger.Println(err)
+			select {
+			case e <- err:
+			default:
+			}
+		}
+		pc.cancel()
+		pc.conn.Close()
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////
 // Incoming Connection
 ////////////////////////////////////////////////////////////////////////////////////////////////
 
-type IncomingPeerConnection struct {
-	close <-chan struct{}
-	c chan<- ProtocolMessage
-	conn net.Conn
-	buffer []byte
-	pending []ProtocolMessage
-	readHandshake bool
-	logger *log.Logger
-}
-
-func (ic * IncomingPeerConnection) loop(err chan<- error) {
-	defer onLoopExit(err)
-	var keepAlive = time.After(KEEP_ALIVE_PERIOD)
+func (pc * PeerConnection) readLoop(in chan<- ProtocolMessage, e chan<- error, logger *log.Logger) {
+	defer pc.wg.Done()
 	for {
-		c, next := ic.maybeEnableSend()
-		select {
-		case <- ic.close: break
-		case <- keepAlive:
-			err <- errKeepAliveExpired
-			break
-		case c <- next: ic.pending = ic.pending[1:]
-		default:
-			if n := ic.readOrSleepFor(ONE_SECOND); n > 0 {
-				keepAlive = time.After(KEEP_ALIVE_PERIOD)
+		// Remote must send something, if only a keep-alive, within the timeout
+		pc.conn.SetReadDeadline(time.Now().Add(KEEP_ALIVE_TIMEOUT))
+		msg, n, err := readMessage(pc.r)
+		if err != nil {
+			if isTimeout(err) {
+				err = errKeepAliveExpired
 			}
+			pc.fail(err, e)
+			break
 		}
-	}
-	ic.logger.Println("Loop exit")
-}
+		logger.Print(msg)
 
-func (ic * IncomingPeerConnection) readOrSleepFor(d time.Duration) (int) {
-	if len(ic.pending) >= MAX_INCOMING_BUFFER {
-		ic.logger.Println("Incoming buffer full - sleeping...")
-		time.Sleep(d)	// too many outstanding messages
-		return 0
-	}
+		// Charge for what was read, delaying the next read if over the limit
+		if waitAll(pc.ctx, pc.down, rateLimitedBytes(msg, n, pc.excludeOverhead)) != nil {
+			break
+		}
 
-	// Set deadline, read as much as possible & attempt to unmarshal message
-	ic.conn.SetReadDeadline(time.Now().Add(d))
-	buf, n := read(ic.conn)
-	ic.buffer = append(ic.buffer, buf...)
-	ic.maybeReadMessage()
-	return n
-}
+		// Remove keepalive & unsupported messages
+		if msg == nil || msg == KeepAliveMessage {
+			continue
+		}
 
-func (ic * IncomingPeerConnection) maybeEnableSend() (chan<- ProtocolMessage, ProtocolMessage) {
-	var c chan<- ProtocolMessage
-	var next ProtocolMessage
-	if len(ic.pending) > 0 {
-		next = ic.pending[0]
-		c = ic.c
+		// Block until there is space upstream
+		select {
+		case in <- msg:
+			continue
+		case <- pc.ctx.Done():
+		}
+		break
 	}
-	return c, next
+	logger.Println("Loop exit")
 }
 
-func (ic * IncomingPeerConnection) maybeReadMessage() {
-	var msg ProtocolMessage
-	if !ic.readHandshake {
-		ic.buffer, msg = ReadHandshake(ic.buffer)
-		if msg != nil {
-			ic.readHandshake = true
-		}
-	} else {
-		ic.buffer, msg = Unmarshal(ic.buffer)
+// Reads a single length prefixed message & returns it with its length on the wire.
+// Unsupported messages are returned as nil, malformed ones as an error.
+func readMessage(r io.Reader) (ProtocolMessage, int, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, 0, err
 	}
-
-	if msg != nil {
-		ic.logger.Print(msg)
+	msgLen := binary.BigEndian.Uint32(buf)
+	if msgLen > uint32(MAX_MESSAGE_LENGTH) {
+		return nil, 0, errMessageTooLong
 	}
-
-	// Remove keepalive
-	if msg != nil && msg != KeepAliveMessage {
-		ic.pending = append(ic.pending, msg)
+	buf = append(buf, make([]byte, msgLen)...)
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, 0, err
+	}
+	if msgLen > 0 && !isValidLength(buf[4], msgLen) {
+		return nil, 0, errInvalidMessageLength
 	}
+	_, msg := Unmarshal(buf)
+	return msg, len(buf), nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////
 // Outgoing Connection
 ////////////////////////////////////////////////////////////////////////////////////////////////
 
-type OutgoingPeerConnection struct {
-	close <-chan struct{}
-	c <-chan ProtocolMessage
-	conn net.Conn
-	curr []byte
-	logger *log.Logger
-}
-
-func (oc * OutgoingPeerConnection) loop(err chan<- error) {
-	defer onLoopExit(err)
-	var keepAlive = time.After(KEEP_ALIVE_PERIOD)
+func (pc * PeerConnection) writeLoop(out <-chan ProtocolMessage, e chan<- error, logger *log.Logger) {
+	defer pc.wg.Done()
+	keepAlive := time.NewTimer(KEEP_ALIVE_PERIOD)
+	defer keepAlive.Stop()
 	for {
-		c := oc.maybeEnableReceive()
+		var msg ProtocolMessage
 		select {
-		case <- oc.close: break
-		case <- keepAlive: oc.append(KeepAliveMessage)
-		case msg := <- c: oc.append(msg)
-		default:
-			if n := oc.writeOrReceiveFor(FIVE_HUNDRED_MILLIS); n > 0 {
-				keepAlive = time.After(KEEP_ALIVE_PERIOD)
-			}
-		}
-	}
-	oc.logger.Println("Loop exit")
-}
-
-func (oc * OutgoingPeerConnection) maybeEnableReceive() <-chan ProtocolMessage {
-	var c <-chan ProtocolMessage
-	if len(oc.curr) == 0 {
-		c = oc.c
-	}
-	return c
-}
-
-func (oc * OutgoingPeerConnection) append(msg ProtocolMessage) {
-	oc.logger.Print(msg)
-	oc.curr = append(oc.curr, Marshal(msg)...)
-}
-
-func (oc * OutgoingPeerConnection) writeOrReceiveFor(d time.Duration) (bytes int) {
-
-	if len(oc.curr) == 0 {
-
-		// Receive until timeout
-		select {
-		case msg := <- oc.c: oc.curr = Marshal(msg)
-		case <- time.After(d):
+		case <- pc.ctx.Done():
+		case <- keepAlive.C: msg = KeepAliveMessage
+		case msg = <- out:
 		}
-	} else {
-
-		// Set deadline and write until timeout
-		oc.conn.SetWriteDeadline(time.Now().Add(ONE_HUNDRED_MILLIS))
-		timeout := false
-		n := 0
-		for !timeout && len(oc.curr) > 0 {
-			oc.curr, n, timeout = write(oc.conn, oc.curr)
-			bytes += n
+		if msg == nil {
+			break
 		}
-	}
-	return bytes
-}
 
-func onLoopExit(c chan<- error) {
-	if r := recover(); r != nil {
-		if _, ok := r.(runtime.Error); ok {
-			panic(r)
+		buf := Marshal(msg)
+		if waitAll(pc.ctx, pc.up, rateLimitedBytes(msg, len(buf), pc.excludeOverhead)) != nil {
+			break
 		}
-		c <- r.(error)
-	}
-}
 
-// Actually does the write & checks for timeout
-func write(w io.Writer, buf []byte) ([]byte, int, bool) {
-	timeout := false
-	n, err := w.Write(buf)
-	if nil != err {
-		panicIfNotTimeout(err)
-		timeout = true
-	}
-	return buf[n:], n, timeout
-}
+		logger.Print(msg)
+		pc.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		if _, err := pc.conn.Write(buf); err != nil {
+			pc.fail(err, e)
+			break
+		}
 
-// Actually does the write & checks for timeout
-func read(r io.Reader) ([]byte, int) {
-	buf := make([]byte, READ_BUFFER_SIZE)
-	n, err := r.Read(buf)
-	if nil != err {
-		panicIfNotTimeout(err)
+		// Only idle connections need a keep-alive
+		keepAlive.Reset(KEEP_ALIVE_PERIOD)
 	}
-	return buf[:n], n
+	logger.Println("Loop exit")
 }
 
-// Panic if the error is not a timeout
-func panicIfNotTimeout(err error) {
-	if opErr, ok := err.(*net.OpError); (ok && !opErr.Timeout() || !ok) {
-		panic(err)
-	}
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
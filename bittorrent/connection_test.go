@@ -0,0 +1,157 @@
+package bittorrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	pc *PeerConnection
+	in, out chan ProtocolMessage
+	e chan error
+}
+
+// Returns both ends of an established TCP loopback connection
+func newTestConnPair(t *testing.T) (*testConn, *testConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sides write their handshake first
+	ends := make(chan *testConn, 2)
+	ids := [][]byte { []byte("-XX0001-localpeerid0"), remotePeerId }
+	for i, c := range []net.Conn { conn, <- accepted } {
+		go func(c net.Conn, id []byte) {
+			tc := &testConn {
+				pc : newPeerConnection(c),
+				in : make(chan ProtocolMessage, 1),
+				out : make(chan ProtocolMessage),
+				e : make(chan error, 1),
+			}
+			_, err := tc.pc.Establish(tc.out, tc.in, tc.e, handshake(supportedReserved, testInfoHash[:], id), t.TempDir())
+			if err != nil {
+				t.Error(err)
+			}
+			ends <- tc
+		}(c, ids[i])
+	}
+	a, b := <- ends, <- ends
+	t.Cleanup(func() { a.pc.Close(); b.pc.Close() })
+	return a, b
+}
+
+func receive(t *testing.T, c <-chan ProtocolMessage) ProtocolMessage {
+	select {
+	case msg := <- c:
+		return msg
+	case <- time.After(HANDSHAKE_TIMEOUT):
+		t.Fatal("Message not received")
+		return nil
+	}
+}
+
+func TestConnectionMessages(t *testing.T) {
+	a, b := newTestConnPair(t)
+
+	a.out <- Have(7)
+	b.out <- Request(1, 2, 3)
+	if msg, ok := receive(t, b.in).(*HaveMessage); !ok || msg.Index() != 7 {
+		t.Errorf("Expected: %v, Actual: %v", Have(7), msg)
+	}
+	if msg, ok := receive(t, a.in).(*RequestMessage); !ok || msg.Begin() != 2 {
+		t.Errorf("Expected: %v, Actual: %v", Request(1, 2, 3), msg)
+	}
+}
+
+func TestConnectionKeepAlive(t *testing.T) {
+	// Restored after connections are closed
+	period, timeout := KEEP_ALIVE_PERIOD, KEEP_ALIVE_TIMEOUT
+	t.Cleanup(func() { KEEP_ALIVE_PERIOD, KEEP_ALIVE_TIMEOUT = period, timeout })
+	KEEP_ALIVE_PERIOD = 20 * time.Millisecond
+	KEEP_ALIVE_TIMEOUT = 100 * time.Millisecond
+
+	// Idle connections stay open
+	a, b := newTestConnPair(t)
+	time.Sleep(5 * KEEP_ALIVE_TIMEOUT)
+	a.out <- Interested
+	if _, ok := receive(t, b.in).(*InterestedMessage); !ok {
+		t.Error("Expected: Interested")
+	}
+}
+
+func TestConnectionCloseReportsOnce(t *testing.T) {
+	a, b := newTestConnPair(t)
+
+	// Remote close is reported once, local close never
+	a.pc.Close()
+	a.pc.Close()
+	select {
+	case err := <- b.e:
+		if err == nil {
+			t.Error("Expected error")
+		}
+	case <- time.After(HANDSHAKE_TIMEOUT):
+		t.Fatal("Error not reported")
+	}
+	if err := b.pc.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <- a.e:
+		t.Errorf("Unexpected error: %v", err)
+	case err := <- b.e:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestReadMessageInvalidLength(t *testing.T) {
+	msgs := [][]byte {
+		{ 0, 0, 0, 1, allowedFastId },
+		{ 0, 0, 0, 5, requestId, 0, 0, 0, 1 },
+		{ 0, 0, 0, 5, blockId, 0, 0, 0, 1 },
+		{ 0, 0, 0, 3, cancelId, 0, 0 },
+	}
+	for _, msg := range msgs {
+		if _, _, err := readMessage(bytes.NewReader(msg)); err != errInvalidMessageLength {
+			t.Errorf("%v - Expected: %v, Actual: %v", msg, errInvalidMessageLength, err)
+		}
+	}
+
+	// Unsupported ids may be any length
+	msg, n, err := readMessage(bytes.NewReader([]byte { 0, 0, 0, 2, 0x63, 0 }))
+	if msg != nil || n != 6 || err != nil {
+		t.Errorf("Expected: <nil>, 6, <nil>, Actual: %v, %v, %v", msg, n, err)
+	}
+}
+
+func TestConnectionInvalidMessageFails(t *testing.T) {
+	a, b := newTestConnPair(t)
+
+	// Truncated request must drop the connection rather than the client
+	if _, err := a.pc.conn.Write([]byte { 0, 0, 0, 2, requestId, 0 }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <- b.e:
+		if err != errInvalidMessageLength {
+			t.Errorf("Expected: %v, Actual: %v", errInvalidMessageLength, err)
+		}
+	case <- time.After(HANDSHAKE_TIMEOUT):
+		t.Fatal("Error not reported")
+	}
+}
@@ -0,0 +1,265 @@
+package bittorrent
+
+import (
+	"container/heap"
+	"sync"
+)
+
+var (
+	MAX_CONNECTIONS = 200        // across all torrents
+	MAX_HALF_OPEN = 10           // outgoing connects in progress
+	MAX_CONNECTIONS_PER_IP = 1   // of each torrent
+
+	// Candidates from higher priority sources are connected to first
+	sourcePriority = map[PeerSource]int {
+		SourceLSD : 3,
+		SourceTracker : 2,
+		SourceMagnet : 2,
+		SourceDHT : 1,
+		SourcePEX : 0,
+	}
+)
+
+// ----------------------------------------------------------------------------------
+// ConnectionManager - bounds peer connections across all torrents. Each torrent
+// queues candidates which are dialled in priority order as slots become free.
+// ----------------------------------------------------------------------------------
+
+type ConnectionManager struct {
+	mu sync.Mutex
+	maxConns, maxHalfOpen, maxPerIP int
+	conns, halfOpen int
+	torrents []*TorrentConnections
+	seq uint64 // orders candidates of equal priority
+}
+
+// Creates a manager with the given limits (0 = default). The per IP limit applies to
+// each torrent, so a peer sharing several torrents with us may be connected for each.
+func NewConnectionManager(maxConns, maxHalfOpen, maxPerIP int) *ConnectionManager {
+	if maxConns == 0 {
+		maxConns = MAX_CONNECTIONS
+	}
+	if maxHalfOpen == 0 {
+		maxHalfOpen = MAX_HALF_OPEN
+	}
+	if maxPerIP == 0 {
+		maxPerIP = MAX_CONNECTIONS_PER_IP
+	}
+	return &ConnectionManager {
+		maxConns : maxConns,
+		maxHalfOpen : maxHalfOpen,
+		maxPerIP : maxPerIP,
+	}
+}
+
+// Registers a torrent allowed at most max connections. Queued candidates are passed
+// to dial, on a new goroutine, along with the slot they occupy.
+func (cm * ConnectionManager) Register(max int, dial func(PeerAddress, *ConnectionSlot)) *TorrentConnections {
+	tc := &TorrentConnections {
+		cm : cm,
+		max : max,
+		dial : dial,
+		known : make(map[string]bool),
+		sources : make(map[PeerSource]int),
+		perIP : make(map[string]int),
+	}
+	cm.mu.Lock()
+	cm.torrents = append(cm.torrents, tc)
+	cm.mu.Unlock()
+	return tc
+}
+
+// Dials the best candidates across all torrents while there are free slots
+// NOTE: Must hold cm.mu
+func (cm * ConnectionManager) schedule() {
+	for cm.halfOpen < cm.maxHalfOpen && cm.conns < cm.maxConns {
+
+		// Find best candidate of any torrent with room
+		var best *TorrentConnections
+		for _, tc := range cm.torrents {
+			if tc.conns < tc.max && len(tc.queue) > 0 &&
+			   (best == nil || tc.queue[0].before(best.queue[0])) {
+				best = tc
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		c := heap.Pop(&best.queue).(*candidate)
+		if best.perIP[c.addr.Ip] >= cm.maxPerIP {
+			best.forget(c.addr)
+			continue
+		}
+		slot := best.reserve(c.addr, true)
+		go best.dial(c.addr, slot)
+	}
+}
+
+// ----------------------------------------------------------------------------------
+// TorrentConnections - candidates & connections of a single torrent
+// ----------------------------------------------------------------------------------
+
+type TorrentConnections struct {
+	cm *ConnectionManager
+	max int
+	dial func(PeerAddress, *ConnectionSlot)
+	queue candidateQueue
+	known map[string]bool           // queued or connected addresses
+	sources map[PeerSource]int      // queued or connected by source
+	perIP map[string]int            // connections by IP
+	conns int
+}
+
+// Queues candidates to be dialled. Known addresses & addresses from sources which
+// have reached their limit are ignored.
+func (tc * TorrentConnections) Add(addrs []PeerAddress) {
+	tc.cm.mu.Lock()
+	defer tc.cm.mu.Unlock()
+	for _, pa := range addrs {
+		if tc.known[pa.GetIpAndPort()] {
+			continue
+		}
+		if limit, ok := sourceLimits[pa.Source]; ok && tc.sources[pa.Source] >= limit {
+			continue
+		}
+		tc.known[pa.GetIpAndPort()] = true
+		tc.sources[pa.Source]++
+		tc.cm.seq++
+		heap.Push(&tc.queue, &candidate { pa, sourcePriority[pa.Source], tc.cm.seq })
+	}
+	tc.cm.schedule()
+}
+
+// Reserves a slot for an incoming connection if within all limits
+func (tc * TorrentConnections) Accept(addr PeerAddress) (*ConnectionSlot, bool) {
+	cm := tc.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.conns >= cm.maxConns || tc.conns >= tc.max || tc.perIP[addr.Ip] >= cm.maxPerIP {
+		return nil, false
+	}
+	tc.known[addr.GetIpAndPort()] = true
+	tc.sources[addr.Source]++
+	return tc.reserve(addr, false), true
+}
+
+// Returns the number of connections & queued candidates
+func (tc * TorrentConnections) Len() (conns, queued int) {
+	tc.cm.mu.Lock()
+	defer tc.cm.mu.Unlock()
+	return tc.conns, len(tc.queue)
+}
+
+// Drops queued candidates & stops dialling. Slots are held until released.
+func (tc * TorrentConnections) Close() {
+	cm := tc.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, c := range tc.queue {
+		tc.forget(c.addr)
+	}
+	tc.queue = nil
+	for i, t := range cm.torrents {
+		if t == tc {
+			cm.torrents = append(cm.torrents[:i], cm.torrents[i+1:]...)
+			break
+		}
+	}
+}
+
+// NOTE: Must hold cm.mu
+func (tc * TorrentConnections) reserve(addr PeerAddress, halfOpen bool) *ConnectionSlot {
+	tc.cm.conns++
+	tc.perIP[addr.Ip]++
+	tc.conns++
+	if halfOpen {
+		tc.cm.halfOpen++
+	}
+	return &ConnectionSlot { tc : tc, addr : addr, halfOpen : halfOpen }
+}
+
+// NOTE: Must hold cm.mu
+func (tc * TorrentConnections) forget(addr PeerAddress) {
+	delete(tc.known, addr.GetIpAndPort())
+	tc.sources[addr.Source]--
+}
+
+// ----------------------------------------------------------------------------------
+// ConnectionSlot - a connection counted against the limits until released
+// ----------------------------------------------------------------------------------
+
+type ConnectionSlot struct {
+	tc *TorrentConnections
+	addr PeerAddress
+	halfOpen bool
+	released bool
+}
+
+// Marks an outgoing connect as complete, freeing its half-open slot
+func (s * ConnectionSlot) Connected() {
+	cm := s.tc.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if s.halfOpen && !s.released {
+		s.halfOpen = false
+		cm.halfOpen--
+		cm.schedule()
+	}
+}
+
+// Frees the slot, allowing another candidate to be dialled. Safe to call more than once.
+func (s * ConnectionSlot) Release() {
+	cm := s.tc.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if s.halfOpen {
+		cm.halfOpen--
+	}
+	cm.conns--
+	if s.tc.perIP[s.addr.Ip]--; s.tc.perIP[s.addr.Ip] == 0 {
+		delete(s.tc.perIP, s.addr.Ip)
+	}
+	s.tc.conns--
+	s.tc.forget(s.addr)
+	cm.schedule()
+}
+
+// ----------------------------------------------------------------------------------
+// candidateQueue - heap of candidates, highest priority & then oldest first
+// ----------------------------------------------------------------------------------
+
+type candidate struct {
+	addr PeerAddress
+	priority int
+	seq uint64
+}
+
+type candidateQueue []*candidate
+
+func (cq candidateQueue) Len() int { return len(cq) }
+func (cq candidateQueue) Swap(i, j int) { cq[i], cq[j] = cq[j], cq[i] }
+
+func (cq candidateQueue) Less(i, j int) bool { return cq[i].before(cq[j]) }
+
+func (c * candidate) before(other *candidate) bool {
+	if c.priority != other.priority {
+		return c.priority > other.priority
+	}
+	return c.seq < other.seq
+}
+
+func (cq * candidateQueue) Push(x interface{}) {
+	*cq = append(*cq, x.(*candidate))
+}
+
+func (cq * candidateQueue) Pop() interface{} {
+	old := *cq
+	c := old[len(old)-1]
+	*cq = old[:len(old)-1]
+	return c
+}
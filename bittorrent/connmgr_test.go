@@ -0,0 +1,111 @@
+package bittorrent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type dialled struct {
+	addr PeerAddress
+	slot *ConnectionSlot
+}
+
+func newTestTorrent(cm *ConnectionManager, max int) (*TorrentConnections, <-chan dialled) {
+	c := make(chan dialled, 100)
+	tc := cm.Register(max, func(pa PeerAddress, slot *ConnectionSlot) {
+		c <- dialled { pa, slot }
+	})
+	return tc, c
+}
+
+func testAddrs(source PeerSource, ips ...int) []PeerAddress {
+	addrs := make([]PeerAddress, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, PeerAddress { Ip : fmt.Sprintf("10.0.0.%v", ip), Port : 6881, Source : source })
+	}
+	return addrs
+}
+
+// Dials run concurrently so may arrive in any order
+func expectDialled(t *testing.T, c <-chan dialled, ips ...string) map[string]*ConnectionSlot {
+	slots := make(map[string]*ConnectionSlot, len(ips))
+	for range ips {
+		select {
+		case d := <- c:
+			slots[d.addr.Ip] = d.slot
+		case <- time.After(time.Second):
+			t.Fatalf("Expected dials: %v, Actual: %v", ips, slots)
+		}
+	}
+	for _, ip := range ips {
+		if slots[ip] == nil {
+			t.Errorf("Expected dials: %v, Actual: %v", ips, slots)
+		}
+	}
+	select {
+	case d := <- c:
+		t.Errorf("Unexpected dial: %v", d.addr)
+	case <- time.After(20 * time.Millisecond):
+	}
+	return slots
+}
+
+func TestConnectionManagerHalfOpenAndPriority(t *testing.T) {
+	cm := NewConnectionManager(10, 2, 1)
+	tc, c := newTestTorrent(cm, 10)
+
+	// Sorted by priority then arrival, never more than 2 connecting
+	tc.Add(testAddrs(SourcePEX, 1, 2))
+	slots := expectDialled(t, c, "10.0.0.1", "10.0.0.2")
+	tc.Add(testAddrs(SourceDHT, 3))
+	tc.Add(testAddrs(SourceLSD, 4))
+	tc.Add(testAddrs(SourceTracker, 5, 5)) // duplicate ignored
+
+	slots["10.0.0.1"].Connected()
+	expectDialled(t, c, "10.0.0.4")
+	slots["10.0.0.2"].Release()
+	slots["10.0.0.2"].Release() // only released once
+	expectDialled(t, c, "10.0.0.5")
+	if conns, queued := tc.Len(); conns != 3 || queued != 1 {
+		t.Errorf("Expected: 3 1, Actual: %v %v", conns, queued)
+	}
+}
+
+func TestConnectionManagerLimits(t *testing.T) {
+	cm := NewConnectionManager(3, 10, 1)
+	a, ac := newTestTorrent(cm, 2)
+	b, bc := newTestTorrent(cm, 10)
+
+	// Per torrent limit
+	a.Add(testAddrs(SourceTracker, 1, 2, 3))
+	slots := expectDialled(t, ac, "10.0.0.1", "10.0.0.2")
+
+	// Global limit
+	b.Add(testAddrs(SourceTracker, 4, 5))
+	expectDialled(t, bc, "10.0.0.4")
+	if _, ok := b.Accept(testAddrs(SourceIncoming, 6)[0]); ok {
+		t.Error("Expected incoming connection over global limit to be rejected")
+	}
+
+	// Closing a peer frees its slot for the oldest candidate
+	slots["10.0.0.1"].Release()
+	expectDialled(t, ac, "10.0.0.3")
+	expectDialled(t, bc)
+}
+
+func TestConnectionManagerPerIPLimit(t *testing.T) {
+	cm := NewConnectionManager(10, 10, 1)
+	a, ac := newTestTorrent(cm, 10)
+	b, bc := newTestTorrent(cm, 10)
+
+	// Once per torrent, so a peer sharing both torrents is connected for each
+	other := PeerAddress { Ip : "10.0.0.1", Port : 6882, Source : SourceTracker }
+	a.Add(append(testAddrs(SourceTracker, 1), other))
+	expectDialled(t, ac, "10.0.0.1")
+	b.Add(testAddrs(SourceTracker, 1))
+	expectDialled(t, bc, "10.0.0.1")
+	if _, ok := b.Accept(PeerAddress { Ip : "10.0.0.1", Port : 6883, Source : SourceIncoming }); ok {
+		t.Error("Expected incoming connection over per IP limit to be rejected")
+	}
+}
@@ -1,15 +1,22 @@
 package bittorrent
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
 	"log"
 	"os"
-	"io"
+	"path/filepath"
 )
 
 const (
 	BufLen = uint32(16 * 1024)
 )
 
+var (
+	errBlockOutOfRange = errors.New("Block beyond end of torrent data")
+)
+
 type DiskMessage interface {
 	Id() PeerIdentity
 }
@@ -51,6 +58,20 @@ func DiskRead(r *RequestMessage, id PeerIdentity) *DiskReadMessage {
 	}
 }
 
+// Checks the SHA-1 hash of a complete piece
+type DiskVerifyMessage struct {
+	id PeerIdentity
+	index uint32
+}
+
+func (dv DiskVerifyMessage) Id() PeerIdentity {
+	return dv.id
+}
+
+func DiskVerify(index uint32, id PeerIdentity) *DiskVerifyMessage {
+	return &DiskVerifyMessage { id : id, index : index }
+}
+
 type DiskMessageResult interface {
 	Id() PeerIdentity
 }
@@ -67,26 +88,28 @@ func (drr DiskReadResult) Id() PeerIdentity {
 type DiskWriteResult struct {
 	id PeerIdentity
 	index, begin, length uint32
+	hash [sha1.Size]byte // of the block written
 }
 
 func (dwr DiskWriteResult) Id() PeerIdentity {
 	return dwr.id
 }
 
-func mockDisk(reader <-chan DiskMessage, logger *log.Logger) {
-	for {
-		select {
-		case r := <- reader:
-			logger.Printf("Disk Read: %v\n", r)
-//		case w := <- writer:
-//			logger.Printf("Disk Write: %v\n", w)
-		}
-	}
+type DiskVerifyResult struct {
+	id PeerIdentity
+	index uint32
+	ok bool
+	hashes [][sha1.Size]byte // of each block, when ok
+}
+
+func (dvr DiskVerifyResult) Id() PeerIdentity {
+	return dvr.id
 }
 
 type DiskAccess struct {
 	files []*os.File
 	lens []uint64
+	existed []bool // file held data when opened
 	mi *MetaInfo
 	in <-chan DiskMessage
 	out chan<- DiskMessageResult
@@ -100,7 +123,7 @@ func NewDiskAccess(mi *MetaInfo,
 				   log *log.Logger) (*DiskAccess, error) {
 
 	// Read or create files
-	files, lens, err := initialise(mi.Files, dir)
+	files, lens, existed, err := initialise(mi.Files, dir)
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +132,7 @@ func NewDiskAccess(mi *MetaInfo,
 	da := &DiskAccess{
 		files : files,
 		lens  : lens,
+		existed : existed,
 		mi : mi,
 		in : in,
 		out : out,
@@ -118,46 +142,38 @@ func NewDiskAccess(mi *MetaInfo,
 	return da, nil
 }
 
-func initialise(mif []MetaInfoFile, dir string) ([]*os.File, []uint64, error) {
+func initialise(mif []MetaInfoFile, dir string) ([]*os.File, []uint64, []bool, error) {
 
 	var l uint64
 	lens := make([]uint64, 0, len(mif))
 	files := make([]*os.File, 0, len(mif))
+	existed := make([]bool, 0, len(mif))
 
-	// Attempt to read files - if not present, create them
+	// Open files, creating any which are not present
 	for _, f := range mif {
 
-		var file *os.File
-		fileDir := dir + "/" + f.Path
-		filePath := fileDir + f.Name
-
-		// Stat file to see if it exists
-		if _, err := os.Stat(filePath); os.IsExist(err) {
-
-			// Open existing file
-			file, err = os.Open(filePath)
-			if err != nil {
-				return nil, nil, err
-			}
-
-		} else {
-
-			// Create all dirs
-			err = os.MkdirAll(fileDir, os.ModeDir | os.ModePerm)
-			if err != nil {
-				return nil, nil, err
-			}
+		// Create all dirs
+		fileDir := filepath.Join(dir, f.Path)
+		err := os.MkdirAll(fileDir, os.ModeDir | os.ModePerm)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-			// Create new file
-			file, err = os.Create(filePath)
-			if err != nil {
-				return nil, nil, err
-			}
+		// Open existing or create new file, blocks are both read & written
+		file, err := os.OpenFile(filepath.Join(fileDir, f.Name), os.O_RDWR | os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-			// Preallocate space
+		// Preallocate space
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if fi.Size() < int64(f.Length) {
 			err = file.Truncate(int64(f.Length))
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 		}
 
@@ -165,9 +181,28 @@ func initialise(mif []MetaInfoFile, dir string) ([]*os.File, []uint64, error) {
 		l += f.Length
 		files = append(files, file)
 		lens = append(lens, l)
+		existed = append(existed, fi.Size() > 0)
 	}
 
-	return files, lens, nil
+	return files, lens, existed, nil
+}
+
+// Returns true if any file holding part of the piece held data when opened. Pieces only
+// in newly created files are zero filled so need not be verified.
+func (da DiskAccess) Existed(index uint32) bool {
+	if len(da.lens) == 0 {
+		return false
+	}
+	start := uint64(index) * uint64(da.mi.PieceLength)
+	end := min(start + uint64(da.mi.PieceLength), da.lens[len(da.lens)-1])
+	var fileStart uint64
+	for i, fileEnd := range da.lens {
+		if da.existed[i] && fileStart < end && start < fileEnd {
+			return true
+		}
+		fileStart = fileEnd
+	}
+	return false
 }
 
 func (da DiskAccess) loop() {
@@ -184,6 +219,7 @@ func (da DiskAccess) loop() {
 			switch msg := ioOp.(type) {
 			case *DiskReadMessage: res, err = da.onReadMessage(msg)
 			case *DiskWriteMessage: res, err = da.onWriteMessage(msg)
+			case *DiskVerifyMessage: res, err = da.onVerifyMessage(msg)
 			}
 
 			// Check for error
@@ -199,7 +235,7 @@ func (da DiskAccess) loop() {
 }
 
 func (da DiskAccess) onReadMessage(drm *DiskReadMessage) (DiskMessageResult, error) {
-	buf := make([]byte, 0, drm.length)
+	buf := make([]byte, drm.length)
 	err := da.onIO(buf, drm.index, drm.begin, onReadBlock)
 	if err != nil {
 		return nil, err
@@ -212,39 +248,59 @@ func (da DiskAccess) onWriteMessage(drm *DiskWriteMessage) (DiskMessageResult, e
 	if err != nil {
 		return nil, err
 	}
-	return &DiskWriteResult{drm.Id(), drm.index, drm.begin, uint32(len(drm.block)) }, nil
+	return &DiskWriteResult{drm.Id(), drm.index, drm.begin, uint32(len(drm.block)), sha1.Sum(drm.block) }, nil
+}
+
+func (da DiskAccess) onVerifyMessage(dvm *DiskVerifyMessage) (DiskMessageResult, error) {
+
+	// Last piece may be shorter
+	off := uint64(dvm.index) * uint64(da.mi.PieceLength)
+	buf := make([]byte, min(uint64(da.mi.PieceLength), da.mi.TotalLength() - off))
+	err := da.onIO(buf, dvm.index, 0, onReadBlock)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], da.mi.Hashes[dvm.index]) {
+		return &DiskVerifyResult{ dvm.Id(), dvm.index, false, nil }, nil
+	}
+
+	// Hash each block of good data, to compare with earlier failed attempts
+	hashes := make([][sha1.Size]byte, 0, (len(buf) + int(_16KB) - 1) / int(_16KB))
+	for begin := 0; begin < len(buf); begin += int(_16KB) {
+		hashes = append(hashes, sha1.Sum(buf[begin:min(begin + int(_16KB), len(buf))]))
+	}
+	return &DiskVerifyResult{ dvm.Id(), dvm.index, true, hashes }, nil
 }
 
+// Performs I/O on each file the block spans
 func (da DiskAccess) onIO(buf []byte,
 					      index, begin uint32,
 	                      ioFn func(*os.File, []byte, uint64) (int, error)) error {
 
 	start := (uint64(index) * uint64(da.mi.PieceLength)) + uint64(begin)
-	var bufOff uint64 = 0
+	var fileStart uint64 = 0
 
-	for i, len := range da.lens {
-		if start <= len {
-
-			// Calculate offset & perform I/O
-			off := (start + bufOff) - da.mi.Files[i].Length
-			n, err := ioFn(da.files[i], buf[bufOff:], off)
-
-			// Reached end of file - move to next & continue
-			if err == io.EOF {
-				bufOff += uint64(n)
-				continue
-			}
+	for i, fileEnd := range da.lens {
+		if len(buf) == 0 {
+			break
+		}
+		if start < fileEnd {
 
-			// I/O error
-			if err != io.EOF {
+			// Calculate offset in file & perform I/O on the part it holds
+			n := min(uint64(len(buf)), fileEnd - start)
+			if _, err := ioFn(da.files[i], buf[:n], start - fileStart); err != nil {
 				return err
 			}
-
-			// No error - finished
-			return nil
+			buf = buf[n:]
+			start += n
 		}
+		fileStart = fileEnd
 	}
 
+	if len(buf) > 0 {
+		return errBlockOutOfRange
+	}
 	return nil
 }
 
@@ -0,0 +1,107 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func diskResult(t *testing.T, out <-chan DiskMessageResult) DiskMessageResult {
+	select {
+	case res := <- out:
+		return res
+	case <- time.After(time.Second):
+		t.Fatal("No disk result")
+		return nil
+	}
+}
+
+func TestDiskReadWriteAcrossFiles(t *testing.T) {
+	mi := &MetaInfo {
+		PieceLength : 2 * _16KB,
+		Files : []MetaInfoFile {
+			{ Path : "multi/", Name : "a", Length : 10000 },
+			{ Path : "multi/sub", Name : "b", Length : 20000 },
+			{ Path : "multi/", Name : "c", Length : 5000 },
+		},
+	}
+	dir := t.TempDir()
+	in := make(chan DiskMessage)
+	out := make(chan DiskMessageResult)
+	if _, err := NewDiskAccess(mi, in, out, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Block spans a & b, then b & c
+	for _, begin := range []uint32 { 0, _16KB } {
+		data := make([]byte, _16KB)
+		rand.Read(data)
+		in <- DiskWrite(Block(0, begin, data), PeerIdentity{})
+		if res, ok := diskResult(t, out).(*DiskWriteResult); !ok || res.length != _16KB {
+			t.Fatalf("Expected write of %v, Actual: %v", _16KB, res)
+		}
+		in <- DiskRead(Request(0, begin, _16KB), PeerIdentity{})
+		res, ok := diskResult(t, out).(*DiskReadResult)
+		if !ok || !bytes.Equal(res.b.Block(), data) {
+			t.Errorf("Block %v not read back", begin)
+		}
+	}
+
+	// Files are created at full length
+	for _, f := range mi.Files {
+		fi, err := os.Stat(filepath.Join(dir, f.Path, f.Name))
+		if err != nil || uint64(fi.Size()) != f.Length {
+			t.Errorf("%v - Expected: %v bytes, Actual: %v, %v", f.Name, f.Length, fi, err)
+		}
+	}
+}
+
+func TestDiskExisted(t *testing.T) {
+	mi := &MetaInfo {
+		PieceLength : 2 * _16KB,
+		Files : []MetaInfoFile {
+			{ Name : "a", Length : 10000 },
+			{ Name : "b", Length : 20000 },
+			{ Name : "c", Length : 5000 },
+		},
+	}
+	dir := t.TempDir()
+	tests := []struct {
+		create string // file with data before opening
+		existed []bool // of each piece
+	} {
+		{ "", []bool { false, false } },
+		{ "b", []bool { true, false } },
+		{ "c", []bool { true, true } },
+	}
+	for _, test := range tests {
+		os.RemoveAll(dir)
+		if test.create != "" {
+			os.MkdirAll(dir, 0755)
+			if err := os.WriteFile(filepath.Join(dir, test.create), []byte { 1 }, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		da, err := NewDiskAccess(mi, nil, nil, dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, expected := range test.existed {
+			if existed := da.Existed(uint32(i)); existed != expected {
+				t.Errorf("%q, piece %v - Expected: %v, Actual: %v", test.create, i, expected, existed)
+			}
+		}
+	}
+
+	// Files created by a previous run hold data
+	da, err := NewDiskAccess(mi, nil, nil, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !da.Existed(0) || !da.Existed(1) {
+		t.Error("Expected all pieces to exist")
+	}
+}
@@ -0,0 +1,70 @@
+package bittorrent
+
+var (
+	MAX_ENDGAME_REQUESTS = 2 // peers a remaining block may be requested from at once
+)
+
+// ----------------------------------------------------------------------------------
+// Endgame - once every remaining block has been requested the download can stall on
+// slow peers. Remaining blocks are then requested again from other unchoked peers &
+// cancelled everywhere else as soon as one copy arrives. Duplicate bandwidth is
+// bounded by MAX_ENDGAME_REQUESTS outstanding requests per block.
+// ----------------------------------------------------------------------------------
+
+type blockKey struct {
+	index, begin uint32
+}
+
+// Requests blocks already requested from other peers, if in endgame
+func Endgame(peers []*Peer, pieceMap *PieceMap) {
+	if !pieceMap.IsEndgame() {
+		return
+	}
+
+	// Count outstanding requests for each block. Blocks received but not yet written
+	// need no more.
+	requested := make(map[blockKey]int)
+	for _, p := range peers {
+		for _, brs := range p.localQ.reqs {
+			k := blockKey { brs.req.Index(), brs.req.Begin() }
+			if brs.state == received {
+				requested[k] = MAX_ENDGAME_REQUESTS
+			} else {
+				requested[k]++
+			}
+		}
+	}
+
+	for _, p := range peers {
+		if p.state.localChoke || !p.CanDownload() {
+			continue
+		}
+		n := p.BlocksRequired()
+		for _, piece := range pieceMap.pieces {
+			if piece.state != FULLY_REQUESTED || !p.state.bitfield.Have(piece.index) {
+				continue
+			}
+			for i, s := range piece.blocks {
+				req := Request(piece.index, uint32(i) * _16KB, piece.BlockLen(uint32(i)))
+				k := blockKey { req.Index(), req.Begin() }
+				if n == 0 || s != REQUESTED || requested[k] >= MAX_ENDGAME_REQUESTS ||
+				   p.localQ.Contains(req.Index(), req.Begin(), req.Length()) {
+					continue
+				}
+				p.localQ.Add(req)
+				pieceMap.Duplicate(req)
+				requested[k]++
+				n--
+			}
+		}
+	}
+}
+
+// Withdraws requests for a block, just received from one peer, from every other peer
+func (pc * PeerCoordinator) cancelDuplicates(from *Peer, index, begin, length uint32) {
+	for _, p := range pc.peers {
+		if p != from {
+			p.CancelRequest(index, begin, length)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package bittorrent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Returns unchoked & interested peers which have all of a 2 piece torrent
+func newTestEndgamePeers(n int) []*Peer {
+	peers := newTestChokePeers(n)
+	for i, p := range peers {
+		p.id.address = fmt.Sprintf("10.0.0.%v:6881", i + 1)
+		p.state.bitfield = NewBitSet(2)
+		p.state.bitfield.SetAll()
+		p.state.localChoke = false
+		p.state.localInterest = true
+	}
+	return peers
+}
+
+func requests(p *Peer) []*RequestMessage {
+	var reqs []*RequestMessage
+	for _, brs := range p.localQ.reqs {
+		reqs = append(reqs, brs.req)
+	}
+	return reqs
+}
+
+func TestEndgame(t *testing.T) {
+	pc := newTestVerifyCoordinator()
+	pc.peers = newTestEndgamePeers(3)
+	pc.peers[2].state.localChoke = true
+	pc.peers[2].allowedFast = map[uint32]bool { 0 : true, 1 : true }
+
+	// Not until every block is requested
+	TakeBlocks([]*Piece { pc.pieceMap.Piece(0), pc.pieceMap.Piece(1) }, 3, pc.peers[0])
+	if Endgame(pc.peers, pc.pieceMap); pc.peers[1].localQ.Size() != 0 {
+		t.Fatalf("Endgame started with blocks needed: %v", pc.peers[1].localQ.reqs)
+	}
+	TakeBlocks([]*Piece { pc.pieceMap.Piece(1) }, 1, pc.peers[0])
+
+	// Blocks requested again, but only from unchoked peers & only once more
+	for i := 0; i < 2; i++ {
+		Endgame(pc.peers, pc.pieceMap)
+		if pc.peers[1].localQ.Size() != 4 || pc.peers[2].localQ.Size() != 0 {
+			t.Fatalf("Expected: 4 & 0 duplicates, Actual: %v & %v", pc.peers[1].localQ.Size(), pc.peers[2].localQ.Size())
+		}
+	}
+
+	// Once received, requests sent to others are cancelled & the rest dropped
+	for _, p := range pc.peers {
+		p.pieceMap, p.pipeline, p.onBlockFn = pc.pieceMap, NewPipeline(), pc.cancelDuplicates
+	}
+	for _, brs := range pc.peers[0].localQ.reqs {
+		brs.state = pending
+	}
+	pc.peers[1].localQ.reqs[0].state = pending
+	pc.peers[0].Block(0, 0, make([]byte, _16KB))
+	pc.peers[0].Block(0, _16KB, make([]byte, _16KB))
+	if reqs := requests(pc.peers[1]); len(reqs) != 2 || reqs[0].Index() != 1 {
+		t.Errorf("Expected: piece 1 requests only, Actual: %v", reqs)
+	}
+	if other := pc.peers[1].localQ.other; len(other) != 1 {
+		t.Fatalf("Expected: 1 cancel, Actual: %v", other)
+	} else if c, ok := other[0].(*CancelMessage); !ok || c.Index() != 0 || c.Begin() != 0 {
+		t.Errorf("Expected: cancel of 0, 0, Actual: %v", other[0])
+	}
+}
+
+func TestEndgameDuplicateExpires(t *testing.T) {
+	pc := newTestVerifyCoordinator()
+	pc.peers = newTestEndgamePeers(2)
+	TakeBlocks([]*Piece { pc.pieceMap.Piece(0), pc.pieceMap.Piece(1) }, 4, pc.peers[0])
+	Endgame(pc.peers, pc.pieceMap)
+	piece := pc.pieceMap.Piece(0)
+
+	// Still outstanding from the other peer so not needed again
+	pc.peers[1].localQ.reqs[0].start = time.Now().Add(-time.Minute)
+	pc.pieceMap.ReturnBlocks(pc.peers[1].localQ.ClearExpired(ThirtySeconds))
+	if piece.BlocksNeeded() || piece.blocks[0] != REQUESTED {
+		t.Fatalf("Expected: fully requested, Actual: %v %v", piece.state, piece.blocks)
+	}
+
+	// Needed once the last copy is returned
+	pc.pieceMap.ReturnBlocks(pc.peers[0].localQ.Remove(0, 0, _16KB))
+	if !piece.BlocksNeeded() || piece.blocks[0] != NEEDED {
+		t.Errorf("Expected: block needed, Actual: %v %v", piece.state, piece.blocks)
+	}
+}
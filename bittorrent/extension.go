@@ -0,0 +1,202 @@
+package bittorrent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"github.com/g-dx/chimera/bencode"
+)
+
+// Extension protocol (BEP 10) handshake message id & keys
+const (
+	extHandshakeId byte = 0
+
+	extMessages     = "m"
+	extVersion      = "v"
+	extPort         = "p"
+	extReqq         = "reqq"
+	extYourIp       = "yourip"
+	extMetadataSize = "metadata_size"
+)
+
+const clientVersion = "Chimera 0001"
+
+var errMalformedExtHandshake = errors.New("Malformed extended handshake")
+
+// ----------------------------------------------------------------------------------
+// ExtensionHandler - implements a single extension, i.e. ut_pex
+// ----------------------------------------------------------------------------------
+
+type ExtensionHandler interface {
+
+	// Name advertised in the extended handshake, i.e. "ut_pex"
+	Name() string
+
+	// Called when the remote peer's extended handshake advertises this extension
+	OnHandshake(p *Peer, hs *ExtendedHandshake)
+
+	// Called for each message the remote peer sends for this extension
+	OnMessage(p *Peer, payload []byte) error
+}
+
+// ----------------------------------------------------------------------------------
+// ExtendedHandshake - extension message id 0
+// ----------------------------------------------------------------------------------
+
+type ExtendedHandshake struct {
+	M map[string]byte // extension name -> message id
+	V string          // client name & version
+	P uint16          // listen port
+	Reqq int          // max outstanding requests
+	YourIp net.IP     // address of receiver as seen by sender
+	MetadataSize int  // size of info dictionary (ut_metadata)
+}
+
+func (hs ExtendedHandshake) Marshal() []byte {
+	m := make(map[string]interface{}, len(hs.M))
+	for name, id := range hs.M {
+		m[name] = int(id)
+	}
+	dict := map[string]interface{} { extMessages : m }
+	if hs.V != "" {
+		dict[extVersion] = hs.V
+	}
+	if hs.P != 0 {
+		dict[extPort] = int(hs.P)
+	}
+	if hs.Reqq != 0 {
+		dict[extReqq] = hs.Reqq
+	}
+	if ip := hs.YourIp.To4(); ip != nil {
+		dict[extYourIp] = []byte(ip)
+	} else if hs.YourIp != nil {
+		dict[extYourIp] = []byte(hs.YourIp.To16())
+	}
+	if hs.MetadataSize != 0 {
+		dict[extMetadataSize] = hs.MetadataSize
+	}
+
+	payload, err := bencode.EncodeBytes(dict)
+	if err != nil {
+		panic(err) // Only fails on unsupported types
+	}
+	return payload
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	dict, err := bencode.DecodeAsDict(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := dict[extMessages].(map[string]interface{})
+	if !ok {
+		return nil, errMalformedExtHandshake
+	}
+
+	// Id 0 means the extension is disabled
+	hs := &ExtendedHandshake { M : make(map[string]byte, len(m)) }
+	for name, v := range m {
+		if id, ok := v.(int64); ok && id >= 0 && id < 256 {
+			hs.M[name] = byte(id)
+		}
+	}
+
+	// Optional values - ignore if malformed
+	hs.V, _ = dict[extVersion].(string)
+	if p, ok := dict[extPort].(int64); ok && p > 0 && p < 65536 {
+		hs.P = uint16(p)
+	}
+	if reqq, ok := dict[extReqq].(int64); ok && reqq > 0 {
+		hs.Reqq = int(reqq)
+	}
+	if ip, ok := dict[extYourIp].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		hs.YourIp = net.IP(ip)
+	}
+	if size, ok := dict[extMetadataSize].(int64); ok && size > 0 {
+		hs.MetadataSize = int(size)
+	}
+	return hs, nil
+}
+
+// Applies a subsequent handshake, which may enable or disable (id 0) extensions
+func (hs * ExtendedHandshake) update(next *ExtendedHandshake) {
+	for name, id := range next.M {
+		hs.M[name] = id
+	}
+	if next.V != "" {
+		hs.V = next.V
+	}
+	if next.P != 0 {
+		hs.P = next.P
+	}
+	if next.Reqq != 0 {
+		hs.Reqq = next.Reqq
+	}
+	if next.YourIp != nil {
+		hs.YourIp = next.YourIp
+	}
+	if next.MetadataSize != 0 {
+		hs.MetadataSize = next.MetadataSize
+	}
+}
+
+// Returns the message id the remote peer uses for the named extension
+func (hs * ExtendedHandshake) Id(name string) (byte, bool) {
+	if hs == nil {
+		return 0, false
+	}
+	id, ok := hs.M[name]
+	return id, ok && id != 0
+}
+
+// ----------------------------------------------------------------------------------
+// Extensions - registered handlers. Local message ids are assigned in order of
+// registration starting at 1.
+// ----------------------------------------------------------------------------------
+
+type Extensions struct {
+	handlers []ExtensionHandler
+	port uint16
+	metadataSize int
+}
+
+func NewExtensions(port int, handlers ...ExtensionHandler) *Extensions {
+	e := &Extensions { port : uint16(port) }
+	for _, h := range handlers {
+		e.Register(h)
+	}
+	return e
+}
+
+func (e * Extensions) Register(h ExtensionHandler) {
+	if len(e.handlers) == 255 {
+		panic(errors.New("Too many extension handlers"))
+	}
+	e.handlers = append(e.handlers, h)
+}
+
+// Returns the handler for the given local message id or nil
+func (e * Extensions) Handler(id byte) ExtensionHandler {
+	if id == extHandshakeId || int(id) > len(e.handlers) {
+		return nil
+	}
+	return e.handlers[id-1]
+}
+
+// Builds our extended handshake for a peer at the given address
+func (e * Extensions) Handshake(remote string) *ExtendedMessage {
+	hs := ExtendedHandshake {
+		M : make(map[string]byte, len(e.handlers)),
+		V : clientVersion,
+		P : e.port,
+		Reqq : RequestQueueSize,
+		MetadataSize : e.metadataSize,
+	}
+	for i, h := range e.handlers {
+		hs.M[h.Name()] = byte(i+1)
+	}
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		hs.YourIp = net.ParseIP(host)
+	}
+	return Extended(extHandshakeId, hs.Marshal())
+}
@@ -0,0 +1,128 @@
+package bittorrent
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type testExtension struct {
+	name string
+	handshakes int
+	payloads [][]byte
+	err error
+}
+
+func (te * testExtension) Name() string {
+	return te.name
+}
+
+func (te * testExtension) OnHandshake(p *Peer, hs *ExtendedHandshake) {
+	te.handshakes++
+}
+
+func (te * testExtension) OnMessage(p *Peer, payload []byte) error {
+	te.payloads = append(te.payloads, payload)
+	return te.err
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	tests := []*ExtendedHandshake {
+		{ M : map[string]byte { "ut_pex" : 1, "ut_metadata" : 2 }, V : clientVersion, P : 6881,
+			Reqq : 250, YourIp : net.IPv4(10, 0, 0, 1).To4(), MetadataSize : 31235 },
+		{ M : map[string]byte { "ut_pex" : 0 }, YourIp : net.ParseIP("::1") },
+		{ M : map[string]byte {} },
+	}
+	for _, expected := range tests {
+		actual, err := ParseExtendedHandshake(expected.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected: %+v, Actual: %+v", expected, actual)
+		}
+	}
+}
+
+func TestParseExtendedHandshakeMalformed(t *testing.T) {
+	for _, payload := range []string { "", "d1:m", "de", "d1:mi1ee", "li1ee" } {
+		if hs, err := ParseExtendedHandshake([]byte(payload)); err == nil {
+			t.Errorf("%q - Expected error, Actual: %+v", payload, hs)
+		}
+	}
+
+	// Invalid optional values & ids are ignored
+	hs, err := ParseExtendedHandshake([]byte("d1:md6:ut_pexi300e11:ut_metadatai3ee1:pi70000e4:reqqi-1e6:youripi1ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ExtendedHandshake { M : map[string]byte { "ut_metadata" : 3 } }
+	if !reflect.DeepEqual(hs, expected) {
+		t.Errorf("Expected: %+v, Actual: %+v", expected, hs)
+	}
+}
+
+func TestExtensionsHandler(t *testing.T) {
+	a, b := &testExtension { name : "a" }, &testExtension { name : "b" }
+	e := NewExtensions(6881, a, b)
+	for id, expected := range map[byte]ExtensionHandler { 0 : nil, 1 : a, 2 : b, 3 : nil, 255 : nil } {
+		if h := e.Handler(id); h != expected {
+			t.Errorf("%v - Expected: %v, Actual: %v", id, expected, h)
+		}
+	}
+
+	// Handshake advertises local ids
+	msg := e.Handshake("10.0.0.1:6881")
+	hs, err := ParseExtendedHandshake(msg.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ExtId() != extHandshakeId || hs.M["a"] != 1 || hs.M["b"] != 2 || hs.P != 6881 ||
+		!hs.YourIp.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Unexpected handshake: %+v", hs)
+	}
+}
+
+func TestPeerExtendedDispatch(t *testing.T) {
+	a, b := &testExtension { name : "a" }, &testExtension { name : "b", err : errors.New("Bad") }
+	tp := newTestPeer(false)
+	tp.exts = NewExtensions(0, a, b)
+
+	// Messages before the handshake still reach the handler for our local id
+	tp.Extended(1, []byte("x"))
+
+	// Only handlers the remote supports are notified of the handshake
+	tp.Extended(extHandshakeId, ExtendedHandshake { M : map[string]byte { "a" : 7, "c" : 8 } }.Marshal())
+	if a.handshakes != 1 || b.handshakes != 0 {
+		t.Errorf("Expected: 1 0, Actual: %v %v", a.handshakes, b.handshakes)
+	}
+	if id, ok := tp.ExtendedHandshake().Id("a"); !ok || id != 7 {
+		t.Errorf("Expected: 7, Actual: %v", id)
+	}
+
+	// Malformed handshakes are ignored
+	tp.Extended(extHandshakeId, []byte("d1:m"))
+	if a.handshakes != 1 || tp.ExtendedHandshake().M["a"] != 7 {
+		t.Errorf("Malformed handshake applied: %+v", tp.ExtendedHandshake())
+	}
+
+	// Later handshakes update & may disable extensions
+	tp.Extended(extHandshakeId, ExtendedHandshake { M : map[string]byte { "a" : 0, "b" : 9 } }.Marshal())
+	if _, ok := tp.ExtendedHandshake().Id("a"); ok {
+		t.Error("Expected extension disabled")
+	}
+	if a.handshakes != 1 || b.handshakes != 1 {
+		t.Errorf("Expected: 1 1, Actual: %v %v", a.handshakes, b.handshakes)
+	}
+	if tp.SendExtended("a", nil) || !tp.SendExtended("b", nil) {
+		t.Error("Expected only b to be sendable")
+	}
+
+	// Unknown ids are dropped & handler errors don't affect the peer
+	tp.Extended(3, []byte("y"))
+	tp.Extended(2, []byte("z"))
+	if !reflect.DeepEqual(a.payloads, [][]byte { []byte("x") }) || !reflect.DeepEqual(b.payloads, [][]byte { []byte("z") }) {
+		t.Errorf("Unexpected payloads: %q %q", a.payloads, b.payloads)
+	}
+}
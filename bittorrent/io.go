@@ -10,6 +10,7 @@ type MessageSink struct {
 	id PeerIdentity
 	conn chan<- ProtocolMessage
 	disk chan<- DiskMessage
+	stats *Statistics // counts messages sent to the connection
 	w func(ProtocolMessage) bool // Decides which channel to write to
 }
 
@@ -20,7 +21,9 @@ func (ms MessageSink) Write(msg ProtocolMessage) bool {
 
 func (ms MessageSink) ToConnection(msg ProtocolMessage) bool {
 	select {
-	case ms.conn <- msg : return true
+	case ms.conn <- msg :
+		ms.stats.Sent(msg)
+		return true
 	default: return false
 	}
 }
@@ -34,9 +37,10 @@ func (ms MessageSink) ToDisk(msg DiskMessage) bool {
 
 func NewRemoteMessageSink(id PeerIdentity,
 	                      conn chan<- ProtocolMessage,
-						  disk chan<- DiskMessage) *MessageSink {
+						  disk chan<- DiskMessage,
+						  stats *Statistics) *MessageSink {
 
-	ms := &MessageSink { id : id, conn : conn, disk : disk, }
+	ms := &MessageSink { id : id, conn : conn, disk : disk, stats : stats }
 	ms.w = func (m ProtocolMessage) bool {
 		switch msg := m.(type) {
 		case *RequestMessage: return ms.ToDisk(DiskRead(msg, id))
@@ -48,8 +52,9 @@ func NewRemoteMessageSink(id PeerIdentity,
 
 func NewLocalMessageSink(id PeerIdentity,
 						 conn chan<- ProtocolMessage,
-						 disk chan<- DiskMessage) *MessageSink {
-	ms := &MessageSink { id : id, conn : conn, disk : disk, }
+						 disk chan<- DiskMessage,
+						 stats *Statistics) *MessageSink {
+	ms := &MessageSink { id : id, conn : conn, disk : disk, stats : stats }
 	ms.w = func (m ProtocolMessage) bool {
 		switch msg := m.(type) {
 		case *BlockMessage: return ms.ToDisk(DiskWrite(msg, id))
@@ -114,7 +119,7 @@ func (mq * MessageQueue) ClearNew() []*RequestMessage {
 
 func (mq * MessageQueue) ClearExpired(t time.Duration) []*RequestMessage {
 	return mq.Clear(func(brt * BlockRequestStatus) bool {
-		return (brt.state == new || brt.state == pending) && brt.start.Add(t).After(time.Now())
+		return (brt.state == new || brt.state == pending) && brt.start.Add(t).Before(time.Now())
 	})
 }
 
@@ -122,30 +127,69 @@ func (mq * MessageQueue) ClearAll() []*RequestMessage {
 	return mq.Clear(func(_ * BlockRequestStatus) bool { return true })
 }
 
-func (mq * MessageQueue) Remove(index, begin, length uint32) {
-	mq.Clear(func(brt * BlockRequestStatus) bool {
+func (mq * MessageQueue) ClearUnreceived() []*RequestMessage {
+	return mq.Clear(func(brt *BlockRequestStatus) bool {
+		return brt.state == new || brt.state == pending
+	})
+}
+
+func (mq * MessageQueue) Remove(index, begin, length uint32) []*RequestMessage {
+	return mq.Clear(func(brt * BlockRequestStatus) bool {
 		return brt.req.Index() == index &&
 			   brt.req.Begin() == begin &&
 			   brt.req.Length() == length
 	})
 }
 
+// Returns the sent request the block answers, if any
+func (mq * MessageQueue) Pending(index, begin, length uint32) *BlockRequestStatus {
+	for _, brs := range mq.reqs {
+		if brs.req.Index() == index && brs.req.Begin() == begin && brs.req.Length() == length &&
+		   brs.state == pending {
+			return brs
+		}
+	}
+	return nil
+}
+
+// Returns the number of sent requests not yet answered
+func (mq * MessageQueue) Outstanding() int {
+	n := 0
+	for _, brs := range mq.reqs {
+		if brs.state == pending {
+			n++
+		}
+	}
+	return n
+}
+
+func (mq * MessageQueue) Contains(index, begin, length uint32) bool {
+	for _, brs := range mq.reqs {
+		if brs.req.Index() == index && brs.req.Begin() == begin && brs.req.Length() == length {
+			return true
+		}
+	}
+	return false
+}
+
 func (mq * MessageQueue) Clear(p func(*BlockRequestStatus) bool) []*RequestMessage {
 
-	// Collect all cleared requests
+	// Collect all cleared requests & keep the rest in order
 	reqs := make([]*RequestMessage, 0, mq.cap)
-	for i, req := range mq.reqs {
+	kept := mq.reqs[:0]
+	for _, req := range mq.reqs {
 		if p(req) {
-			// Remove & append to cleared list
-			mq.reqs = append(mq.reqs[:i], mq.reqs[i+1:]...)
 			reqs = append(reqs, req.req)
+		} else {
+			kept = append(kept, req)
 		}
 	}
+	mq.reqs = kept
 	return reqs
 }
 
 func (mq * MessageQueue) IsFull() bool {
-	return mq.Size() < mq.cap
+	return mq.Size() >= mq.cap
 }
 
 func (mq * MessageQueue) Size() int {
@@ -156,6 +200,10 @@ func (mq * MessageQueue) Capacity() int {
 	return mq.cap
 }
 
+func (mq * MessageQueue) SetCapacity(cap int) {
+	mq.cap = cap
+}
+
 func (mq * MessageQueue) Add(m ProtocolMessage) {
 	switch msg := m.(type) {
 	case *BlockMessage:
@@ -168,6 +216,7 @@ func (mq * MessageQueue) Add(m ProtocolMessage) {
 			   req.state == pending {
 
 				mq.reqs[i].block = msg
+				mq.reqs[i].state = received
 				break
 			}
 		}
@@ -226,6 +275,7 @@ func (mq * MessageQueue) WriteRequest(brs *BlockRequestStatus, sink *MessageSink
 	ok := sink.Write(brs.req)
 	if ok {
 		brs.state = pending
+		brs.start = time.Now() // time to answer measured from here
 	}
 	return ok
 }
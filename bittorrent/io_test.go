@@ -0,0 +1,58 @@
+package bittorrent
+
+import "testing"
+
+func TestMessageQueueClear(t *testing.T) {
+	mq := NewMessageQueue(10)
+	for i := uint32(0); i < 6; i++ {
+		mq.Add(Request(i, 0, 16384))
+	}
+
+	// Clear adjacent & trailing requests
+	reqs := mq.Clear(func(brt *BlockRequestStatus) bool {
+		return brt.req.Index() == 1 || brt.req.Index() == 2 || brt.req.Index() == 5
+	})
+	if len(reqs) != 3 || reqs[0].Index() != 1 || reqs[1].Index() != 2 || reqs[2].Index() != 5 {
+		t.Fatalf("Unexpected cleared requests: %v", reqs)
+	}
+	if mq.Size() != 3 {
+		t.Fatalf("Expected: 3, Actual: %v", mq.Size())
+	}
+	for i, index := range []uint32 { 0, 3, 4 } {
+		if mq.reqs[i].req.Index() != index {
+			t.Errorf("Expected: %v, Actual: %v", index, mq.reqs[i].req.Index())
+		}
+	}
+
+	if reqs := mq.ClearAll(); len(reqs) != 3 || mq.Size() != 0 {
+		t.Errorf("Expected all requests cleared, Actual: %v (remaining: %v)", reqs, mq.Size())
+	}
+}
+
+func TestMessageQueueIsFull(t *testing.T) {
+	mq := NewMessageQueue(2)
+	if mq.IsFull() {
+		t.Error("Empty queue reported full")
+	}
+	mq.Add(Request(0, 0, 16384))
+	mq.Add(Request(1, 0, 16384))
+	if !mq.IsFull() {
+		t.Error("Queue at capacity not reported full")
+	}
+}
+
+func TestMessageQueueAddBlockMarksReceived(t *testing.T) {
+	mq := NewMessageQueue(2)
+	mq.Add(Request(0, 0, 4))
+	mq.Add(Request(0, 4, 4))
+	mq.reqs[0].state = pending
+	mq.reqs[1].state = pending
+
+	mq.Add(Block(0, 4, []byte { 1, 2, 3, 4 }))
+	if mq.reqs[0].state != pending {
+		t.Errorf("Expected: %v, Actual: %v", pending, mq.reqs[0].state)
+	}
+	if mq.reqs[1].state != received || mq.reqs[1].block == nil {
+		t.Errorf("Expected: %v, Actual: %v", received, mq.reqs[1].state)
+	}
+}
@@ -0,0 +1,280 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// eMule access levels above this are allowed
+	ipFilterMaxBlockedLevel = 127
+)
+
+// ----------------------------------------------------------------------------------
+// IPFilter - blocks peers whose address falls in any range of a blocklist. Lists may
+// be eMule ipfilter.dat, PeerGuardian .p2p or CIDR (one range or address per line).
+// ----------------------------------------------------------------------------------
+
+type ipRange struct {
+	from, to net.IP // inclusive, 16 byte form
+}
+
+type IPFilter struct {
+	paths []string
+
+	mu sync.RWMutex
+	ranges []ipRange // sorted & non-overlapping
+	modified []time.Time
+
+	rejected uint64
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a filter from the given list files
+func NewIPFilter(paths ...string) (*IPFilter, error) {
+	f := &IPFilter { paths : paths, done : make(chan struct{}) }
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Re-reads all list files. The current ranges are kept if any file fails to load.
+func (f * IPFilter) Reload() error {
+	var ranges []ipRange
+	modified := make([]time.Time, len(f.paths))
+	for i, path := range f.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if fi, err := file.Stat(); err == nil {
+			modified[i] = fi.ModTime()
+		}
+		r, err := parseIPFilter(file)
+		file.Close()
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v: %v", path, err))
+		}
+		ranges = append(ranges, r...)
+	}
+
+	ranges = mergeRanges(ranges)
+	f.mu.Lock()
+	f.ranges = ranges
+	f.modified = modified
+	f.mu.Unlock()
+	return nil
+}
+
+// Reloads the list files whenever they change, checking every interval, until closed.
+// Failed reloads are passed to onError (may be nil).
+func (f * IPFilter) Watch(interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <- f.done:
+				return
+			case <- ticker.C:
+				if !f.changed() {
+					continue
+				}
+				if err := f.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+func (f * IPFilter) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i, path := range f.paths {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Equal(f.modified[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f * IPFilter) Close() {
+	f.closeOnce.Do(func() { close(f.done) })
+}
+
+// Returns true if the address is in a blocked range
+func (f * IPFilter) Blocked(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].to, ip) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].from, ip) <= 0
+}
+
+// Returns true if a connection with the address is allowed, counting rejections. A nil
+// filter allows everything.
+func (f * IPFilter) Allow(ip net.IP) bool {
+	if f == nil || !f.Blocked(ip) {
+		return true
+	}
+	atomic.AddUint64(&f.rejected, 1)
+	return false
+}
+
+// Returns the number of addresses rejected by Allow
+func (f * IPFilter) Rejected() uint64 {
+	return atomic.LoadUint64(&f.rejected)
+}
+
+// Returns the number of distinct blocked ranges
+func (f * IPFilter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+// ----------------------------------------------------------------------------------
+// Parsing
+// ----------------------------------------------------------------------------------
+
+// Parses a list, detecting the format of each line:
+//
+//   ipfilter.dat: 001.002.004.000 - 001.002.004.255 , 000 , Description
+//   .p2p:         Description:1.2.4.0-1.2.4.255
+//   CIDR:         1.2.4.0/24 or 1.2.4.7
+//
+// Blank lines & lines starting with # or // are ignored.
+func parseIPFilter(r io.Reader) ([]ipRange, error) {
+	var ranges []ipRange
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, blocked, err := parseIPFilterLine(line)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %v: %v", n, err))
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	return ranges, s.Err()
+}
+
+// Tries each format in turn as .p2p descriptions may contain commas & slashes
+func parseIPFilterLine(line string) (ipRange, bool, error) {
+
+	// eMule, ranges with a high access level are allowed
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if rng, rerr := parseIPRange(fields[0]); err == nil && rerr == nil {
+			return rng, level <= ipFilterMaxBlockedLevel, nil
+		}
+	}
+
+	// Plain range or PeerGuardian
+	if rng, err := parseIPRange(line); err == nil {
+		return rng, true, nil
+	}
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if rng, err := parseIPRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+
+	// CIDR or single address
+	if _, ipNet, err := net.ParseCIDR(line); err == nil {
+		from := ipNet.IP.To16()
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(bytes.Repeat([]byte { 0xFF }, 12), mask...) // IPv4 in IPv6 prefix
+		}
+		to := make(net.IP, len(from))
+		for i := range from {
+			to[i] = from[i] | ^mask[i]
+		}
+		return ipRange { from, to }, true, nil
+	}
+	ip, err := parseFilterIP(line)
+	return ipRange { ip, ip }, true, err
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return ipRange{}, errors.New("Missing range separator")
+	}
+	from, err := parseFilterIP(s[:i])
+	if err != nil {
+		return ipRange{}, err
+	}
+	to, err := parseFilterIP(s[i+1:])
+	if err != nil {
+		return ipRange{}, err
+	}
+	if bytes.Compare(from, to) > 0 {
+		from, to = to, from
+	}
+	return ipRange { from, to }, nil
+}
+
+// Parses an address allowing zero padded IPv4 octets, i.e. 001.002.004.000
+func parseFilterIP(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16(), nil
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil, errors.New(fmt.Sprintf("Invalid address: %q", s))
+	}
+	ip := make([]byte, 4)
+	for i, o := range octets {
+		v, err := strconv.ParseUint(o, 10, 8)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid address: %q", s))
+		}
+		ip[i] = byte(v)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]).To16(), nil
+}
+
+// Sorts ranges & merges any which overlap
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].from, ranges[j].from) < 0
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.from, merged[n-1].to) <= 0 {
+			if bytes.Compare(r.to, merged[n-1].to) > 0 {
+				merged[n-1].to = r.to
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,102 @@
+package bittorrent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testIPFilter = `# Mixed formats
+001.002.004.000 - 001.002.004.255 , 000 , eMule blocked
+001.002.005.000 - 001.002.005.255 , 200 , eMule allowed
+Some Corp, Inc: Monitoring:10.0.0.0-10.0.0.127
+192.168.0.0/16
+2001:db8::/32
+8.8.8.8
+`
+
+func writeTestIPFilter(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "ipfilter.dat")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIPFilterFormats(t *testing.T) {
+	f, err := NewIPFilter(writeTestIPFilter(t, testIPFilter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip string
+		blocked bool
+	} {
+		{ "1.2.4.0", true },
+		{ "1.2.4.255", true },
+		{ "1.2.5.1", false },
+		{ "10.0.0.127", true },
+		{ "10.0.0.128", false },
+		{ "192.168.44.1", true },
+		{ "192.169.0.1", false },
+		{ "2001:db8::1", true },
+		{ "2001:db9::1", false },
+		{ "8.8.8.8", true },
+		{ "8.8.4.4", false },
+	}
+	for _, test := range tests {
+		if blocked := f.Blocked(net.ParseIP(test.ip)); blocked != test.blocked {
+			t.Errorf("%v - Expected: %v, Actual: %v", test.ip, test.blocked, blocked)
+		}
+	}
+}
+
+func TestIPFilterReload(t *testing.T) {
+	path := writeTestIPFilter(t, "10.0.0.0/8\n")
+	f, err := NewIPFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Watch(10 * time.Millisecond, nil)
+
+	// Newer modification time triggers a reload
+	os.WriteFile(path, []byte("11.0.0.0/8\n"), 0644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	deadline := time.Now().Add(time.Second)
+	for f.Blocked(net.ParseIP("10.1.1.1")) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Blocked(net.ParseIP("10.1.1.1")) || !f.Blocked(net.ParseIP("11.1.1.1")) {
+		t.Error("Filter not reloaded")
+	}
+
+	// Bad lists keep the current ranges
+	os.WriteFile(path, []byte("not an address\n"), 0644)
+	if err := f.Reload(); err == nil || !f.Blocked(net.ParseIP("11.1.1.1")) {
+		t.Errorf("Expected error & ranges kept, Actual: %v", err)
+	}
+}
+
+func TestIPFilterIncoming(t *testing.T) {
+	f, err := NewIPFilter(writeTestIPFilter(t, "127.0.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := NewPeerListener("127.0.0.1:0", nil, EncryptionEnabled, 0, f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	pl.Register(testInfoHash[:], PeerId, func(pc *PeerConnection, hs *HandshakeMessage) {
+		t.Error("Blocked connection routed")
+	})
+
+	assertClosed(t, dialHandshake(t, pl, testInfoHash[:], remotePeerId))
+	if f.Rejected() != 1 {
+		t.Errorf("Expected: 1, Actual: %v", f.Rejected())
+	}
+}
@@ -0,0 +1,245 @@
+package bittorrent
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/g-dx/chimera/utp"
+)
+
+var (
+	MAX_INCOMING_CONNECTIONS = 200
+
+	errTooManyConnections = errors.New("Too many incoming connections")
+	errUnknownInfoHash = errors.New("Handshake for unknown info hash")
+	errBlockedAddress = errors.New("Address blocked by IP filter")
+)
+
+// ----------------------------------------------------------------------------------
+// PeerListener - accepts peer connections & routes them to the torrent whose info
+// hash the remote handshake asks for
+// ----------------------------------------------------------------------------------
+
+type PeerListener struct {
+	listeners []Listener // first is ours, any others are shared
+	policy EncryptionPolicy
+	maxConns int
+	filter *IPFilter
+	logger *log.Logger
+
+	mu sync.Mutex
+	torrents map[string]registration // hex info hash -> handler
+	conns int
+
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+// Listens for TCP connections on the given address, i.e. ":6881", & also accepts
+// connections from the uTP socket if given. At most maxConns (0 = default) incoming
+// connections are open at once & connections blocked by the filter (may be nil) are
+// closed immediately.
+func NewPeerListener(addr string,
+					 us *utp.Socket,
+					 policy EncryptionPolicy,
+					 maxConns int,
+					 filter *IPFilter,
+					 logger *log.Logger) (*PeerListener, error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var shared []Listener
+	if us != nil {
+		shared = append(shared, us)
+	}
+	return NewPeerListenerOn(l, shared, policy, maxConns, filter, logger), nil
+}
+
+// Accepts connections from l, which is closed along with the listener, & from any
+// shared listeners, which are left open
+func NewPeerListenerOn(l Listener,
+					   shared []Listener,
+					   policy EncryptionPolicy,
+					   maxConns int,
+					   filter *IPFilter,
+					   logger *log.Logger) *PeerListener {
+
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	if maxConns == 0 {
+		maxConns = MAX_INCOMING_CONNECTIONS
+	}
+
+	pl := &PeerListener {
+		listeners : append([]Listener { l }, shared...),
+		policy : policy,
+		maxConns : maxConns,
+		filter : filter,
+		logger : logger,
+		torrents : make(map[string]registration),
+		done : make(chan struct{}),
+	}
+	for _, l := range pl.listeners {
+		go pl.acceptLoop(l)
+	}
+	return pl
+}
+
+// A torrent accepting connections & the peer id it identifies us by
+type registration struct {
+	peerId []byte
+	fn func(*PeerConnection, *HandshakeMessage)
+}
+
+// Registers a torrent identifying us by peerId. Connections which complete a handshake
+// for it are passed to fn which must either establish or close them.
+func (pl * PeerListener) Register(infoHash, peerId []byte, fn func(*PeerConnection, *HandshakeMessage)) {
+	pl.mu.Lock()
+	pl.torrents[hex.EncodeToString(infoHash)] = registration { peerId, fn }
+	pl.mu.Unlock()
+}
+
+func (pl * PeerListener) Unregister(infoHash []byte) {
+	pl.mu.Lock()
+	delete(pl.torrents, hex.EncodeToString(infoHash))
+	pl.mu.Unlock()
+}
+
+// Returns the address being listened on
+func (pl * PeerListener) Addr() net.Addr {
+	return pl.listeners[0].Addr()
+}
+
+// Stops accepting connections. Shared listeners, such as a uTP socket also used for
+// outgoing connections, are left open.
+func (pl * PeerListener) Close() {
+	pl.closeOnce.Do(func() {
+		close(pl.done)
+		pl.listeners[0].Close()
+	})
+}
+
+func (pl * PeerListener) acceptLoop(l Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <- pl.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			pl.logger.Printf("Accept failed: %v\n", err)
+			continue
+		}
+
+		// A shared listener keeps accepting after we close
+		select {
+		case <- pl.done:
+			conn.Close()
+			return
+		default:
+		}
+		go pl.handle(conn)
+	}
+}
+
+func (pl * PeerListener) handle(conn net.Conn) {
+
+	// Is this address blocked?
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && !pl.filter.Allow(net.ParseIP(host)) {
+		pl.logger.Printf("Rejecting [%v]: %v\n", conn.RemoteAddr(), errBlockedAddress)
+		conn.Close()
+		return
+	}
+
+	// Is this connection one too many?
+	if !pl.acquire() {
+		pl.logger.Printf("Rejecting [%v]: %v\n", conn.RemoteAddr(), errTooManyConnections)
+		conn.Close()
+		return
+	}
+	conn = &countedConn { Conn : conn, release : pl.release }
+
+	// Read handshake, which may be encrypted for any registered torrent
+	pc, err := NewIncomingConnection(conn, pl.policy, pl.infoHashes())
+	if err != nil {
+		pl.logger.Printf("Rejecting [%v]: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	hs, err := pc.ReceiveHandshake(pl.peerIds()...)
+	if err != nil {
+		pl.logger.Printf("Rejecting [%v]: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	pl.mu.Lock()
+	r, ok := pl.torrents[hex.EncodeToString(hs.infoHash)]
+	pl.mu.Unlock()
+	if !ok {
+		pl.logger.Printf("Rejecting [%v]: %v\n", conn.RemoteAddr(), errUnknownInfoHash)
+		conn.Close()
+		return
+	}
+	r.fn(pc, hs)
+}
+
+func (pl * PeerListener) infoHashes() [][]byte {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	hashes := make([][]byte, 0, len(pl.torrents))
+	for ih := range pl.torrents {
+		b, _ := hex.DecodeString(ih)
+		hashes = append(hashes, b)
+	}
+	return hashes
+}
+
+// Returns the peer ids of every registered torrent, each of which may be ourself
+func (pl * PeerListener) peerIds() [][]byte {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	ids := make([][]byte, 0, len(pl.torrents))
+	for _, r := range pl.torrents {
+		ids = append(ids, r.peerId)
+	}
+	return ids
+}
+
+func (pl * PeerListener) acquire() bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.conns >= pl.maxConns {
+		return false
+	}
+	pl.conns++
+	return true
+}
+
+func (pl * PeerListener) release() {
+	pl.mu.Lock()
+	pl.conns--
+	pl.mu.Unlock()
+}
+
+// Releases its slot in the listener the first time it is closed
+type countedConn struct {
+	net.Conn
+	once sync.Once
+	release func()
+}
+
+func (cc * countedConn) Close() error {
+	cc.once.Do(cc.release)
+	return cc.Conn.Close()
+}
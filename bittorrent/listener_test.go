@@ -0,0 +1,104 @@
+package bittorrent
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	remotePeerId = []byte("-XX0001-remotepeerid")
+	localPeerId = []byte("-CH0001-localpeerid0")
+)
+
+func newTestPeerListener(t *testing.T, maxConns int) (*PeerListener, <-chan *PeerConnection) {
+	pl, err := NewPeerListener("127.0.0.1:0", nil, EncryptionEnabled, maxConns, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pl.Close)
+
+	accepted := make(chan *PeerConnection, 1)
+	pl.Register(testInfoHash[:], localPeerId, func(pc *PeerConnection, hs *HandshakeMessage) {
+		accepted <- pc
+	})
+	return pl, accepted
+}
+
+func dialHandshake(t *testing.T, pl *PeerListener, infoHash, peerId []byte) net.Conn {
+	c, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write(Marshal(handshake(supportedReserved, infoHash, peerId))); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func assertClosed(t *testing.T, c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	// Closed with unread data may be reset rather than EOF
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("Expected connection closed, Actual: %v", err)
+	}
+}
+
+func TestListenerRoutesByInfoHash(t *testing.T) {
+	pl, accepted := newTestPeerListener(t, 0)
+	c := dialHandshake(t, pl, testInfoHash[:], remotePeerId)
+
+	// Reply with our handshake once established
+	pc := <- accepted
+	defer pc.Close()
+	id, err := pc.Establish(nil, nil, make(chan error, 3), Handshake(testInfoHash[:]), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(id.id) != string(remotePeerId) {
+		t.Errorf("Expected: %q, Actual: %q", remotePeerId, id.id)
+	}
+
+	buf := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := ReadHandshake(buf); msg.(*HandshakeMessage).peerId != string(PeerId) {
+		t.Errorf("Expected: %q, Actual: %v", PeerId, msg)
+	}
+}
+
+func TestListenerRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		infoHash, peerId []byte
+	} {
+		{ "unknown info hash", otherInfoHash[:], remotePeerId },
+		{ "self connection", testInfoHash[:], localPeerId },
+	}
+	for _, test := range tests {
+		pl, accepted := newTestPeerListener(t, 0)
+		assertClosed(t, dialHandshake(t, pl, test.infoHash, test.peerId))
+		select {
+		case <- accepted:
+			t.Errorf("%v: connection should not be routed", test.name)
+		default:
+		}
+	}
+}
+
+func TestListenerRejectsOverLimit(t *testing.T) {
+	pl, accepted := newTestPeerListener(t, 1)
+	dialHandshake(t, pl, testInfoHash[:], remotePeerId)
+	pc := <- accepted
+
+	assertClosed(t, dialHandshake(t, pl, testInfoHash[:], remotePeerId))
+
+	// Closing releases the slot
+	pc.Close()
+	dialHandshake(t, pl, testInfoHash[:], remotePeerId)
+	(<- accepted).Close()
+}
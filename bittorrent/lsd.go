@@ -0,0 +1,273 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	LSD_IPV4_GROUP = "239.192.152.143:6771"
+	LSD_IPV6_GROUP = "[ff15::efc0:988f]:6771"
+	LSD_ANNOUNCE_PERIOD = 5 * time.Minute
+
+	errNoLsdGroups = errors.New("Failed to join any local service discovery group")
+)
+
+const (
+	lsdRequestLine = "BT-SEARCH * HTTP/1.1"
+	lsdMaxHashesPerMessage = 20 // keeps announcements within a single packet
+)
+
+// ----------------------------------------------------------------------------------
+// LocalServiceDiscovery - finds peers on the local network (BEP 14)
+// ----------------------------------------------------------------------------------
+
+type lsdGroup struct {
+	addr *net.UDPAddr
+	in, out *net.UDPConn
+}
+
+type LocalServiceDiscovery struct {
+	port int
+	cookie string
+	groups []*lsdGroup
+	logger *log.Logger
+
+	mu sync.Mutex
+	torrents map[string]func([]PeerAddress) // hex info hash -> peer handler
+
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+// Joins the given multicast groups (nil = IPv4 & IPv6 defaults) on the interface
+// (nil = system default) & announces that peers may connect to us on the given port
+// (0 = never announce).
+func NewLocalServiceDiscovery(port int,
+							  iface *net.Interface,
+							  groups []string,
+							  logger *log.Logger) (*LocalServiceDiscovery, error) {
+
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	if groups == nil {
+		groups = []string { LSD_IPV4_GROUP, LSD_IPV6_GROUP }
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	lsd := &LocalServiceDiscovery {
+		port : port,
+		cookie : hex.EncodeToString(cookie),
+		logger : logger,
+		torrents : make(map[string]func([]PeerAddress)),
+		done : make(chan struct{}),
+	}
+
+	// Join groups - failure to join one (i.e. no IPv6 route) is not fatal
+	for _, g := range groups {
+		group, err := joinLsdGroup(g, iface)
+		if err != nil {
+			logger.Printf("Can't join LSD group [%v]: %v\n", g, err)
+			continue
+		}
+		lsd.groups = append(lsd.groups, group)
+	}
+	if len(lsd.groups) == 0 {
+		return nil, errNoLsdGroups
+	}
+
+	for _, g := range lsd.groups {
+		go lsd.readLoop(g)
+	}
+	go lsd.announceLoop()
+	return lsd, nil
+}
+
+func joinLsdGroup(addr string, iface *net.Interface) (*lsdGroup, error) {
+	gaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if gaddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	in, err := net.ListenMulticastUDP(network, iface, gaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binding to an address of the interface selects it for outgoing multicast
+	out, err := net.ListenUDP(network, &net.UDPAddr { IP : interfaceAddr(iface, network) })
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &lsdGroup { gaddr, in, out }, nil
+}
+
+func interfaceAddr(iface *net.Interface, network string) net.IP {
+	if iface == nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && (ipNet.IP.To4() != nil) == (network == "udp4") {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// Registers a torrent & immediately announces it. Peers found for it are passed to fn.
+func (lsd * LocalServiceDiscovery) Register(infoHash []byte, fn func([]PeerAddress)) {
+	ih := hex.EncodeToString(infoHash)
+	lsd.mu.Lock()
+	lsd.torrents[ih] = fn
+	lsd.mu.Unlock()
+	lsd.announce([]string { ih })
+}
+
+func (lsd * LocalServiceDiscovery) Unregister(infoHash []byte) {
+	lsd.mu.Lock()
+	delete(lsd.torrents, hex.EncodeToString(infoHash))
+	lsd.mu.Unlock()
+}
+
+func (lsd * LocalServiceDiscovery) Close() {
+	lsd.closeOnce.Do(func() {
+		close(lsd.done)
+		for _, g := range lsd.groups {
+			g.in.Close()
+			g.out.Close()
+		}
+	})
+}
+
+func (lsd * LocalServiceDiscovery) announceLoop() {
+	ticker := time.NewTicker(LSD_ANNOUNCE_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- lsd.done:
+			return
+		case <- ticker.C:
+			lsd.mu.Lock()
+			hashes := make([]string, 0, len(lsd.torrents))
+			for ih := range lsd.torrents {
+				hashes = append(hashes, ih)
+			}
+			lsd.mu.Unlock()
+			lsd.announce(hashes)
+		}
+	}
+}
+
+func (lsd * LocalServiceDiscovery) announce(hashes []string) {
+	if lsd.port == 0 {
+		return
+	}
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > lsdMaxHashesPerMessage {
+			n = lsdMaxHashesPerMessage
+		}
+		for _, g := range lsd.groups {
+			_, err := g.out.WriteToUDP(lsd.buildAnnounce(g.addr, hashes[:n]), g.addr)
+			if err != nil {
+				lsd.logger.Printf("LSD announce to [%v] failed: %v\n", g.addr, err)
+			}
+		}
+		hashes = hashes[n:]
+	}
+}
+
+func (lsd * LocalServiceDiscovery) buildAnnounce(group *net.UDPAddr, hashes []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v\r\n", lsdRequestLine)
+	fmt.Fprintf(&buf, "Host: %v\r\n", group)
+	fmt.Fprintf(&buf, "Port: %v\r\n", lsd.port)
+	for _, ih := range hashes {
+		fmt.Fprintf(&buf, "Infohash: %v\r\n", ih)
+	}
+	fmt.Fprintf(&buf, "cookie: %v\r\n\r\n\r\n", lsd.cookie)
+	return buf.Bytes()
+}
+
+func (lsd * LocalServiceDiscovery) readLoop(g *lsdGroup) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := g.in.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			lsd.logger.Printf("LSD read error: %v\n", err)
+			continue
+		}
+		lsd.onAnnounce(buf[:n], addr)
+	}
+}
+
+func (lsd * LocalServiceDiscovery) onAnnounce(buf []byte, from *net.UDPAddr) {
+
+	// Parse request line & headers
+	r := bufio.NewReader(bytes.NewReader(buf))
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != lsdRequestLine {
+		return
+	}
+	headers := make(http.Header)
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			headers.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+		}
+	}
+
+	// Ignore our own announcements
+	if headers.Get("Cookie") == lsd.cookie {
+		return
+	}
+	port, err := strconv.ParseUint(headers.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return
+	}
+
+	peer := []PeerAddress { {
+		Id : "unknown",
+		Ip : from.IP.String(),
+		Port : uint(port),
+		Source : SourceLSD,
+	} }
+	for _, ih := range headers.Values("Infohash") {
+		lsd.mu.Lock()
+		fn, ok := lsd.torrents[strings.ToLower(ih)]
+		lsd.mu.Unlock()
+		if ok {
+			fn(peer)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// Loopback group on a non-standard port so tests never see real LAN traffic
+const testLsdGroup = "239.192.152.143:16771"
+
+func newTestLsd(t *testing.T, port int) *LocalServiceDiscovery {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface named lo")
+	}
+	lsd, err := NewLocalServiceDiscovery(port, lo, []string { testLsdGroup }, nil)
+	if err != nil {
+		t.Skipf("Multicast unavailable on loopback: %v", err)
+	}
+	t.Cleanup(lsd.Close)
+	return lsd
+}
+
+func TestLsdDiscoversPeer(t *testing.T) {
+	infoHash := sha1.Sum([]byte("chimera"))
+	other := sha1.Sum([]byte("other"))
+
+	// Listening torrent
+	found := make(chan []PeerAddress, 10)
+	b := newTestLsd(t, 2000)
+	b.Register(infoHash[:], func(addrs []PeerAddress) { found <- addrs })
+	b.Register(other[:], func(addrs []PeerAddress) { t.Errorf("Unexpected peers: %v", addrs) })
+
+	// Announcing torrent, must never see its own announcement
+	a := newTestLsd(t, 1000)
+	a.Register(infoHash[:], func(addrs []PeerAddress) { t.Errorf("Received own announcement: %v", addrs) })
+
+	select {
+	case addrs := <- found:
+		if len(addrs) != 1 {
+			t.Fatalf("Expected 1 peer, Actual: %v", addrs)
+		}
+		pa := addrs[0]
+		if pa.GetIpAndPort() != "127.0.0.1:1000" || pa.Source != SourceLSD {
+			t.Errorf("Unexpected peer: %v", pa)
+		}
+	case <- time.After(2 * time.Second):
+		t.Fatal("Announcement not received")
+	}
+}
+
+func TestLsdIgnoresMalformedAnnouncements(t *testing.T) {
+	infoHash := sha1.Sum([]byte("chimera"))
+	lsd := newTestLsd(t, 0)
+	lsd.Register(infoHash[:], func(addrs []PeerAddress) { t.Errorf("Unexpected peers: %v", addrs) })
+
+	from := &net.UDPAddr { IP : net.IPv4(127, 0, 0, 1), Port : 5000 }
+	for _, msg := range []string {
+		"GET / HTTP/1.1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: nope\r\nInfohash: " + hex.EncodeToString(infoHash[:]) + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + hex.EncodeToString(infoHash[:]) + "\r\n\r\n",
+	} {
+		lsd.onAnnounce([]byte(msg), from)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"runtime"
 	"errors"
 	"io"
+	"net"
+	"strconv"
 	"github.com/g-dx/chimera/bencode"
 )
 
@@ -28,6 +30,7 @@ const (
 	length       = "length"
 	md5sum       = "md5sum"
 	path         = "path"
+	nodes        = "nodes"
 )
 
 // Errors
@@ -43,6 +46,7 @@ type MetaInfo struct {
 	Private      bool
 	Files        []MetaInfoFile
 	InfoHash     []byte
+	Nodes        []string // DHT bootstrap nodes (host:port)
 }
 
 type MetaInfoFile struct {
@@ -93,6 +97,7 @@ func NewMetaInfo(r io.Reader) (mi *MetaInfo, err error) {
 		Private:		optI(d(bdata, info), private) != 0,
 		Files:			toMetaInfoFiles(d(bdata, info)),
 		InfoHash:		[]byte(bs(bdata, infoHash)),
+		Nodes:			toNodes(optL(bdata, nodes)),
 	}
 
 	return mi, nil
@@ -133,6 +138,24 @@ func toMetaInfoFiles(info map[string]interface{}) []MetaInfoFile {
 	return miFiles
 }
 
+func toNodes(list []interface {}) []string {
+
+	// Each entry is a list of host & port
+	nodes := make([]string, 0, len(list))
+	for _, entry := range list {
+		node, ok := entry.([]interface {})
+		if !ok || len(node) != 2 {
+			continue
+		}
+		host, ok := node[0].(string)
+		port, ok2 := node[1].(int64)
+		if ok && ok2 {
+			nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+		}
+	}
+	return nodes
+}
+
 func toSha1Hashes(pieces string) [][]byte {
 
 	// Check format/length
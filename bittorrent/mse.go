@@ -0,0 +1,422 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------
+// EncryptionPolicy - controls Message Stream Encryption (MSE/PE) of peer connections
+// ----------------------------------------------------------------------------------
+
+type EncryptionPolicy int
+
+const (
+	// Plaintext only. Incoming encrypted connections are rejected.
+	EncryptionDisabled EncryptionPolicy = iota
+
+	// Outgoing connections are plaintext. Incoming encrypted connections are accepted
+	// & plaintext is selected if the remote offers it.
+	EncryptionEnabled
+
+	// Outgoing connections are encrypted, falling back to plaintext if the encrypted
+	// handshake fails. Incoming connections of either kind are accepted & RC4 is
+	// selected if the remote offers it.
+	EncryptionPreferred
+
+	// Encrypted (RC4) only. Plaintext connections are never made or accepted.
+	EncryptionForced
+)
+
+func (ep EncryptionPolicy) String() string {
+	switch ep {
+	case EncryptionDisabled: return "disabled"
+	case EncryptionEnabled: return "enabled"
+	case EncryptionPreferred: return "preferred"
+	case EncryptionForced: return "forced"
+	default: return "unknown"
+	}
+}
+
+// Crypto methods which may be provided & selected
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+func (ep EncryptionPolicy) provide() uint32 {
+	if ep == EncryptionForced {
+		return cryptoRC4
+	}
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// Chooses from the methods provided by the remote or returns 0 if none acceptable
+func (ep EncryptionPolicy) selectFrom(provide uint32) uint32 {
+	rc4, plaintext := provide & cryptoRC4 != 0, provide & cryptoPlaintext != 0
+	switch {
+	case plaintext && ep == EncryptionEnabled: return cryptoPlaintext
+	case rc4: return cryptoRC4
+	case plaintext && ep != EncryptionForced: return cryptoPlaintext
+	default: return 0
+	}
+}
+
+const (
+	mseKeyLen = 96    // bytes of DH public key
+	msePrivKeyBits = 160
+	mseMaxPad = 512
+	mseDiscard = 1024 // RC4 keystream bytes discarded
+)
+
+var (
+	// 768 bit DH prime & generator
+	mseP, _ = big.NewInt(0).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B" +
+		"22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E" +
+		"7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+
+	MSE_HANDSHAKE_TIMEOUT = 2 * HANDSHAKE_TIMEOUT
+
+	// Verification constant
+	mseVC = make([]byte, 8)
+
+	// Start of a plaintext handshake
+	plaintextPrefix = append([]byte { byte(len(protocolName)) }, protocolName...)
+
+	errMseSyncFailed = errors.New("Encrypted handshake: can't synchronise stream")
+	errMseBadVC = errors.New("Encrypted handshake: bad verification constant")
+	errMseNoCrypto = errors.New("Encrypted handshake: no acceptable crypto method")
+	errMseBadPad = errors.New("Encrypted handshake: padding too long")
+	errMseUnknownInfoHash = errors.New("Encrypted handshake: unknown info hash")
+	errEncryptionDisabled = errors.New("Encrypted connections are disabled")
+	errEncryptionRequired = errors.New("Plaintext connections are disabled")
+)
+
+// ----------------------------------------------------------------------------------
+// Outgoing
+// ----------------------------------------------------------------------------------
+
+// Connects to the given address applying the encryption policy. Preferred policy
+// falls back to a new plaintext connection if the encrypted handshake fails.
+func dial(addr string, infoHash []byte, policy EncryptionPolicy, d Dialer) (net.Conn, error) {
+	conn, err := d.DialTimeout(addr, DIAL_TIMEOUT)
+	if err != nil || policy < EncryptionPreferred {
+		return conn, err
+	}
+
+	ec, err := initiateMse(conn, infoHash, policy)
+	if err == nil {
+		return ec, nil
+	}
+	conn.Close()
+	if policy == EncryptionForced {
+		return nil, err
+	}
+	return d.DialTimeout(addr, DIAL_TIMEOUT)
+}
+
+// Performs the encrypted handshake as the initiator (A). SKEY is the info hash.
+func initiateMse(conn net.Conn, skey []byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(MSE_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+
+	// 1. A->B: Ya, PadA
+	x, ya := mseKeyPair()
+	if _, err := conn.Write(append(ya, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	yb := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, err
+	}
+	s := mseSecret(x, yb)
+	enc, dec := mseCipher("keyA", s, skey), mseCipher("keyB", s, skey)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//          ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	var buf bytes.Buffer
+	buf.Write(mseHash("req1", s))
+	buf.Write(xor(mseHash("req2", skey), mseHash("req3", s)))
+	payload := make([]byte, len(mseVC) + 8)
+	binary.BigEndian.PutUint32(payload[len(mseVC):], policy.provide())
+	enc.XORKeyStream(payload, payload)
+	buf.Write(payload)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD). PadB is discarded by
+	//    finding the encrypted VC.
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err := syncTo(r, vc, mseMaxPad); err != nil {
+		return nil, err
+	}
+	sel, err := readEncrypted(r, dec, 6)
+	if err != nil {
+		return nil, err
+	}
+	crypto := binary.BigEndian.Uint32(sel)
+	if crypto != cryptoRC4 && crypto != cryptoPlaintext || crypto & policy.provide() == 0 {
+		return nil, errMseNoCrypto
+	}
+	if err = discardPad(r, dec, binary.BigEndian.Uint16(sel[4:])); err != nil {
+		return nil, err
+	}
+	return newMseConn(conn, r, crypto, enc, dec, nil), nil
+}
+
+// ----------------------------------------------------------------------------------
+// Incoming
+// ----------------------------------------------------------------------------------
+
+// Detects whether an incoming connection is encrypted & if so performs the handshake
+// as the receiver (B). The info hash used as SKEY must be one of those given. Returns a
+// connection from which the plaintext BitTorrent handshake can be read.
+func acceptMse(conn net.Conn, policy EncryptionPolicy, infoHashes [][]byte) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(MSE_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+
+	prefix, err := r.Peek(len(plaintextPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, plaintextPrefix) {
+		if policy == EncryptionForced {
+			return nil, errEncryptionRequired
+		}
+		return newMseConn(conn, r, cryptoPlaintext, nil, nil, nil), nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, errEncryptionDisabled
+	}
+
+	// 1. A->B: Ya, PadA
+	ya := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	y, yb := mseKeyPair()
+	if _, err := conn.Write(append(yb, msePad()...)); err != nil {
+		return nil, err
+	}
+	s := mseSecret(y, ya)
+
+	// 3. A->B: HASH('req1', S) - PadA is discarded by finding it
+	if err := syncTo(r, mseHash("req1", s), mseMaxPad); err != nil {
+		return nil, err
+	}
+
+	// HASH('req2', SKEY) xor HASH('req3', S) identifies the torrent
+	req, err := readEncrypted(r, nil, sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	req2 := xor(req, mseHash("req3", s))
+	var skey []byte
+	for _, ih := range infoHashes {
+		if bytes.Equal(req2, mseHash("req2", ih)) {
+			skey = ih
+			break
+		}
+	}
+	if skey == nil {
+		return nil, errMseUnknownInfoHash
+	}
+	enc, dec := mseCipher("keyB", s, skey), mseCipher("keyA", s, skey)
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	provide, err := readEncrypted(r, dec, len(mseVC) + 6)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(provide[:len(mseVC)], mseVC) {
+		return nil, errMseBadVC
+	}
+	crypto := policy.selectFrom(binary.BigEndian.Uint32(provide[len(mseVC):]))
+	if crypto == 0 {
+		return nil, errMseNoCrypto
+	}
+	if err = discardPad(r, dec, binary.BigEndian.Uint16(provide[len(mseVC)+4:])); err != nil {
+		return nil, err
+	}
+	iaLen, err := readEncrypted(r, dec, 2)
+	if err != nil {
+		return nil, err
+	}
+	ia, err := readEncrypted(r, dec, int(binary.BigEndian.Uint16(iaLen)))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	sel := make([]byte, len(mseVC) + 6)
+	binary.BigEndian.PutUint32(sel[len(mseVC):], crypto)
+	enc.XORKeyStream(sel, sel)
+	if _, err = conn.Write(sel); err != nil {
+		return nil, err
+	}
+	return newMseConn(conn, r, crypto, enc, dec, ia), nil
+}
+
+// ----------------------------------------------------------------------------------
+// mseConn - connection after handshake. Reads are buffered as the handshake may read
+// past its end & RC4 is applied if selected.
+// ----------------------------------------------------------------------------------
+
+type mseConn struct {
+	net.Conn
+	r io.Reader
+	initial []byte        // decrypted initial payload (IA) not yet read
+	enc, dec *rc4.Cipher  // nil if plaintext
+	unsent []byte         // encrypted bytes not yet written
+}
+
+func newMseConn(conn net.Conn, r io.Reader, crypto uint32, enc, dec *rc4.Cipher, ia []byte) *mseConn {
+	c := &mseConn { Conn : conn, r : r, initial : ia }
+	if crypto == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c
+}
+
+func (c * mseConn) Read(b []byte) (int, error) {
+	if len(c.initial) > 0 {
+		n := copy(b, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// NOTE: After a partial write callers retry with the unwritten remainder, which has
+// already been encrypted. Only bytes beyond it are encrypted again.
+func (c * mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	if len(b) > len(c.unsent) {
+		buf := make([]byte, len(b) - len(c.unsent))
+		c.enc.XORKeyStream(buf, b[len(c.unsent):])
+		c.unsent = append(c.unsent, buf...)
+	}
+	n, err := c.Conn.Write(c.unsent[:len(b)])
+	c.unsent = c.unsent[n:]
+	return n, err
+}
+
+// ----------------------------------------------------------------------------------
+// Helpers
+// ----------------------------------------------------------------------------------
+
+func mseKeyPair() (*big.Int, []byte) {
+	x, err := rand.Int(rand.Reader, big.NewInt(0).Lsh(big.NewInt(1), msePrivKeyBits))
+	if err != nil {
+		panic(err)
+	}
+	return x, mseBytes(big.NewInt(0).Exp(mseG, x, mseP))
+}
+
+func mseSecret(x *big.Int, y []byte) []byte {
+	return mseBytes(big.NewInt(0).Exp(big.NewInt(0).SetBytes(y), x, mseP))
+}
+
+// Big endian, padded to key length
+func mseBytes(i *big.Int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, mseKeyLen - len(b)), b...)
+}
+
+func mseHash(prefix string, parts ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func mseCipher(key string, s, skey []byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(mseHash(key, s, skey))
+	if err != nil {
+		panic(err)
+	}
+	discard := make([]byte, mseDiscard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func msePad() []byte {
+	n, err := rand.Int(rand.Reader, big.NewInt(mseMaxPad + 1))
+	if err != nil {
+		panic(err)
+	}
+	pad := make([]byte, n.Int64())
+	rand.Read(pad)
+	return pad
+}
+
+func xor(a, b []byte) []byte {
+	c := make([]byte, len(a))
+	for i := range a {
+		c[i] = a[i] ^ b[i]
+	}
+	return c
+}
+
+// Consumes the stream up to & including the pattern, which must begin within max bytes
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max + len(pattern))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errMseSyncFailed
+}
+
+// Reads exactly n bytes, decrypting if a cipher is given
+func readEncrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.XORKeyStream(buf, buf)
+	}
+	return buf, nil
+}
+
+func discardPad(r io.Reader, c *rc4.Cipher, n uint16) error {
+	if n > mseMaxPad {
+		return errMseBadPad
+	}
+	_, err := readEncrypted(r, c, int(n))
+	return err
+}
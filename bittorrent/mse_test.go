@@ -0,0 +1,162 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+)
+
+var (
+	testInfoHash = sha1.Sum([]byte("chimera"))
+	otherInfoHash = sha1.Sum([]byte("other"))
+)
+
+// Accepts a single connection applying the given policy & echoes what it reads
+func newTestMseListener(t *testing.T, policy EncryptionPolicy) (string, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		c, err := acceptMse(conn, policy, [][]byte { otherInfoHash[:], testInfoHash[:] })
+		if err != nil {
+			errs <- err
+			return
+		}
+		_, err = io.CopyN(c, c, int64(len(plaintextPrefix)))
+		errs <- err
+	}()
+	return l.Addr().String(), errs
+}
+
+func assertEcho(t *testing.T, c net.Conn, errs <-chan error) {
+	if _, err := c.Write(plaintextPrefix); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(plaintextPrefix))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, plaintextPrefix) {
+		t.Errorf("Expected: %q, Actual: %q", plaintextPrefix, buf)
+	}
+	if err := <- errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMseCryptoSelected(t *testing.T) {
+	tests := []struct {
+		out, in EncryptionPolicy
+		crypto uint32
+	} {
+		{ EncryptionPreferred, EncryptionEnabled, cryptoPlaintext },
+		{ EncryptionPreferred, EncryptionPreferred, cryptoRC4 },
+		{ EncryptionPreferred, EncryptionForced, cryptoRC4 },
+		{ EncryptionForced, EncryptionEnabled, cryptoRC4 },
+		{ EncryptionForced, EncryptionForced, cryptoRC4 },
+	}
+	for _, test := range tests {
+		addr, errs := newTestMseListener(t, test.in)
+		c, err := dial(addr, testInfoHash[:], test.out, tcpDialer {})
+		if err != nil {
+			t.Fatalf("%v -> %v: %v", test.out, test.in, err)
+		}
+		mc, ok := c.(*mseConn)
+		if !ok {
+			t.Fatalf("%v -> %v: Expected encrypted handshake", test.out, test.in)
+		}
+		if encrypted := mc.enc != nil; encrypted != (test.crypto == cryptoRC4) {
+			t.Errorf("%v -> %v: Expected RC4: %v, Actual: %v", test.out, test.in, !encrypted, encrypted)
+		}
+		assertEcho(t, c, errs)
+		c.Close()
+	}
+}
+
+func TestMsePlaintextAccepted(t *testing.T) {
+	addr, errs := newTestMseListener(t, EncryptionEnabled)
+	c, err := dial(addr, testInfoHash[:], EncryptionEnabled, tcpDialer {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*mseConn); ok {
+		t.Error("Expected plaintext connection")
+	}
+	assertEcho(t, c, errs)
+}
+
+func TestMseRejected(t *testing.T) {
+	tests := []struct {
+		out, in EncryptionPolicy
+		infoHash []byte
+		err error
+	} {
+		{ EncryptionForced, EncryptionDisabled, testInfoHash[:], errEncryptionDisabled },
+		{ EncryptionDisabled, EncryptionForced, testInfoHash[:], errEncryptionRequired },
+		{ EncryptionForced, EncryptionForced, make([]byte, 20), errMseUnknownInfoHash },
+	}
+	for _, test := range tests {
+		addr, errs := newTestMseListener(t, test.in)
+		c, err := dial(addr, test.infoHash, test.out, tcpDialer {})
+		if err == nil {
+			c.Write(plaintextPrefix)
+			defer c.Close()
+		}
+		if err := <- errs; err != test.err {
+			t.Errorf("%v -> %v: Expected: %v, Actual: %v", test.out, test.in, test.err, err)
+		}
+	}
+}
+
+func TestMseFallbackToPlaintext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// First connection (encrypted) is rejected, second (plaintext) is echoed
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c, err := acceptMse(conn, EncryptionDisabled, nil)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			_, err = io.CopyN(c, c, int64(len(plaintextPrefix)))
+			errs <- err
+			conn.Close()
+		}
+	}()
+
+	c, err := dial(l.Addr().String(), testInfoHash[:], EncryptionPreferred, tcpDialer {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assertEcho(t, c, errs)
+}
+
+func TestMsePrime(t *testing.T) {
+	if mseP.BitLen() != 768 || !mseP.ProbablyPrime(20) {
+		t.Errorf("Invalid DH prime: %x", mseP)
+	}
+}
@@ -3,6 +3,7 @@ package bittorrent
 import (
 	"fmt"
 	"log"
+	"net"
 	"time"
 )
 
@@ -10,6 +11,13 @@ const (
 	ReceiveBufferSize = 25
 	RequestQueueSize = 25
 	ThirtySeconds = 30 * time.Second
+	AllowedFastSetSize = 10
+	MaxSuggestedPieces = 10
+)
+
+var (
+	SNUB_TIMEOUT = 60 * time.Second // waited for requested blocks before a peer is snubbing us
+	SNUBBED_REQUESTS = 1            // outstanding to a snubbing peer
 )
 
 
@@ -20,6 +28,7 @@ const (
 type PeerState struct {
 	remoteChoke, localChoke, remoteInterest, localInterest bool
 	bitfield *BitSet
+	fast bool // Fast extension (BEP 6) negotiated
 }
 
 func NewPeerState(bits *BitSet) PeerState {
@@ -58,16 +67,46 @@ type Peer struct {
 	// ID
 	id PeerIdentity
 
+	// Where the address of this peer was learned from
+	source PeerSource
+
 	// Peer statistics concerning upload, download, etc...
 	statistics * Statistics
 
+	// Sizes & times out our requests
+	pipeline * Pipeline
+
+	// Time spent with requests outstanding since a block last arrived. Once too long
+	// the peer is snubbing us.
+	waited time.Duration
+	checked time.Time
+	snubbed bool
+
+	// Pieces we have are withheld, being super seeded
+	hidden bool
+
+	// Fast extension (BEP 6) - pieces we may request while choked, pieces the remote
+	// may request while choked & pieces suggested by the remote
+	allowedFast, allowedFastOut map[uint32]bool
+	suggested []uint32
+
+	// Extension protocol (BEP 10) handlers, remote handshake & per-extension state
+	exts * Extensions
+	remoteExt * ExtendedHandshake
+	extData map[string]interface{}
+
 	logger * log.Logger
 
 	// Cleanup function called on close
 	onCloseFn func(error)
+	closed bool
+
+	// Called for each requested block received, before it is written
+	onBlockFn func(p *Peer, index, begin, length uint32)
 }
 
 func NewPeer(id PeerIdentity,
+			 source PeerSource,
 			 in <-chan ProtocolMessage,
 		     out chan<- ProtocolMessage,
 			 disk chan<- DiskMessage,
@@ -75,28 +114,67 @@ func NewPeer(id PeerIdentity,
 	         pieceMap * PieceMap,
 			 e <-chan error,
 			 logger * log.Logger,
-			 onCloseFn func(error)) *Peer {
+			 onCloseFn func(error),
+			 onBlockFn func(*Peer, uint32, uint32, uint32),
+			 exts * Extensions) *Peer {
 
-	return &Peer {
+	stats := &Statistics{}
+	p := &Peer {
 		inBuf      : NewRingBuffer(ReceiveBufferSize),
 
 		remoteQ    : NewMessageQueue(RequestQueueSize),
-		remoteSink : NewRemoteMessageSink(id, out, disk),
+		remoteSink : NewRemoteMessageSink(id, out, disk, stats),
 		localQ     : NewMessageQueue(RequestQueueSize),
-		localSink  : NewLocalMessageSink(id, out, disk),
+		localSink  : NewLocalMessageSink(id, out, disk, stats),
 
 		in      : in,
 
 		id         : id,
+		source     : source,
 		pieceMap   : pieceMap,
 		state      : NewPeerState(NewBitSet(uint32(len(mi.Hashes)))),
 
 		logger : logger,
 		err : e,
 
-		statistics : &Statistics{},
+		statistics : stats,
+		pipeline : NewPipeline(),
+		checked : time.Now(),
+		allowedFast : make(map[uint32]bool),
+		allowedFastOut : make(map[uint32]bool),
+		exts : exts,
+		extData : make(map[string]interface{}),
 		onCloseFn : onCloseFn,
+		onBlockFn : onBlockFn,
+	}
+
+	p.state.fast = id.SupportsFast()
+
+	// Send the pieces we have first
+	bits := pieceMap.Bitfield()
+	switch {
+	case p.state.fast && bits.IsEmpty(): p.localQ.Add(HaveNone)
+	case p.state.fast && bits.IsComplete(): p.localQ.Add(HaveAll)
+	case !bits.IsEmpty(): p.localQ.Add(Bitfield(bits.Bytes()))
+	}
+
+	// Then extended handshake
+	if id.SupportsExtensions() {
+		p.localQ.Add(exts.Handshake(id.address))
 	}
+
+	// Then pieces the remote may request while choked
+	if p.state.fast {
+		if host, _, err := net.SplitHostPort(id.address); err == nil {
+			for _, i := range AllowedFastSet(net.ParseIP(host), mi.InfoHash, pieceMap.Len(), AllowedFastSetSize) {
+				p.allowedFastOut[i] = true
+				if bits.Have(i) {
+					p.localQ.Add(AllowedFast(i))
+				}
+			}
+		}
+	}
+	return p
 }
 
 func (p * Peer) ProcessMessages() int {
@@ -112,8 +190,12 @@ func (p * Peer) ProcessMessages() int {
 	default:
 	}
 
-	// Return expired requests to map
-	p.pieceMap.ReturnBlocks(p.localQ.ClearExpired(ThirtySeconds))
+	// Size request queue to the peer's rate & return expired requests to map
+	now := time.Now()
+	p.checkSnubbed(now)
+	p.pipeline.Update(p.statistics.totalBytesDownloaded, now)
+	p.localQ.SetCapacity(p.pipeline.Depth())
+	p.pieceMap.ReturnBlocks(p.localQ.ClearExpired(p.pipeline.Timeout()))
 
 	// If we have space, fill message buffer & then process them
 	if !p.remoteQ.IsFull() {
@@ -143,6 +225,7 @@ func (p * Peer) ProcessMessages() int {
 
 func (p * Peer) HandleMessage(pm ProtocolMessage) {
 	p.logger.Printf("%v, Handling Msg: %v\n", p.id, pm)
+	p.statistics.Received(pm)
 	switch msg := pm.(type) {
 	case *ChokeMessage: p.Choke()
 	case *UnchokeMessage: p.Unchoke()
@@ -153,20 +236,63 @@ func (p * Peer) HandleMessage(pm ProtocolMessage) {
 	case *CancelMessage: p.Cancel(msg.Index(), msg.Begin(), msg.Length())
 	case *RequestMessage: p.Request(msg.Index(), msg.Begin(), msg.Length())
 	case *BlockMessage: p.Block(msg.Index(), msg.Begin(), msg.Block())
+	case *ExtendedMessage: p.Extended(msg.ExtId(), msg.Payload())
+	case *HaveAllMessage: p.HaveAll()
+	case *HaveNoneMessage: p.HaveNone()
+	case *SuggestPieceMessage: p.SuggestPiece(msg.Index())
+	case *RejectRequestMessage: p.RejectRequest(msg.Index(), msg.Begin(), msg.Length())
+	case *AllowedFastMessage: p.AllowedFast(msg.Index())
 	default:
 		panic(fmt.Sprintf("Unknown protocol message: %v", pm))
 	}
 }
 
 func (p * Peer) Choke() {
-	p.pieceMap.ReturnBlocks(p.localQ.ClearNew())
+
+	// Without fast extension all outstanding requests are discarded by the remote. With
+	// it, each is explicitly rejected & only allowed fast pieces may still be requested.
+	if p.state.fast {
+		p.pieceMap.ReturnBlocks(p.localQ.Clear(func(brs *BlockRequestStatus) bool {
+			return brs.state == new && !p.allowedFast[brs.req.Index()]
+		}))
+	} else {
+		p.pieceMap.ReturnBlocks(p.localQ.ClearUnreceived())
+	}
 	p.state.localChoke = true
+	p.waited = 0
 }
 
 func (p * Peer) Unchoke() {
 	p.state.localChoke = false
 }
 
+// Stops the remote requesting blocks from us. Without the fast extension the remote
+// discards its outstanding requests, with it each is explicitly rejected, unless for
+// an allowed fast piece.
+func (p * Peer) ChokeRemote() {
+	if p.state.remoteChoke {
+		return
+	}
+	p.state.remoteChoke = true
+	p.localQ.Add(Choke)
+	reqs := p.remoteQ.Clear(func(brs *BlockRequestStatus) bool {
+		return !p.state.fast || !p.allowedFastOut[brs.req.Index()]
+	})
+	if p.state.fast {
+		for _, req := range reqs {
+			p.remoteQ.Add(RejectRequest(req.Index(), req.Begin(), req.Length()))
+		}
+	}
+}
+
+// Allows the remote to request blocks from us
+func (p * Peer) UnchokeRemote() {
+	if p.state.remoteChoke {
+		p.state.remoteChoke = false
+		p.localQ.Add(Unchoke)
+	}
+}
+
 func (p * Peer) Interested() {
 	p.state.remoteInterest = !p.state.bitfield.IsComplete()
 }
@@ -180,6 +306,7 @@ func (p * Peer) Have(index uint32) {
 	// Validate
 	if !p.state.bitfield.IsValid(index) {
 		p.Close(newError("Invalid index received: %v", index))
+		return
 	}
 
 	if !p.state.bitfield.Have(index) {
@@ -190,32 +317,82 @@ func (p * Peer) Have(index uint32) {
 		p.pieceMap.Inc(index)
 
 		if p.isNowInteresting(index) {
+			p.state.localInterest = true
 			p.localQ.Add(Interested)
 		}
 	}
 }
 
+// Drops the request if not yet sent. With the fast extension every request must be
+// answered, so it is rejected.
 func (p * Peer) Cancel(index, begin, length uint32) {
-	p.remoteQ.Remove(index, begin, length)
+	reqs := p.remoteQ.Remove(index, begin, length)
+	if p.state.fast && len(reqs) > 0 {
+		p.remoteQ.Add(RejectRequest(index, begin, length))
+	}
 }
 
 func (p * Peer) Request(index, begin, length uint32) {
 	if !p.pieceMap.IsValid(index, begin, length) {
 		p.Close(newError("Invalid request received: %v, %v, %v", index, begin, length))
+		return
 	}
 
-	if !p.state.remoteChoke {
+	switch {
+	case !p.pieceMap.Piece(index).IsComplete():
+		p.logger.Printf("%v, Request for piece we don't have: %v\n", p.id, index)
+		if p.state.fast {
+			p.remoteQ.Add(RejectRequest(index, begin, length))
+		}
+	case !p.state.remoteChoke || (p.state.fast && p.allowedFastOut[index]):
 		p.remoteQ.Add(Request(index, begin, length))
+	case p.state.fast:
+		p.remoteQ.Add(RejectRequest(index, begin, length))
 	}
 }
 
 func (p * Peer) Block(index, begin uint32, block []byte) {
 	if !p.pieceMap.IsValid(index, begin, uint32(len(block))) {
 		p.Close(newError("Invalid block received: %v, %v, %v", index, begin, block))
+		return
 	}
 
-	p.localQ.Add(Block(index, begin, block))
-	p.Statistics().Downloaded(uint(len(block)))
+	n := uint32(len(block))
+	piece := p.pieceMap.Piece(index)
+	brs := p.localQ.Pending(index, begin, n)
+	switch {
+
+	// Already downloaded, e.g. from another peer in endgame
+	case piece.IsComplete() || piece.IsDownloaded() || piece.blocks[begin/_16KB] == DONE:
+		p.localQ.Remove(index, begin, n)
+		p.Statistics().Redundant(uint(n))
+
+	// Never requested, or since cancelled or expired
+	case brs == nil:
+		p.Statistics().Wasted(uint(n))
+
+	default:
+		p.pipeline.Sample(time.Since(brs.start))
+		p.localQ.Add(Block(index, begin, block))
+		p.Statistics().Downloaded(uint(n))
+		p.onBlockFn(p, index, begin, n)
+	}
+	p.waited = 0
+	p.snubbed = false
+}
+
+// Withdraws our request for a block since received from another peer. Requests
+// already sent are cancelled.
+func (p * Peer) CancelRequest(index, begin, length uint32) {
+	sent := false
+	p.pieceMap.ReturnBlocks(p.localQ.Clear(func(brs *BlockRequestStatus) bool {
+		match := brs.req.Index() == index && brs.req.Begin() == begin && brs.req.Length() == length
+		sent = sent || (match && brs.state == pending)
+		return match
+	}))
+	if sent {
+		p.localQ.Add(Cancel(index, begin, length))
+	}
 }
 
 func (p * Peer) Bitfield(bits []byte) {
@@ -225,21 +402,152 @@ func (p * Peer) Bitfield(bits []byte) {
 	p.state.bitfield, err = NewBitSetFrom(bits, p.state.bitfield.Size())
 	if err != nil {
 		p.Close(err)
+		return
 	}
 
-	// Update availability in global piece map
+	// Update availability in global piece map & check if we are interested
+	p.pieceMap.IncAll(p.state.bitfield)
+	p.updateInterest()
+}
+
+func (p * Peer) HaveAll() {
+	if !p.requireFast("HaveAll") {
+		return
+	}
+	p.state.bitfield.SetAll()
+	p.state.remoteInterest = false
 	p.pieceMap.IncAll(p.state.bitfield)
+	p.updateInterest()
+}
+
+func (p * Peer) HaveNone() {
+	p.requireFast("HaveNone")
+}
+
+func (p * Peer) SuggestPiece(index uint32) {
+	if !p.requireFast("SuggestPiece") {
+		return
+	}
+	if !p.state.bitfield.IsValid(index) {
+		p.Close(newError("Invalid suggested piece: %v", index))
+		return
+	}
+	if containsIndex(p.suggested, index) {
+		return
+	}
+
+	// Keep most recent suggestions only
+	if len(p.suggested) == MaxSuggestedPieces {
+		p.suggested = p.suggested[1:]
+	}
+	p.suggested = append(p.suggested, index)
+}
+
+func (p * Peer) RejectRequest(index, begin, length uint32) {
+	if !p.requireFast("RejectRequest") {
+		return
+	}
+	p.pieceMap.ReturnBlocks(p.localQ.Remove(index, begin, length))
+}
+
+func (p * Peer) AllowedFast(index uint32) {
+	if !p.requireFast("AllowedFast") {
+		return
+	}
+	if !p.state.bitfield.IsValid(index) {
+		p.Close(newError("Invalid allowed fast piece: %v", index))
+		return
+	}
+	p.allowedFast[index] = true
+}
 
-	// Check if we are interested
+// Fast extension messages may only be sent by peers which negotiated it
+func (p * Peer) requireFast(name string) bool {
+	if !p.state.fast {
+		p.Close(newError("%v received without fast extension", name))
+	}
+	return p.state.fast
+}
+
+// Sends interested if the remote has any piece we still need
+func (p * Peer) updateInterest() {
+	if p.state.localInterest {
+		return
+	}
 	for i := uint32(0); i < p.state.bitfield.Size(); i++ {
-		if p.pieceMap.Piece(i).BlocksNeeded() {
+		if p.state.bitfield.Have(i) && p.pieceMap.Piece(i).BlocksNeeded() {
 			p.state.localInterest = true
 			p.localQ.Add(Interested)
-			break
+			return
 		}
 	}
 }
 
+func (p * Peer) Extended(id byte, payload []byte) {
+
+	// Handshake - notify handlers of each extension the remote supports
+	if id == extHandshakeId {
+		hs, err := ParseExtendedHandshake(payload)
+		if err != nil {
+			p.logger.Printf("%v, Bad extended handshake: %v\n", p.id, err)
+			return
+		}
+		if p.remoteExt == nil {
+			p.remoteExt = hs
+		} else {
+			p.remoteExt.update(hs)
+		}
+		p.pipeline.SetLimit(p.remoteExt.Reqq)
+		for _, h := range p.exts.handlers {
+			if _, ok := p.remoteExt.Id(h.Name()); ok {
+				h.OnHandshake(p, p.remoteExt)
+			}
+		}
+		return
+	}
+
+	h := p.exts.Handler(id)
+	if h == nil {
+		p.logger.Printf("%v, Unknown extended message id: %v\n", p.id, id)
+		return
+	}
+	if err := h.OnMessage(p, payload); err != nil {
+		p.logger.Printf("%v, Bad %v message: %v\n", p.id, h.Name(), err)
+	}
+}
+
+// Sends a message for the named extension. Returns false if the remote peer does not
+// support it.
+func (p * Peer) SendExtended(name string, payload []byte) bool {
+	id, ok := p.remoteExt.Id(name)
+	if ok {
+		p.localQ.Add(Extended(id, payload))
+	}
+	return ok
+}
+
+// Returns the remote peer's extended handshake or nil if not yet received
+func (p Peer) ExtendedHandshake() *ExtendedHandshake {
+	return p.remoteExt
+}
+
+// Returns per-peer state stored by the named extension
+func (p Peer) ExtensionData(name string) interface{} {
+	return p.extData[name]
+}
+
+func (p * Peer) SetExtensionData(name string, v interface{}) {
+	p.extData[name] = v
+}
+
+func (p Peer) Source() PeerSource {
+	return p.source
+}
+
+func (p Peer) String() string {
+	return fmt.Sprintf("%v (%v)", p.id, p.source)
+}
+
 func (p Peer) Statistics() *Statistics {
 	return p.statistics
 }
@@ -249,6 +557,10 @@ func (p * Peer) isNowInteresting(index uint32) bool {
 }
 
 func (p * Peer) Close(err error) {
+	if p.closed {
+		return
+	}
+	p.closed = true
 
 	// Update availability & return all blocks
 	p.pieceMap.DecAll(p.state.bitfield)
@@ -262,52 +574,51 @@ func (p * Peer) Close(err error) {
 }
 
 func (p * Peer) BlocksRequired() uint {
-	return uint(p.localQ.Capacity() - p.localQ.Size())
-}
-
-func (p * Peer) BlockWritten(index, begin uint32) {
-	// Update piece and check if finished
-	piece := p.pieceMap.Piece(index)
-	piece.BlockDone(begin)
-	if piece.IsComplete() {
-
-		// TODO: Must validate hash is correct.
-
-		p.localQ.Add(Have(index))
+	n := p.localQ.Capacity()
+	if p.snubbed {
+		n = SNUBBED_REQUESTS
 	}
+	return uint(max(n - p.localQ.Size(), 0))
 }
 
 func (p * Peer) CanDownload() bool {
-	return !p.state.localChoke && p.state.localInterest && !p.localQ.IsFull()
+	return (!p.state.localChoke || len(p.allowedFast) > 0) && p.state.localInterest && p.BlocksRequired() > 0
 }
 
-// ----------------------------------------------------------------------------------
-// PeerStatistics
-// ----------------------------------------------------------------------------------
-
-type Statistics struct {
-	totalBytesDownloaded uint64
-	bytesDownloadedPerUpdate uint
-	bytesDownloaded uint
-
-	totalBytesWritten uint64
-	bytesWrittenPerUpdate uint
-	bytesWritten uint
-}
-
-func (s * Statistics) Update() {
+// Marks the peer snubbed once it has sent nothing for SNUB_TIMEOUT while we have
+// requests outstanding. Its blocks are returned for other peers to download.
+func (p * Peer) checkSnubbed(now time.Time) {
+	if p.localQ.Outstanding() > 0 {
+		p.waited += now.Sub(p.checked)
+	}
+	p.checked = now
+	if p.snubbed || p.waited < SNUB_TIMEOUT {
+		return
+	}
 
-	// Update & reset
-	s.bytesDownloadedPerUpdate = s.bytesDownloaded
-	s.bytesDownloaded = 0
-	s.bytesWrittenPerUpdate = s.bytesWritten
-	s.bytesWritten = 0
+	p.logger.Printf("%v, Snubbed after %v\n", p.id, p.waited)
+	p.snubbed = true
+	var sent []*RequestMessage
+	reqs := p.localQ.Clear(func(brs *BlockRequestStatus) bool {
+		if brs.state == pending {
+			sent = append(sent, brs.req)
+		}
+		return brs.state != received
+	})
+	for _, req := range sent {
+		p.localQ.Add(Cancel(req.Index(), req.Begin(), req.Length()))
+	}
+	p.pieceMap.ReturnBlocks(reqs)
 }
 
-func (s * Statistics) Downloaded(n uint) {
-	s.bytesDownloaded += n
+func (p Peer) IsSnubbed() bool {
+	return p.snubbed
 }
 
-func (s * Statistics) Written(n uint) {
-	s.bytesWritten += n
+// Returns true if blocks of the given piece may be requested from this peer. While
+// choked only allowed fast pieces may be requested.
+func (p * Peer) CanRequest(piece *Piece) bool {
+	return piece.BlocksNeeded() &&
+		   p.state.bitfield.Have(piece.index) &&
+		   (!p.state.localChoke || p.allowedFast[piece.index])
 }
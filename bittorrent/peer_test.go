@@ -0,0 +1,178 @@
+package bittorrent
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+type testPeer struct {
+	*Peer
+	out chan ProtocolMessage
+	disk chan DiskMessage
+}
+
+// Returns a peer of a torrent with 2 pieces, of which we have the first. The remote
+// is unchoked.
+func newTestPeer(fast bool) *testPeer {
+	mi := &MetaInfo { PieceLength : 2 * _16KB, Hashes : make([][]byte, 2), InfoHash : testInfoHash[:] }
+	mi.Files = []MetaInfoFile { { Length : 4 * uint64(_16KB) } }
+	pieceMap := NewPieceMap(2, mi.PieceLength, mi.TotalLength())
+	pieceMap.Piece(0).Verified()
+
+	id := PeerIdentity { id : remotePeerId, address : "10.0.0.1:6881" }
+	if fast {
+		id.reserved = supportedReserved
+	}
+	tp := &testPeer { out : make(chan ProtocolMessage, 50), disk : make(chan DiskMessage, 50) }
+	tp.Peer = NewPeer(id, SourceTracker, nil, tp.out, tp.disk, mi, pieceMap, nil,
+		log.New(ioutil.Discard, "", 0), func(error) {},
+		func(*Peer, uint32, uint32, uint32) {}, NewExtensions(0))
+	tp.UnchokeRemote()
+	tp.flush()
+	return tp
+}
+
+// Processes queued messages & returns those sent to the remote
+func (tp * testPeer) flush() []ProtocolMessage {
+	tp.ProcessMessages()
+	var msgs []ProtocolMessage
+	for {
+		select {
+		case msg := <- tp.out:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func (tp * testPeer) reads() []*DiskReadMessage {
+	var reads []*DiskReadMessage
+	for {
+		select {
+		case msg := <- tp.disk:
+			reads = append(reads, msg.(*DiskReadMessage))
+		default:
+			return reads
+		}
+	}
+}
+
+func TestPeerUpload(t *testing.T) {
+	tp := newTestPeer(false)
+
+	// Only pieces we have are read
+	tp.Request(0, _16KB, _16KB)
+	tp.Request(1, 0, _16KB)
+	tp.flush()
+	reads := tp.reads()
+	if len(reads) != 1 || reads[0].index != 0 || reads[0].begin != _16KB {
+		t.Fatalf("Expected: 1 read of 0, %v, Actual: %v", _16KB, reads)
+	}
+
+	// Read blocks are sent & counted
+	tp.remoteQ.Add(Block(0, _16KB, make([]byte, _16KB)))
+	msgs := tp.flush()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected: 1 block, Actual: %v", msgs)
+	}
+	if b, ok := msgs[0].(*BlockMessage); !ok || b.Index() != 0 || b.Begin() != _16KB {
+		t.Errorf("Expected: block 0, %v, Actual: %v", _16KB, msgs[0])
+	}
+	if tp.Statistics().totalBytesUploaded != uint64(_16KB) {
+		t.Errorf("Expected: %v uploaded, Actual: %v", _16KB, tp.Statistics().totalBytesUploaded)
+	}
+}
+
+func TestPeerUploadCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		fast bool
+		cancel func(*testPeer)
+	} {
+		{ "cancel", false, func(tp *testPeer) { tp.Cancel(0, 0, _16KB) } },
+		{ "cancel (fast)", true, func(tp *testPeer) { tp.Cancel(0, 0, _16KB) } },
+		{ "choke", false, func(tp *testPeer) { tp.ChokeRemote() } },
+		{ "choke (fast)", true, func(tp *testPeer) {
+			delete(tp.allowedFastOut, 0) // otherwise still served
+			tp.ChokeRemote()
+		} },
+	}
+	for _, test := range tests {
+		tp := newTestPeer(test.fast)
+		tp.Request(0, 0, _16KB)
+		tp.flush()
+		tp.reads()
+
+		// Block read after the request is cancelled is not sent
+		test.cancel(tp)
+		tp.remoteQ.Add(Block(0, 0, make([]byte, _16KB)))
+		rejected := false
+		for _, msg := range tp.flush() {
+			switch msg.(type) {
+			case *BlockMessage: t.Errorf("%v: block sent", test.name)
+			case *RejectRequestMessage: rejected = true
+			}
+		}
+		if rejected != test.fast {
+			t.Errorf("%v - Expected rejected: %v, Actual: %v", test.name, test.fast, rejected)
+		}
+	}
+}
+
+func TestPieceMapIsValid(t *testing.T) {
+	pm := NewPieceMap(2, 2 * _16KB, uint64(3 * _16KB))
+	tests := []struct {
+		index, begin, length uint32
+		valid bool
+	} {
+		{ 0, 0, _16KB, true },
+		{ 0, _16KB, _16KB, true },           // last block of piece
+		{ 1, 0, _16KB, true },               // last, shorter, piece
+		{ 1, _16KB, 1, false },
+		{ 0, _16KB, _16KB + 1, false },
+		{ 0, 0, 0, false },
+		{ 2, 0, _16KB, false },
+		{ 0, 0xFFFFFFFF, _16KB, false },     // overflow
+	}
+	for _, test := range tests {
+		if valid := pm.IsValid(test.index, test.begin, test.length); valid != test.valid {
+			t.Errorf("%v, %v, %v - Expected: %v, Actual: %v", test.index, test.begin, test.length, test.valid, valid)
+		}
+	}
+}
+
+func TestPeerSnubbed(t *testing.T) {
+	tp := newTestPeer(false)
+	tp.state.bitfield.Set(1)
+	tp.state.localChoke = false
+	tp.state.localInterest = true
+	TakeBlocks([]*Piece { tp.pieceMap.Piece(1) }, 2, tp.Peer)
+	tp.flush()
+
+	// Not yet
+	start := tp.checked
+	tp.checkSnubbed(start.Add(SNUB_TIMEOUT / 2))
+	if tp.IsSnubbed() {
+		t.Fatal("Snubbed early")
+	}
+
+	// Requests returned & cancelled, only one allowed from now on
+	tp.checkSnubbed(start.Add(SNUB_TIMEOUT))
+	if !tp.IsSnubbed() || !tp.pieceMap.Piece(1).BlocksNeeded() || tp.localQ.Size() != 0 {
+		t.Fatalf("Expected: snubbed & blocks returned, Actual: %v, %v", tp.IsSnubbed(), tp.localQ.reqs)
+	}
+	if msgs := tp.flush(); len(msgs) != 2 {
+		t.Errorf("Expected: 2 cancels, Actual: %v", msgs)
+	}
+	if n := tp.BlocksRequired(); n != uint(SNUBBED_REQUESTS) {
+		t.Errorf("Expected: %v blocks required, Actual: %v", SNUBBED_REQUESTS, n)
+	}
+
+	// Until data arrives
+	tp.Block(1, 0, make([]byte, _16KB))
+	if tp.IsSnubbed() {
+		t.Error("Still snubbed after block received")
+	}
+}
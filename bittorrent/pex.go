@@ -0,0 +1,249 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+	"github.com/g-dx/chimera/bencode"
+)
+
+var (
+	PEX_INTERVAL = 1 * time.Minute
+)
+
+const UT_PEX = "ut_pex"
+
+const (
+	pexMaxPeers = 50 // max added & dropped peers per message
+
+	// Peer flags (BEP 11)
+	pexPrefersEncryption byte = 0x01
+	pexSeed              byte = 0x02
+	pexSupportsUtp       byte = 0x04
+	pexSupportsHolepunch byte = 0x08
+	pexReachable         byte = 0x10
+)
+
+// PEX message keys
+const (
+	pexAdded    = "added"
+	pexAddedF   = "added.f"
+	pexDropped  = "dropped"
+	pexAdded6   = "added6"
+	pexAdded6F  = "added6.f"
+	pexDropped6 = "dropped6"
+)
+
+// ----------------------------------------------------------------------------------
+// PexExtension - peer exchange (BEP 11) extension handler
+// ----------------------------------------------------------------------------------
+
+type PexExtension struct {
+	onPeers func([]PeerAddress)
+}
+
+// Peers learned from remote peers are passed to onPeers
+func NewPexExtension(onPeers func([]PeerAddress)) *PexExtension {
+	return &PexExtension { onPeers : onPeers }
+}
+
+func (pe * PexExtension) Name() string {
+	return UT_PEX
+}
+
+func (pe * PexExtension) OnHandshake(p *Peer, hs *ExtendedHandshake) {
+	if p.ExtensionData(UT_PEX) == nil {
+		p.SetExtensionData(UT_PEX, NewPexState())
+	}
+}
+
+func (pe * PexExtension) OnMessage(p *Peer, payload []byte) error {
+	ps, ok := p.ExtensionData(UT_PEX).(*PexState)
+	if !ok {
+		ps = NewPexState() // Sent before handshake
+		p.SetExtensionData(UT_PEX, ps)
+	}
+	addrs, err := ps.Received(payload)
+	if err != nil {
+		return err
+	}
+	if len(addrs) > 0 {
+		pe.onPeers(addrs)
+	}
+	return nil
+}
+
+// Sends any changes to the set of connected peers to each peer which supports PEX
+func (pe * PexExtension) Send(peers []*Peer) {
+	connected := make(map[string]byte, len(peers))
+	for _, p := range peers {
+		if addr, ok := pexAddr(p); ok {
+			connected[addr] = pexFlags(p)
+		}
+	}
+	for _, p := range peers {
+		ps, ok := p.ExtensionData(UT_PEX).(*PexState)
+		if !ok {
+			continue
+		}
+		self, _ := pexAddr(p)
+		if payload := ps.Update(connected, self); payload != nil {
+			p.SendExtended(UT_PEX, payload)
+		}
+	}
+}
+
+// Returns the address a peer listens on. Incoming peers connect from a temporary port
+// so are only known if their extended handshake includes their listen port.
+func pexAddr(p *Peer) (string, bool) {
+	if p.source != SourceIncoming {
+		return p.id.address, true
+	}
+	host, _, err := net.SplitHostPort(p.id.address)
+	hs := p.ExtendedHandshake()
+	if err != nil || hs == nil || hs.P == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(hs.P))), true
+}
+
+// Returns the PEX flags describing a peer
+func pexFlags(p *Peer) byte {
+	var flags byte
+	if p.state.bitfield.IsComplete() {
+		flags |= pexSeed
+	}
+	if p.source != SourceIncoming {
+		flags |= pexReachable
+	}
+	return flags
+}
+
+// ----------------------------------------------------------------------------------
+// PexState - tracks which peers we have told a remote peer about
+// ----------------------------------------------------------------------------------
+
+type PexState struct {
+	sent map[string]byte // ip:port -> flags
+	lastSent, lastReceived time.Time
+}
+
+func NewPexState() *PexState {
+	return &PexState { sent : make(map[string]byte) }
+}
+
+// Builds a PEX message payload describing changes to the set of connected peers since
+// the last message. Returns nil if it is too soon to send or nothing has changed.
+func (ps * PexState) Update(connected map[string]byte, self string) []byte {
+	if time.Since(ps.lastSent) < PEX_INTERVAL {
+		return nil
+	}
+
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+	n := 0
+	for addr, flags := range connected {
+		if _, ok := ps.sent[addr]; ok || addr == self || n == pexMaxPeers {
+			continue
+		}
+		if buf, v6, ok := compactAddr(addr); ok {
+			if v6 {
+				added6, added6F = append(added6, buf...), append(added6F, flags)
+			} else {
+				added, addedF = append(added, buf...), append(addedF, flags)
+			}
+			ps.sent[addr] = flags
+			n++
+		}
+	}
+
+	n = 0
+	for addr := range ps.sent {
+		if _, ok := connected[addr]; ok || n == pexMaxPeers {
+			continue
+		}
+		if buf, v6, ok := compactAddr(addr); ok {
+			if v6 {
+				dropped6 = append(dropped6, buf...)
+			} else {
+				dropped = append(dropped, buf...)
+			}
+			n++
+		}
+		delete(ps.sent, addr)
+	}
+
+	if len(added) + len(added6) + len(dropped) + len(dropped6) == 0 {
+		return nil
+	}
+
+	payload, err := bencode.EncodeBytes(map[string]interface{} {
+		pexAdded    : added,
+		pexAddedF   : addedF,
+		pexDropped  : dropped,
+		pexAdded6   : added6,
+		pexAdded6F  : added6F,
+		pexDropped6 : dropped6,
+	})
+	if err != nil {
+		panic(err) // Only fails on unsupported types
+	}
+	ps.lastSent = time.Now()
+	return payload
+}
+
+// Returns the peers added by a PEX message, or nil if the message arrived too soon
+// after the previous one.
+func (ps * PexState) Received(payload []byte) ([]PeerAddress, error) {
+	if time.Since(ps.lastReceived) < PEX_INTERVAL / 2 {
+		return nil, nil
+	}
+	ps.lastReceived = time.Now()
+	return ParsePex(payload)
+}
+
+func ParsePex(payload []byte) ([]PeerAddress, error) {
+	dict, err := bencode.DecodeAsDict(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]PeerAddress, 0, pexMaxPeers)
+	for _, key := range []string { pexAdded, pexAdded6 } {
+		size := 6
+		if key == pexAdded6 {
+			size = 18
+		}
+		s, _ := dict[key].(string)
+		buf := []byte(s)
+		for ; len(buf) >= size && len(addrs) < pexMaxPeers; buf = buf[size:] {
+			addrs = append(addrs, PeerAddress {
+				Id : "unknown",
+				Ip : net.IP(buf[:size-2]).String(),
+				Port : uint(binary.BigEndian.Uint16(buf[size-2:size])),
+				Source : SourcePEX,
+			})
+		}
+	}
+	return addrs, nil
+}
+
+// Converts ip:port to compact form & indicates if it is IPv6
+func compactAddr(addr string) ([]byte, bool, bool) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false, false
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return nil, false, false
+	}
+
+	v6 := ip.To4() == nil
+	if !v6 {
+		ip = ip.To4()
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port)), v6, true
+}
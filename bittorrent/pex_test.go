@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"github.com/g-dx/chimera/bencode"
+)
+
+func TestCompactAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		buf []byte
+		v6, ok bool
+	} {
+		{ "10.0.0.1:6881", []byte { 10, 0, 0, 1, 0x1A, 0xE1 }, false, true },
+		{ "[::1]:80", append(make([]byte, 15), 1, 0, 80), true, true },
+		{ "10.0.0.1", nil, false, false },
+		{ "10.0.0.1:65536", nil, false, false },
+		{ "host:6881", nil, false, false },
+	}
+	for _, test := range tests {
+		buf, v6, ok := compactAddr(test.addr)
+		if !bytes.Equal(buf, test.buf) || v6 != test.v6 || ok != test.ok {
+			t.Errorf("%v - Expected: %v %v %v, Actual: %v %v %v", test.addr, test.buf, test.v6, test.ok, buf, v6, ok)
+		}
+	}
+}
+
+func TestParsePex(t *testing.T) {
+	payload, _ := bencode.EncodeBytes(map[string]interface{} {
+		pexAdded : []byte { 10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0, 80, 10 }, // trailing partial peer
+		pexAdded6 : append(make([]byte, 15), 1, 0, 80),
+	})
+	addrs, err := ParsePex(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PeerAddress {
+		{ Id : "unknown", Ip : "10.0.0.1", Port : 6881, Source : SourcePEX },
+		{ Id : "unknown", Ip : "10.0.0.2", Port : 80, Source : SourcePEX },
+		{ Id : "unknown", Ip : "::1", Port : 80, Source : SourcePEX },
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected: %v, Actual: %v", expected, addrs)
+	}
+
+	if _, err := ParsePex([]byte("d5:added")); err == nil {
+		t.Error("Expected error for malformed bencode")
+	}
+}
+
+func TestPexStateUpdate(t *testing.T) {
+	ps := NewPexState()
+	connected := map[string]byte {
+		"10.0.0.1:6881" : pexSeed,
+		"10.0.0.2:6881" : 0,
+		"[::1]:6881" : pexReachable,
+	}
+
+	// Everyone except the recipient is added
+	payload := ps.Update(connected, "10.0.0.2:6881")
+	msg := decodeTestPex(t, payload)
+	if msg[pexAdded] != "\x0a\x00\x00\x01\x1a\xe1" || msg[pexAddedF] != string([]byte { pexSeed }) {
+		t.Errorf("Unexpected added: %q %q", msg[pexAdded], msg[pexAddedF])
+	}
+	if len(msg[pexAdded6].(string)) != 18 || msg[pexAdded6F] != string([]byte { pexReachable }) {
+		t.Errorf("Unexpected added6: %q %q", msg[pexAdded6], msg[pexAdded6F])
+	}
+
+	// Too soon to send again
+	delete(connected, "10.0.0.1:6881")
+	if payload := ps.Update(connected, "10.0.0.2:6881"); payload != nil {
+		t.Errorf("Expected: <nil>, Actual: %q", payload)
+	}
+
+	// Only changes are sent
+	ps.lastSent = ps.lastSent.Add(-PEX_INTERVAL)
+	msg = decodeTestPex(t, ps.Update(connected, "10.0.0.2:6881"))
+	if msg[pexAdded] != "" || msg[pexDropped] != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("Unexpected added & dropped: %q %q", msg[pexAdded], msg[pexDropped])
+	}
+
+	// Nothing changed
+	ps.lastSent = ps.lastSent.Add(-PEX_INTERVAL)
+	if payload := ps.Update(connected, "10.0.0.2:6881"); payload != nil {
+		t.Errorf("Expected: <nil>, Actual: %q", payload)
+	}
+}
+
+func TestPexSendUsesListenPort(t *testing.T) {
+	recipient := newTestPexPeer("10.0.0.1:6881", SourceTracker, 0)
+	recipient.remoteExt = &ExtendedHandshake { M : map[string]byte { UT_PEX : 3 } }
+	recipient.SetExtensionData(UT_PEX, NewPexState())
+	peers := []*Peer {
+		recipient.Peer,
+		newTestPexPeer("10.0.0.2:51413", SourceIncoming, 6882).Peer,
+		newTestPexPeer("10.0.0.3:51413", SourceIncoming, 0).Peer, // listen port unknown
+	}
+
+	NewPexExtension(nil).Send(peers)
+	var payload []byte
+	for _, m := range recipient.flush() {
+		if ext, ok := m.(*ExtendedMessage); ok && ext.ExtId() == 3 {
+			payload = ext.Payload()
+		}
+	}
+	addrs, err := ParsePex(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].GetIpAndPort() != "10.0.0.2:6882" {
+		t.Errorf("Expected: [10.0.0.2:6882], Actual: %v", addrs)
+	}
+}
+
+// Returns a peer with the given source & extended handshake listen port (0 = none)
+func newTestPexPeer(addr string, source PeerSource, port uint16) *testPeer {
+	mi := &MetaInfo { PieceLength : _16KB, Hashes : make([][]byte, 1) }
+	mi.Files = []MetaInfoFile { { Length : uint64(_16KB) } }
+	tp := &testPeer { out : make(chan ProtocolMessage, 50), disk : make(chan DiskMessage, 50) }
+	tp.Peer = NewPeer(PeerIdentity { address : addr }, source, nil, tp.out, tp.disk, mi,
+		NewPieceMap(1, mi.PieceLength, mi.TotalLength()), nil, log.New(ioutil.Discard, "", 0),
+		func(error) {}, func(*Peer, uint32, uint32, uint32) {}, NewExtensions(0))
+	if port != 0 {
+		tp.remoteExt = &ExtendedHandshake { P : port }
+	}
+	tp.flush()
+	return tp
+}
+
+func decodeTestPex(t *testing.T, payload []byte) map[string]interface{} {
+	if payload == nil {
+		t.Fatal("Expected PEX message")
+	}
+	msg, err := bencode.DecodeAsDict(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
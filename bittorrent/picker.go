@@ -18,7 +18,7 @@ type ByDownloadSpeed []*Peer
 func (b ByDownloadSpeed) Len() int { return len(b) }
 func (b ByDownloadSpeed) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
 func (b ByDownloadSpeed) Less(i, j int) bool {
-	return b[i].Statistics().bytesDownloadedPerUpdate < b[j].Statistics().bytesDownloadedPerUpdate
+	return b[i].Statistics().DownloadRate() > b[j].Statistics().DownloadRate()
 }
 
 type ByAvailability []*Piece
@@ -29,13 +29,10 @@ func (b ByAvailability) Less(i, j int) bool { return b[i].Availability() < b[j].
 func PickPieces(peers []*Peer, pieceMap *PieceMap) {
 
 	fmt.Println("Running piece picker...")
-	// Sort by availability
-	sort.Sort(ByAvailability(pieceMap.pieces))
-
-	// Update counters
-	for _, p := range peers {
-		p.Statistics().Update()
-	}
+	// Sort by availability. NOTE: Piece map is indexed by piece so sort a copy
+	pieces := make([]*Piece, len(pieceMap.pieces))
+	copy(pieces, pieceMap.pieces)
+	sort.Sort(ByAvailability(pieces))
 
 	// Sort into fastest downloaders
 	sort.Sort(ByDownloadSpeed(peers))
@@ -46,23 +43,36 @@ func PickPieces(peers []*Peer, pieceMap *PieceMap) {
 
 			fmt.Printf("Finding pieces for peer: %v\n", peer.id)
 
-			// Find 10 rarest available pieces with blocks still required
-			pieces := make([]*Piece, 0, 10)
-			for _, piece := range pieceMap.pieces {
-				if piece.state == BLOCKS_NEEDED && peer.state.bitfield.Have(piece.index) {
-					pieces = append(pieces, piece)
-					if len(pieces) == 10 {
-						break
-					}
+			// Find 10 available pieces with blocks still required. Suggested & allowed
+			// fast pieces first, then the rarest.
+			picked := make([]*Piece, 0, 10)
+			add := func(piece *Piece) {
+				if len(picked) < 10 && peer.CanRequest(piece) && !containsPiece(picked, piece) {
+					picked = append(picked, piece)
+				}
+			}
+			for _, i := range peer.suggested {
+				add(pieceMap.Piece(i))
+			}
+			for i := range peer.allowedFast {
+				add(pieceMap.Piece(i))
+			}
+			for _, piece := range pieces {
+				if len(picked) == 10 {
+					break
 				}
+				add(piece)
 			}
 
-			fmt.Printf("Peer: %v rarest pieces: %v\n", peer.id, pieces)
+			fmt.Printf("Peer: %v rarest pieces: %v\n", peer.id, picked)
 
 			// Attempt to pick the number of required blocks
-			TakeBlocks(pieces, peer.BlocksRequired(), peer)
+			TakeBlocks(picked, peer.BlocksRequired(), peer)
 		}
 	}
+
+	// Finally, request the last blocks again from other peers
+	Endgame(peers, pieceMap)
 }
 
 func TakeBlocks(pieces []*Piece, numRequired uint, p *Peer) {
@@ -76,3 +86,12 @@ func TakeBlocks(pieces []*Piece, numRequired uint, p *Peer) {
 		}
 	}
 }
+
+func containsPiece(pieces []*Piece, piece *Piece) bool {
+	for _, p := range pieces {
+		if p == piece {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package bittorrent
+
+import "testing"
+
+func TestPickPiecesKeepsPieceMapOrder(t *testing.T) {
+	pm := NewPieceMap(4, _16KB, uint64(4 * _16KB))
+	for i, n := range []int { 3, 0, 2, 1 } {
+		for ; n > 0; n-- {
+			pm.Inc(uint32(i))
+		}
+	}
+
+	PickPieces(nil, pm)
+	for i := uint32(0); i < 4; i++ {
+		if index := pm.Piece(i).index; index != i {
+			t.Errorf("Expected: %v, Actual: %v", i, index)
+		}
+	}
+}
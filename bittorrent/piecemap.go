@@ -1,5 +1,7 @@
 package bittorrent
 
+import "crypto/sha1"
+
 const (
 	_16KB = uint32(16 * 1024)
 	_128KB = uint32(128 * 1024)
@@ -59,14 +61,14 @@ func (pm * PieceMap) IsValid(index, begin, length uint32) bool {
 		return false
 	}
 
-	// 2. begin + length < size
+	// 2. begin + length <= size
 	piece := pm.pieces[index]
-	if begin + length >= piece.Length() {
+	if length == 0 || uint64(begin) + uint64(length) > uint64(piece.Length()) {
 		return false
 	}
 
-	// 3. length < 2^18 (minimum piece size)
-	if length >= _128KB {
+	// 3. length <= 2^17 (largest block any client requests)
+	if length > _128KB {
 		return false
 	}
 	return true
@@ -76,11 +78,53 @@ func (pm * PieceMap) Piece(i uint32) *Piece {
 	return pm.pieces[i]
 }
 
+func (pm * PieceMap) Len() uint32 {
+	return uint32(len(pm.pieces))
+}
+
+// Returns the set of pieces we have completed
+func (pm * PieceMap) Bitfield() *BitSet {
+	bits := NewBitSet(pm.Len())
+	for _, p := range pm.pieces {
+		if p.IsComplete() {
+			bits.Set(p.index)
+		}
+	}
+	return bits
+}
+
+// Returns true once every block still needed has been requested, so slow peers can
+// only be worked around by requesting blocks again from others
+func (pm * PieceMap) IsEndgame() bool {
+	requested := false
+	for _, p := range pm.pieces {
+		switch p.state {
+		case BLOCKS_NEEDED: return false
+		case FULLY_REQUESTED: requested = true
+		}
+	}
+	return requested
+}
+
+// Records a block requested again from another peer in endgame
+func (p * PieceMap) Duplicate(req *RequestMessage) {
+	p.pieces[req.Index()].requests[req.Begin()/_16KB]++
+}
+
 func (p * PieceMap) ReturnBlocks(reqs []*RequestMessage) {
 	for _, req := range reqs {
 		// Reset block state to needed and ensure overall piece state is blocks needed
 		piece := p.pieces[req.Index()]
-		piece.blocks[req.Begin()%_16KB] = NEEDED
+		i := req.Begin()/_16KB
+		if piece.blocks[i] == DONE {
+			continue // written by another peer
+		}
+		if piece.requests[i] > 1 {
+			piece.requests[i]--
+			continue // still outstanding from another peer in endgame
+		}
+		piece.requests[i] = 0
+		piece.blocks[i] = NEEDED
 		piece.state = BLOCKS_NEEDED
 	}
 }
@@ -88,6 +132,7 @@ func (p * PieceMap) ReturnBlocks(reqs []*RequestMessage) {
 const (
 	BLOCKS_NEEDED = iota
 	FULLY_REQUESTED
+	VERIFYING // all blocks written, hash not yet checked
 	COMPLETE
 )
 
@@ -102,6 +147,8 @@ type Piece struct {
 	index uint32
 	len uint32
 	blocks []uint8
+	requests []uint8 // peers each block is outstanding from
+	sources []BlockSource // where each written block came from
 	lastBlockLen uint32
 	availability uint32
 	state int
@@ -123,7 +170,7 @@ func NewPiece(i, len uint32) *Piece {
 		blocks[index] = NEEDED
 	}
 
-	return &Piece { i, len, blocks, lastBlockLen, 0, BLOCKS_NEEDED }
+	return &Piece { i, len, blocks, make([]uint8, n), make([]BlockSource, n), lastBlockLen, 0, BLOCKS_NEEDED }
 }
 
 func (p Piece) Availability() uint32 {
@@ -147,7 +194,8 @@ func (p * Piece) TakeBlocks(n uint) []*RequestMessage {
 		// Take this block if we still need blocks
 		if s == NEEDED && uint(len(blocks)) != n {
 			p.blocks[i] = REQUESTED
-			blocks = append(blocks, Request(p.index, uint32(i) * _16KB, _16KB))
+			p.requests[i] = 1
+			blocks = append(blocks, Request(p.index, uint32(i) * _16KB, p.BlockLen(uint32(i))))
 		}
 
 		// Keep track of the overall piece a
@@ -161,10 +209,16 @@ func (p * Piece) TakeBlocks(n uint) []*RequestMessage {
 	return blocks
 }
 
-func (p * Piece) BlockDone(begin uint32) {
+// Records a block written from a peer. Once all blocks are written the piece must
+// be verified.
+func (p * Piece) BlockDone(begin uint32, src BlockSource) {
+	if p.state == VERIFYING || p.state == COMPLETE {
+		return
+	}
 
 	// Set state
 	p.blocks[begin/_16KB] = DONE
+	p.sources[begin/_16KB] = src
 
 	// Check overall piece
 	isComplete := true
@@ -176,8 +230,37 @@ func (p * Piece) BlockDone(begin uint32) {
 	}
 
 	if isComplete {
-		p.state = COMPLETE
+		p.state = VERIFYING
+	}
+}
+
+// Returns true if all blocks are written & the hash must be checked
+func (p * Piece) IsDownloaded() bool {
+	return p.state == VERIFYING
+}
+
+// Marks the piece complete, its hash having been checked
+func (p * Piece) Verified() {
+	for i := range p.blocks {
+		p.blocks[i] = DONE
 	}
+	p.state = COMPLETE
+}
+
+// Marks every block needed after a failed hash check. Returns where each written
+// block came from.
+func (p * Piece) Reset() []BlockSource {
+	var sources []BlockSource
+	for i := range p.blocks {
+		if p.sources[i].from != "" {
+			sources = append(sources, p.sources[i])
+		}
+		p.blocks[i] = NEEDED
+		p.requests[i] = 0
+		p.sources[i] = BlockSource{}
+	}
+	p.state = BLOCKS_NEEDED
+	return sources
 }
 
 func (p * Piece) IsComplete() bool {
@@ -191,3 +274,10 @@ func (p Piece) BlockLen(i uint32) uint32 {
 	}
 	return blockLen
 }
+
+// The peer a block was written from & the hash of the data it sent
+type BlockSource struct {
+	begin uint32
+	from string
+	hash [sha1.Size]byte
+}
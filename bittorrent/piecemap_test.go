@@ -0,0 +1,40 @@
+package bittorrent
+
+import "testing"
+
+func TestPieceMapReturnBlocks(t *testing.T) {
+	pm := NewPieceMap(1, 4 * _16KB, uint64(4 * _16KB))
+	piece := pm.Piece(0)
+	reqs := piece.TakeBlocks(4)
+	if piece.BlocksNeeded() {
+		t.Fatal("Expected piece to be fully requested")
+	}
+
+	pm.ReturnBlocks(reqs[2:3])
+	for i, s := range piece.blocks {
+		expected := uint8(REQUESTED)
+		if i == 2 {
+			expected = NEEDED
+		}
+		if s != expected {
+			t.Errorf("Block %v - Expected: %v, Actual: %v", i, expected, s)
+		}
+	}
+	if !piece.BlocksNeeded() {
+		t.Error("Expected piece to need blocks")
+	}
+}
+
+func TestPieceTakeBlocksLastBlockLength(t *testing.T) {
+	pm := NewPieceMap(2, 2 * _16KB, uint64(3 * _16KB + 100))
+	reqs := pm.Piece(1).TakeBlocks(2)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected: 2, Actual: %v", len(reqs))
+	}
+	if reqs[0].Length() != _16KB {
+		t.Errorf("Expected: %v, Actual: %v", _16KB, reqs[0].Length())
+	}
+	if reqs[1].Begin() != _16KB || reqs[1].Length() != 100 {
+		t.Errorf("Expected: %v/%v, Actual: %v/%v", _16KB, 100, reqs[1].Begin(), reqs[1].Length())
+	}
+}
@@ -0,0 +1,74 @@
+package bittorrent
+
+import (
+	"math"
+	"time"
+)
+
+var (
+	MIN_QUEUE_DEPTH = 2                    // requests kept outstanding, however slow the peer
+	MAX_QUEUE_DEPTH = 500                  // & however fast, whatever reqq it advertises
+	REQUEST_QUEUE_TIME = 3 * time.Second   // download kept requested from each peer
+	MIN_REQUEST_TIMEOUT = 2 * time.Second
+	MAX_REQUEST_TIMEOUT = 60 * time.Second
+)
+
+// ----------------------------------------------------------------------------------
+// Pipeline - sizes the queue of requests outstanding to a peer. Enough are kept to
+// cover REQUEST_QUEUE_TIME of download at the peer's measured rate, plus its round
+// trip, so fast peers are never idle & slow peers don't hoard blocks. Requests time
+// out once well beyond the usual time the peer takes to answer.
+// ----------------------------------------------------------------------------------
+
+type Pipeline struct {
+	srtt, rttvar time.Duration // smoothed time to answer a request & its variation
+	minRtt time.Duration       // quickest answer, the least queuing at the remote
+	rate Rate                  // download
+	limit int                  // requests the remote accepts at once
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline { limit : RequestQueueSize }
+}
+
+// Limits outstanding requests to those the remote says it will queue (reqq)
+func (pl * Pipeline) SetLimit(reqq int) {
+	if reqq > 0 {
+		pl.limit = reqq
+	}
+}
+
+// Records the time taken to answer a request (RFC 6298)
+func (pl * Pipeline) Sample(rtt time.Duration) {
+	if pl.srtt == 0 {
+		pl.srtt, pl.rttvar, pl.minRtt = rtt, rtt / 2, rtt
+		return
+	}
+	diff := pl.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	pl.rttvar = (3 * pl.rttvar + diff) / 4
+	pl.srtt = (7 * pl.srtt + rtt) / 8
+	pl.minRtt = min(pl.minRtt, rtt)
+}
+
+// Measures the download rate given the total downloaded from the peer so far
+func (pl * Pipeline) Update(downloaded uint64, now time.Time) {
+	pl.rate.Update(downloaded, now)
+}
+
+// Returns the number of requests to keep outstanding
+func (pl * Pipeline) Depth() int {
+	t := REQUEST_QUEUE_TIME + pl.minRtt
+	depth := int(math.Ceil(pl.rate.Get() * t.Seconds() / float64(_16KB)))
+	return min(max(MIN_QUEUE_DEPTH, depth), pl.limit, MAX_QUEUE_DEPTH)
+}
+
+// Returns how long to wait for a request to be answered before asking someone else
+func (pl * Pipeline) Timeout() time.Duration {
+	if pl.srtt == 0 {
+		return ThirtySeconds
+	}
+	return max(MIN_REQUEST_TIMEOUT, min(pl.srtt + 4 * pl.rttvar, MAX_REQUEST_TIMEOUT))
+}
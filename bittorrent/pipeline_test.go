@@ -0,0 +1,72 @@
+package bittorrent
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns a pipeline having downloaded at the given rate (bytes/sec) for a while
+func newTestPipeline(rate uint64, rtt time.Duration) *Pipeline {
+	pl := NewPipeline()
+	start := time.Now()
+	for i := uint64(0); i <= 20; i++ {
+		pl.Sample(rtt)
+		pl.Update(i * rate, start.Add(time.Duration(i) * time.Second))
+	}
+	return pl
+}
+
+func TestPipelineDepth(t *testing.T) {
+	tests := []struct {
+		name string
+		rate uint64
+		rtt time.Duration
+		reqq int
+		depth int
+	} {
+		{ "new peer", 0, 0, 0, MIN_QUEUE_DEPTH },
+		{ "slow", 4 * 1024, time.Second, 0, MIN_QUEUE_DEPTH },
+		{ "moderate", 160 * 1024, 100 * time.Millisecond, 250, 31 },
+		{ "reqq", 160 * 1024, 100 * time.Millisecond, 0, RequestQueueSize },
+		{ "gigabit", 100 * 1024 * 1024, time.Millisecond, 5000, MAX_QUEUE_DEPTH },
+		{ "reqq below minimum", 0, 0, 1, 1 },
+	}
+	for _, test := range tests {
+		pl := newTestPipeline(test.rate, test.rtt)
+		pl.SetLimit(test.reqq)
+		if depth := pl.Depth(); depth != test.depth {
+			t.Errorf("%v - Expected: %v, Actual: %v", test.name, test.depth, depth)
+		}
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	if timeout := NewPipeline().Timeout(); timeout != ThirtySeconds {
+		t.Errorf("Expected: %v before any sample, Actual: %v", ThirtySeconds, timeout)
+	}
+	if timeout := newTestPipeline(0, time.Millisecond).Timeout(); timeout != MIN_REQUEST_TIMEOUT {
+		t.Errorf("Expected: %v, Actual: %v", MIN_REQUEST_TIMEOUT, timeout)
+	}
+
+	// Varying answers time out later than steady ones
+	pl := newTestPipeline(0, 5 * time.Second)
+	steady := pl.Timeout()
+	for i := 0; i < 10; i++ {
+		pl.Sample(time.Duration(1 + 8 * (i % 2)) * time.Second)
+	}
+	if steady < 5 * time.Second || pl.Timeout() <= steady || pl.Timeout() > MAX_REQUEST_TIMEOUT {
+		t.Errorf("Unexpected timeouts: %v steady, %v varying", steady, pl.Timeout())
+	}
+}
+
+func TestMessageQueueClearExpired(t *testing.T) {
+	mq := NewMessageQueue(RequestQueueSize)
+	mq.Add(Request(0, 0, _16KB))
+	mq.Add(Request(0, _16KB, _16KB))
+	mq.reqs[0].start = time.Now().Add(-time.Minute)
+
+	reqs := mq.ClearExpired(ThirtySeconds)
+	if len(reqs) != 1 || reqs[0].Begin() != 0 || mq.Size() != 1 {
+		t.Errorf("Expected: 1st request expired, Actual: %v", reqs)
+	}
+}
@@ -1,32 +1,61 @@
 package bittorrent
 
 import (
+	"context"
 	"time"
 	"fmt"
 	"log"
 	"os"
+	"net"
+	"strconv"
+	"sync"
 )
 
 var (
 	QUARTER_OF_A_SECOND = 250 * time.Millisecond
 	FIFTY_MILLISECONDS = 50 * time.Millisecond
+	DHT_ANNOUNCE_PERIOD = 15 * time.Minute
 	idealPeers = 25
+	MAX_DISK_QUEUE = 100 // pending reads & writes, across all peers
+
+	// Maximum number of queued or connected peers learned from each source (default: idealPeers)
+	sourceLimits = map[PeerSource]int { SourcePEX : idealPeers / 2 }
 )
 
 type PeerCoordinator struct {
 	metaInfo *MetaInfo
+	cfg Config
 	peers []*Peer
 	trackerResponses <-chan *TrackerResponse
+	candidates chan []PeerAddress
+	incoming chan incomingPeer
 	addPeer chan *Peer
 	pieceMap *PieceMap
+	extensions *Extensions
+	pex *PexExtension
+	limits *RateLimits
+	peerLimits *PeerRateLimits
+	conns *TorrentConnections
+	choker *Choker
+	superSeeder *SuperSeeder // nil unless super seeding
+	superSeed chan bool
 	done chan struct{}
+	closeOnce sync.Once
 	dir string
 	logger *log.Logger
-	diskR chan DiskMessage
+	disk chan DiskMessage
 	diskResult <-chan DiskMessageResult
+
+	// Piece verification
+	corrupt uint64                  // bytes failing hash checks
+	hashFailures map[string]int     // failed pieces contributed to, by IP
+	banned map[string]bool          // IPs never connected to again
+	failed map[uint32][]BlockSource // blocks of failed pieces, checked once they pass
+
+	stats torrentStatistics
 }
 
-func NewPeerCoordinator(mi *MetaInfo, dir string, tr <-chan *TrackerResponse) (*PeerCoordinator, error) {
+func NewPeerCoordinator(mi *MetaInfo, dir string, tr <-chan *TrackerResponse, cfg Config) (*PeerCoordinator, error) {
 
 	// Create log file
 	// Create log file & create loggers
@@ -36,9 +65,17 @@ func NewPeerCoordinator(mi *MetaInfo, dir string, tr <-chan *TrackerResponse) (*
 	}
 	logger := log.New(f, "", log.Ldate | log.Ltime)
 
-	// Start fake disk reader
-	diskR := make(chan DiskMessage)
-	go mockDisk(diskR, logger)
+	// Open torrent data, which is shared by all peers
+	dataDir := cfg.DownloadDir
+	if dataDir == "" {
+		dataDir = dir
+	}
+	disk := make(chan DiskMessage, MAX_DISK_QUEUE)
+	diskResult := make(chan DiskMessageResult, MAX_DISK_QUEUE)
+	da, err := NewDiskAccess(mi, disk, diskResult, dataDir, logger)
+	if err != nil {
+		return nil, err
+	}
 
 
 	// Create piece map
@@ -47,18 +84,88 @@ func NewPeerCoordinator(mi *MetaInfo, dir string, tr <-chan *TrackerResponse) (*
 	// Create coordinator
 	pc := &PeerCoordinator{
 		metaInfo : mi,
+		cfg : cfg,
 		peers : make([]*Peer, 0, idealPeers),
 		trackerResponses : tr,
+		candidates : make(chan []PeerAddress),
+		incoming : make(chan incomingPeer),
 		addPeer : make(chan *Peer),
 		pieceMap : pieceMap,
+		limits : NewRateLimits(0, 0),
+		peerLimits : NewPeerRateLimits(0, 0),
+		choker : NewChoker(0),
+		superSeed : make(chan bool),
 		done : make(chan struct{}),
 		dir : dir,
 		logger : logger,
-		diskR : diskR,
+		disk : disk,
+		diskResult : diskResult,
+		hashFailures : make(map[string]int),
+		banned : make(map[string]bool),
+		failed : make(map[uint32][]BlockSource),
+	}
+
+	// Nothing may bypass the proxy, including advertising that we accept connections.
+	// LSD multicasts on the LAN so is never used with a proxy.
+	if cfg.Proxy != nil {
+		cfg.LSD = nil
+	}
+	if cfg.Proxy != nil && cfg.Proxy.NoIncoming() {
+		cfg.Port = 0
+		cfg.Listener = nil
+	}
+	if cfg.Proxy != nil && cfg.Proxy.NoDHT() {
+		cfg.DHT = nil
+	}
+	if cfg.PeerId == nil {
+		cfg.PeerId = PeerId
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = NewDialer(cfg.UTP, cfg.Proxy)
+	}
+	if cfg.Tracker == nil {
+		cfg.Tracker = DefaultTrackerClient
+	}
+	pc.cfg = cfg
+	if cfg.SuperSeed {
+		pc.superSeeder = NewSuperSeeder()
 	}
 
+	// Connections are bounded by the shared manager, if any
+	cm := cfg.Connections
+	if cm == nil {
+		cm = NewConnectionManager(0, 0, 0)
+	}
+	pc.conns = cm.Register(idealPeers, pc.handlePeerConnect)
+	if cfg.Statistics != nil {
+		cfg.Statistics.register(pc)
+	}
+
+	// Register extensions, private torrents never exchange peers
+	pc.extensions = NewExtensions(cfg.Port)
+	if mi.AllowsSource(SourcePEX) {
+		pc.pex = NewPexExtension(pc.onPeerCandidates)
+		pc.extensions.Register(pc.pex)
+	}
+	for _, h := range cfg.Extensions {
+		pc.extensions.Register(h)
+	}
+
+	// Announces may be made before the first measurement
+	pc.updateStatistics(time.Now())
+
 	// Start loop & return
+	go pc.verifyExisting(da)
 	go pc.loop()
+	if cfg.DHT != nil && mi.AllowsSource(SourceDHT) {
+		go pc.dhtLoop()
+	}
+	if cfg.LSD != nil && mi.AllowsSource(SourceLSD) {
+		cfg.LSD.Register(mi.InfoHash, pc.AddPeers)
+	}
+	if cfg.Listener != nil {
+		cfg.Listener.Register(mi.InfoHash, cfg.PeerId, pc.acceptPeer)
+	}
 	return pc, nil
 }
 
@@ -67,9 +174,83 @@ func (pc * PeerCoordinator) AwaitDone() {
 	<- pc.done
 }
 
+// Stops finding & accepting peers & closes those connected. Safe to call more than once.
+func (pc * PeerCoordinator) Close() {
+	pc.closeOnce.Do(func() { close(pc.done) })
+}
+
+// Returns the bandwidth limits of this torrent, which may be changed at any time
+func (pc * PeerCoordinator) RateLimits() *RateLimits {
+	return pc.limits
+}
+
+// Returns the bandwidth limits applied to each peer, which may be changed at any time
+func (pc * PeerCoordinator) PeerRateLimits() *PeerRateLimits {
+	return pc.peerLimits
+}
+
+// Adds peer addresses learned from any source. Addresses from sources not permitted
+// for this torrent are discarded.
+func (pc * PeerCoordinator) AddPeers(addrs []PeerAddress) {
+	select {
+	case pc.candidates <- addrs:
+	case <- pc.done:
+	}
+}
+
+// Queries a tracker for peers, reporting our current statistics. Gives up as soon as
+// the coordinator is closed, so shutdown never waits on a hung tracker.
+func (pc * PeerCoordinator) Announce(url string, numWanted uint) (*TrackerResponse, error) {
+	req := &TrackerRequest {
+		Url : url,
+		InfoHash : pc.metaInfo.InfoHash,
+		PeerId : pc.cfg.PeerId,
+		NumWanted : numWanted,
+	}
+	pc.Statistics().Announce(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <- pc.done: cancel()
+		case <- ctx.Done():
+		}
+	}()
+	return pc.cfg.Tracker.Query(ctx, req)
+}
+
+// Turns super seeding (BEP 16) on or off. Peers already connected while turning it on
+// have seen our pieces, so only those connecting later are super seeded.
+func (pc * PeerCoordinator) SetSuperSeeding(on bool) {
+	select {
+	case pc.superSeed <- on:
+	case <- pc.done:
+	}
+}
+
+// A connection accepted for this torrent whose handshake has been read
+type incomingPeer struct {
+	conn *PeerConnection
+	handshake *HandshakeMessage
+}
+
+// Called by the listener for each connection which asks for this torrent
+func (pc * PeerCoordinator) acceptPeer(conn *PeerConnection, hs *HandshakeMessage) {
+	select {
+	case pc.incoming <- incomingPeer { conn, hs }:
+	case <- pc.done:
+		conn.Close()
+	}
+}
+
 func (pc * PeerCoordinator) loop() {
 
 	onPicker := time.After(1 * time.Second)
+	onPex := time.After(PEX_INTERVAL)
+	onChoke := time.After(CHOKE_INTERVAL)
+	onSuperSeed := time.After(SUPER_SEED_INTERVAL)
+	onStats := time.After(RATE_INTERVAL)
 	for {
 
 		select {
@@ -78,31 +259,123 @@ func (pc * PeerCoordinator) loop() {
 			PickPieces(pc.peers, pc.pieceMap)
 			onPicker = time.After(1 * time.Second)
 
-		case <- time.After(10 * time.Second):
-			// Run choking algorithm
+		case <- onPex:
+			pc.sendPex()
+			onPex = time.After(PEX_INTERVAL)
+
+		case <- onChoke:
+			pc.choker.Run(pc.peers, pc.pieceMap.Bitfield().IsComplete())
+			onChoke = time.After(CHOKE_INTERVAL)
+
+		case <- onStats:
+			pc.updateStatistics(time.Now())
+			onStats = time.After(RATE_INTERVAL)
+
+		case <- onSuperSeed:
+			if pc.superSeeder != nil {
+				pc.superSeeder.Run(pc.peers, pc.pieceMap)
+			}
+			onSuperSeed = time.After(SUPER_SEED_INTERVAL)
+
+		case on := <- pc.superSeed:
+			pc.onSuperSeed(on)
 
 		case r := <- pc.trackerResponses:
 			pc.onTrackerResponse(r)
 
+		case addrs := <- pc.candidates:
+			pc.onPeerCandidates(addrs)
+
+		case ip := <- pc.incoming:
+			pc.onIncomingPeer(ip)
+
 		case p := <- pc.addPeer:
+			if pc.superSeeder != nil {
+				p.HidePieces()
+			}
 			pc.peers = append(pc.peers, p)
 
+		case dmr := <- pc.diskResult:
+			pc.onDiskMessageResult(dmr)
+
+		case <- pc.done:
+			pc.shutdown()
+			return
+
 		default:
 			pc.processMessagesFor(QUARTER_OF_A_SECOND)
 		}
 	}
 }
 
+func (pc * PeerCoordinator) dhtLoop() {
+
+	node := pc.cfg.DHT
+	if len(pc.metaInfo.Nodes) > 0 {
+		node.Bootstrap(pc.metaInfo.Nodes)
+	}
+
+	ticker := time.NewTicker(DHT_ANNOUNCE_PERIOD)
+	defer ticker.Stop()
+	for {
+		// Only announce if peers can connect to us
+		var addrs []*net.TCPAddr
+		var err error
+		if pc.cfg.Port != 0 {
+			addrs, err = node.Announce(pc.metaInfo.InfoHash, pc.cfg.Port)
+		} else {
+			addrs, err = node.GetPeers(pc.metaInfo.InfoHash)
+		}
+
+		if err != nil {
+			pc.logger.Printf("DHT lookup failed: %v\n", err)
+		} else if len(addrs) > 0 {
+			peers := make([]PeerAddress, 0, len(addrs))
+			for _, addr := range addrs {
+				peers = append(peers, PeerAddress {
+					Id : "unknown",
+					Ip : addr.IP.String(),
+					Port : uint(addr.Port),
+					Source : SourceDHT,
+				})
+			}
+			pc.AddPeers(peers)
+		}
+
+		select {
+		case <- ticker.C:
+		case <- pc.done:
+			return
+		}
+	}
+}
+
+// Stops finding & accepting peers & closes those connected
+func (pc * PeerCoordinator) shutdown() {
+	if pc.cfg.LSD != nil {
+		pc.cfg.LSD.Unregister(pc.metaInfo.InfoHash)
+	}
+	if pc.cfg.Listener != nil {
+		pc.cfg.Listener.Unregister(pc.metaInfo.InfoHash)
+	}
+	pc.conns.Close()
+	for _, p := range pc.peers {
+		p.Close(nil)
+	}
+	pc.removeClosedPeers()
+}
+
 func (pc * PeerCoordinator) processMessagesFor(d time.Duration) {
 
 	// Set a maximum amount of
 	deadline := time.Now().Add(d)
 	for time.Now().Before(deadline) {
 
-		msgs := 0
+		msgs := pc.processDiskResults()
 		for _, p := range pc.peers {
 			msgs += p.ProcessMessages()
 		}
+		pc.removeClosedPeers()
 
 		// If we did nothing this loop - wait for more data to arrive
 		if msgs == 0 {
@@ -111,41 +384,126 @@ func (pc * PeerCoordinator) processMessagesFor(d time.Duration) {
 	}
 }
 
+// Handles completed reads & writes without waiting
+func (pc * PeerCoordinator) processDiskResults() int {
+	for n := 0; ; n++ {
+		select {
+		case dmr := <- pc.diskResult:
+			pc.onDiskMessageResult(dmr)
+		default:
+			return n
+		}
+	}
+}
+
+func (pc * PeerCoordinator) removeClosedPeers() {
+	peers := pc.peers[:0]
+	for _, p := range pc.peers {
+		if !p.closed {
+			peers = append(peers, p)
+		} else {
+			pc.onPeerClosed(p)
+		}
+	}
+	pc.peers = peers
+}
+
+func (pc * PeerCoordinator) onSuperSeed(on bool) {
+	switch {
+	case on && pc.superSeeder == nil:
+		pc.superSeeder = NewSuperSeeder()
+	case !on && pc.superSeeder != nil:
+		pc.superSeeder = nil
+		for _, p := range pc.peers {
+			p.RevealPieces()
+		}
+	}
+}
+
 func (pc * PeerCoordinator) onTrackerResponse(r *TrackerResponse) {
+	pc.onPeerCandidates(r.PeerAddresses)
+}
 
-	peerCount := len(pc.peers)
-	if peerCount < idealPeers {
+// Queues permitted candidates, which are connected to as slots become free
+func (pc * PeerCoordinator) onPeerCandidates(addrs []PeerAddress) {
+	permitted := make([]PeerAddress, 0, len(addrs))
+	for _, pa := range addrs {
+		if pc.metaInfo.AllowsSource(pa.Source) && !pc.banned[pa.Ip] && pc.cfg.IPFilter.Allow(net.ParseIP(pa.Ip)) {
+			permitted = append(permitted, pa)
+		}
+	}
+	pc.conns.Add(permitted)
+}
 
-		// Add some
-		for _, pa := range r.PeerAddresses[25:] {
-			go pc.handlePeerConnect(pa, pc.pieceMap)
-			peerCount++
-			if peerCount == idealPeers {
-				break
-			}
+func (pc * PeerCoordinator) onIncomingPeer(ip incomingPeer) {
+
+	// NOTE: Port is the remote's outgoing port, not one it listens on
+	host, port, _ := net.SplitHostPort(ip.conn.RemoteAddr().String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+	addr := PeerAddress { Id : ip.handshake.peerId, Ip : host, Port : uint(p), Source : SourceIncoming }
+
+	// Reject if banned, already connected to this peer or over any limit
+	reject := pc.banned[host]
+	for _, p := range pc.peers {
+		reject = reject || string(p.id.id) == ip.handshake.peerId
+	}
+	slot, ok := pc.conns.Accept(addr)
+	if reject || !ok {
+		pc.logger.Printf("Rejecting incoming [%v]\n", ip.conn.RemoteAddr())
+		if ok {
+			slot.Release()
 		}
+		ip.conn.Close()
+		return
 	}
+	go pc.establish(ip.conn, addr, slot)
 }
 
-func (pc * PeerCoordinator) handlePeerConnect(addr PeerAddress, pieceMap *PieceMap) {
+func (pc * PeerCoordinator) sendPex() {
+	if pc.pex != nil {
+		pc.pex.Send(pc.peers)
+	}
+}
+
+func (pc * PeerCoordinator) handlePeerConnect(addr PeerAddress, slot *ConnectionSlot) {
+
+	// Never leak connections to peers from disallowed sources
+	if !pc.metaInfo.AllowsSource(addr.Source) {
+		pc.logger.Printf("Rejecting [%v]: source not permitted for private torrent\n", addr)
+		slot.Release()
+		return
+	}
 
-	conn, err := NewConnection(addr.GetIpAndPort())
+	conn, err := NewConnection(addr.GetIpAndPort(), pc.metaInfo.InfoHash, pc.cfg.Encryption, pc.cfg.Dialer)
 	if err != nil {
 		pc.logger.Printf("Can't connect to [%v]: %v\n", addr, err)
+		slot.Release()
 		return
 	}
+	slot.Connected()
+	pc.establish(conn, addr, slot)
+}
+
+// Completes the handshake on an outgoing or incoming connection & adds the peer. The
+// slot is held until the peer closes.
+func (pc * PeerCoordinator) establish(conn *PeerConnection, addr PeerAddress, slot *ConnectionSlot) {
+
+	in := make(chan ProtocolMessage, MAX_INCOMING_BUFFER)   // connection -> peer
+	out := make(chan ProtocolMessage, MAX_OUTGOING_BUFFER)  // peer -> connection
+	e := make(chan error, 1) // first connection error
+	outHandshake := handshake(supportedReserved, pc.metaInfo.InfoHash, pc.cfg.PeerId)
 
-	in := make(<-chan ProtocolMessage, 10)
-	out := make(chan<- ProtocolMessage, 10)
-	disk := make(chan<- DiskMessage, 10)
-	e := make(chan error, 3) // error sources -> reader, writer, peer
-	outHandshake := Handshake(pc.metaInfo.InfoHash)
+	// Limit by peer, torrent & then session
+	limits := pc.peerLimits.add()
+	conn.SetRateLimits(pc.cfg.ExcludeOverhead, limits, pc.limits, pc.cfg.RateLimits)
 
 	// Attempt to establish connection
-	id, err := conn.Establish(in, out, e, outHandshake, pc.dir)
+	id, err := conn.Establish(out, in, e, outHandshake, pc.dir)
 	if err != nil {
 		pc.logger.Printf("Can't establish connection [%v]: %v\n", addr, err)
+		pc.peerLimits.remove(limits)
 		conn.Close()
+		slot.Release()
 		return;
 	}
 
@@ -160,15 +518,20 @@ func (pc * PeerCoordinator) handlePeerConnect(addr PeerAddress, pieceMap *PieceM
 		if err != nil {
 			// Can't really do anything about it...
 		}
+		pc.peerLimits.remove(limits)
 
-		// 3. Remove from list of peers
-//		pc.peers.remove();
+		// 3. Free slot, peer is removed from list once closed
+		slot.Release()
 	}
 
 	// Connected
-	p := NewPeer(*id, in, out, disk, pc.metaInfo, pieceMap, e, pc.logger, onPeerClose)
+	p := NewPeer(*id, addr.Source, in, out, pc.disk, pc.metaInfo, pc.pieceMap, e, pc.logger, onPeerClose, pc.cancelDuplicates, pc.extensions)
 	pc.logger.Printf("New Peer: %v\n", p)
-	pc.addPeer <- p
+	select {
+	case pc.addPeer <- p:
+	case <- pc.done:
+		p.Close(nil)
+	}
 }
 
 func (pc * PeerCoordinator) onDiskMessageResult(dmr DiskMessageResult) {
@@ -176,8 +539,11 @@ func (pc * PeerCoordinator) onDiskMessageResult(dmr DiskMessageResult) {
 	switch msg := dmr.(type) {
 	case *DiskWriteResult:
 		if p != nil {
-			p.BlockWritten(msg.index, msg.begin)
+			p.Statistics().Written(uint(msg.length))
 		}
+		pc.onBlockWritten(msg)
+	case *DiskVerifyResult:
+		pc.onPieceVerified(msg)
 	case *DiskReadResult:
 		if p != nil {
 			p.remoteQ.Add(msg.b)
@@ -185,6 +551,12 @@ func (pc * PeerCoordinator) onDiskMessageResult(dmr DiskMessageResult) {
 	}
 }
 
+// Returns the connected peer with the given identity, or nil if it has since closed
 func (pc * PeerCoordinator) FindPeer(id PeerIdentity) *Peer {
+	for _, p := range pc.peers {
+		if !p.closed && p.id.address == id.address && string(p.id.id) == string(id.id) {
+			return p
+		}
+	}
 	return nil
 }
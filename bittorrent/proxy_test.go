@@ -0,0 +1,153 @@
+package bittorrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Echoes a single connection
+func newTestEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Proxies a single connection once the handshake function returns its destination
+func newTestProxy(t *testing.T, handshake func(net.Conn, *bufio.Reader) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		addr := handshake(conn, r)
+		if addr == "" {
+			return
+		}
+		dst, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer dst.Close()
+		go io.Copy(dst, r)
+		io.Copy(conn, dst)
+	}()
+	return l.Addr().String()
+}
+
+// Minimal SOCKS5 server requiring chimera:secret, IPv4 destinations only
+func socksHandshake(conn net.Conn, r *bufio.Reader) string {
+	buf := make([]byte, 262)
+	io.ReadFull(r, buf[:2])
+	io.ReadFull(r, buf[:buf[1]])
+	conn.Write([]byte { socksVersion, socksAuthPassword })
+
+	// <1><ulen><user><plen><pass>
+	io.ReadFull(r, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(r, user)
+	io.ReadFull(r, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(r, pass)
+	if string(user) != "chimera" || string(pass) != "secret" {
+		conn.Write([]byte { 1, 1 })
+		return ""
+	}
+	conn.Write([]byte { 1, 0 })
+
+	io.ReadFull(r, buf[:10])
+	addr := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[8:10]))))
+	conn.Write([]byte { socksVersion, 0, 0, socksIPv4, 0, 0, 0, 0, 0, 0 })
+	return addr
+}
+
+func httpConnectHandshake(conn net.Conn, r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return ""
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host
+}
+
+func TestProxyDial(t *testing.T) {
+	tests := []struct {
+		url string
+		handshake func(net.Conn, *bufio.Reader) string
+		ok bool
+	} {
+		{ "socks5://chimera:secret@", socksHandshake, true },
+		{ "socks5://chimera:wrong@", socksHandshake, false },
+		{ "http://", httpConnectHandshake, true },
+	}
+	for _, test := range tests {
+		p, err := NewProxy(ProxyConfig { Url : test.url + newTestProxy(t, test.handshake) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := p.DialTimeout(newTestEchoServer(t), time.Second)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%v: expected error", test.url)
+				c.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.url, err)
+		}
+		c.SetDeadline(time.Now().Add(time.Second))
+		c.Write(plaintextPrefix)
+		buf := make([]byte, len(plaintextPrefix))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(plaintextPrefix) {
+			t.Errorf("%v: Expected: %q, Actual: %q, %v", test.url, plaintextPrefix, buf, err)
+		}
+		c.Close()
+	}
+}
+
+func TestProxyNothingBypasses(t *testing.T) {
+	p, err := NewProxy(ProxyConfig { Url : "socks5://127.0.0.1:1080", NoIncoming : true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsd := newTestLsd(t, 6881)
+	pc, err := NewPeerCoordinator(newTestMetaInfo(), t.TempDir(), nil, Config {
+		Port : 6881,
+		Proxy : p,
+		LSD : lsd,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pc.Close)
+
+	lsd.mu.Lock()
+	registered := len(lsd.torrents)
+	lsd.mu.Unlock()
+	if pc.cfg.Port != 0 || pc.cfg.LSD != nil || registered != 0 {
+		t.Errorf("Expected: no port or LSD, Actual: %v, %v, %v registered", pc.cfg.Port, pc.cfg.LSD, registered)
+	}
+}
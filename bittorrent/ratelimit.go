@@ -0,0 +1,201 @@
+package bittorrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------
+// RateLimiter - token bucket limiting bytes per second. Waiters are served in the
+// order they arrive so connections sharing a bucket share it fairly. The rate may be
+// changed at any time & waiters adjust immediately.
+// ----------------------------------------------------------------------------------
+
+type RateLimiter struct {
+	mu sync.Mutex
+	rate int          // bytes per second (0 = unlimited)
+	tokens float64    // at most one second's worth
+	last time.Time
+	queue []*rateWaiter // head is served next
+	changed chan struct{}
+}
+
+// NOTE: Not empty, pointers to zero sized values may be equal
+type rateWaiter struct {
+	n int
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter {
+		rate : rate,
+		tokens : float64(rate),
+		last : time.Now(),
+		changed : make(chan struct{}),
+	}
+}
+
+func (rl * RateLimiter) Rate() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate
+}
+
+func (rl * RateLimiter) SetRate(rate int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill(time.Now())
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+	rl.notify()
+}
+
+// Blocks until n bytes may be transferred or ctx is done. Requests larger than the
+// bucket proceed once it is full & leave it in debt.
+func (rl * RateLimiter) WaitN(ctx context.Context, n int) error {
+	w := &rateWaiter { n }
+	rl.mu.Lock()
+	rl.queue = append(rl.queue, w)
+	for {
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if rl.queue[0] == w {
+			rl.refill(time.Now())
+			if rl.rate == 0 || rl.tokens >= float64(min(n, rl.rate)) {
+				if rl.rate != 0 {
+					rl.tokens -= float64(n)
+				}
+				rl.dequeue(w)
+				rl.mu.Unlock()
+				return nil
+			}
+			need := float64(min(n, rl.rate)) - rl.tokens
+			timer = time.NewTimer(time.Duration(need / float64(rl.rate) * float64(time.Second)))
+			wake = timer.C
+		}
+		changed := rl.changed
+		rl.mu.Unlock()
+
+		var err error
+		select {
+		case <- ctx.Done(): err = ctx.Err()
+		case <- changed:
+		case <- wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		rl.mu.Lock()
+		if err != nil {
+			rl.dequeue(w)
+			rl.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// NOTE: Must hold rl.mu
+func (rl * RateLimiter) refill(now time.Time) {
+	rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+	if rl.tokens > float64(rl.rate) {
+		rl.tokens = float64(rl.rate)
+	}
+	rl.last = now
+}
+
+// NOTE: Must hold rl.mu
+func (rl * RateLimiter) dequeue(w *rateWaiter) {
+	for i, q := range rl.queue {
+		if q == w {
+			rl.queue = append(rl.queue[:i], rl.queue[i+1:]...)
+			break
+		}
+	}
+	rl.notify()
+}
+
+// Wakes all waiters to re-check their position & the rate
+// NOTE: Must hold rl.mu
+func (rl * RateLimiter) notify() {
+	close(rl.changed)
+	rl.changed = make(chan struct{})
+}
+
+// ----------------------------------------------------------------------------------
+// RateLimits - upload & download limits of a session, torrent or peer
+// ----------------------------------------------------------------------------------
+
+type RateLimits struct {
+	Upload, Download *RateLimiter
+}
+
+// Creates limits in bytes per second (0 = unlimited)
+func NewRateLimits(up, down int) *RateLimits {
+	return &RateLimits { NewRateLimiter(up), NewRateLimiter(down) }
+}
+
+// ----------------------------------------------------------------------------------
+// PeerRateLimits - limits applied to each peer of a torrent individually
+// ----------------------------------------------------------------------------------
+
+type PeerRateLimits struct {
+	mu sync.Mutex
+	up, down int
+	peers map[*RateLimits]bool
+}
+
+func NewPeerRateLimits(up, down int) *PeerRateLimits {
+	return &PeerRateLimits { up : up, down : down, peers : make(map[*RateLimits]bool) }
+}
+
+// Changes the limits of every current & future peer
+func (prl * PeerRateLimits) SetRates(up, down int) {
+	prl.mu.Lock()
+	defer prl.mu.Unlock()
+	prl.up, prl.down = up, down
+	for l := range prl.peers {
+		l.Upload.SetRate(up)
+		l.Download.SetRate(down)
+	}
+}
+
+func (prl * PeerRateLimits) add() *RateLimits {
+	prl.mu.Lock()
+	defer prl.mu.Unlock()
+	l := NewRateLimits(prl.up, prl.down)
+	prl.peers[l] = true
+	return l
+}
+
+func (prl * PeerRateLimits) remove(l *RateLimits) {
+	prl.mu.Lock()
+	delete(prl.peers, l)
+	prl.mu.Unlock()
+}
+
+// Waits for n bytes from each limiter in turn, most specific first
+func waitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	if n == 0 {
+		return nil
+	}
+	for _, rl := range limiters {
+		if err := rl.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the bytes of a message which count towards rate limits
+func rateLimitedBytes(msg ProtocolMessage, wireLen int, excludeOverhead bool) int {
+	if !excludeOverhead {
+		return wireLen
+	}
+	if b, ok := msg.(*BlockMessage); ok {
+		return len(b.Block())
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package bittorrent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRate(t *testing.T) {
+	rl := NewRateLimiter(100 * 1024)
+
+	// Initial burst is free, the remainder takes ~0.5s
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		rl.WaitN(context.Background(), 15 * 1024)
+	}
+	if d := time.Since(start); d < 400 * time.Millisecond || d > time.Second {
+		t.Errorf("Expected: ~500ms, Actual: %v", d)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	rl := NewRateLimiter(1)
+	done := make(chan error)
+	go func() {
+		done <- rl.WaitN(context.Background(), 1000)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rl.SetRate(0)
+	select {
+	case err := <- done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <- time.After(time.Second):
+		t.Error("Waiter not released by rate change")
+	}
+
+	// Cancelled waiters give up their place
+	rl.SetRate(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if err := rl.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("Expected: %v, Actual: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRateLimiterFair(t *testing.T) {
+	rl := NewRateLimiter(64 * 1024)
+	rl.WaitN(context.Background(), 64 * 1024) // empty bucket
+
+	// Two peers competing for the bucket receive an equal share
+	var mu sync.Mutex
+	counts := make([]int, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for rl.WaitN(ctx, 1024) == nil {
+				mu.Lock()
+				counts[i]++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if diff := counts[0] - counts[1]; diff < -2 || diff > 2 {
+		t.Errorf("Expected equal share, Actual: %v", counts)
+	}
+}
@@ -0,0 +1,33 @@
+package bittorrent
+
+// ----------------------------------------------------------------------------------
+// PeerSource - where a peer address was learned from
+// ----------------------------------------------------------------------------------
+
+type PeerSource int
+
+const (
+	SourceUnknown PeerSource = iota // never set, so never trusted
+	SourceTracker
+	SourceIncoming
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	SourceMagnet
+)
+
+var sourceNames = []string { "unknown", "tracker", "incoming", "dht", "pex", "lsd", "magnet" }
+
+func (ps PeerSource) String() string {
+	if int(ps) >= len(sourceNames) {
+		return "unknown"
+	}
+	return sourceNames[ps]
+}
+
+// Returns true if peers from the given source may be used for this torrent. Private
+// torrents (BEP 27) must only use peers supplied by their trackers or peers which
+// connected to us. Peers of unknown source are never used for private torrents.
+func (mi *MetaInfo) AllowsSource(ps PeerSource) bool {
+	return !mi.Private || ps == SourceTracker || ps == SourceIncoming
+}
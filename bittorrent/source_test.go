@@ -0,0 +1,59 @@
+package bittorrent
+
+import "testing"
+
+func TestAllowsSource(t *testing.T) {
+	public, private := &MetaInfo {}, &MetaInfo { Private : true }
+	tests := []struct {
+		ps PeerSource
+		private bool
+	} {
+		{ SourceUnknown, false },
+		{ SourceTracker, true },
+		{ SourceIncoming, true },
+		{ SourceDHT, false },
+		{ SourcePEX, false },
+		{ SourceLSD, false },
+		{ SourceMagnet, false },
+	}
+	for _, test := range tests {
+		if !public.AllowsSource(test.ps) {
+			t.Errorf("%v - Expected: allowed for public torrent", test.ps)
+		}
+		if allowed := private.AllowsSource(test.ps); allowed != test.private {
+			t.Errorf("%v - Expected: %v, Actual: %v", test.ps, test.private, allowed)
+		}
+	}
+	var ps PeerSource
+	if ps != SourceUnknown || ps.String() != "unknown" {
+		t.Errorf("Expected: unknown zero value, Actual: %v", ps)
+	}
+}
+
+func TestPeerCandidatesFiltered(t *testing.T) {
+	cm := NewConnectionManager(10, 10, 1)
+	pc := newTestVerifyCoordinator()
+	pc.metaInfo.Private = true
+	pc.banned["10.0.0.2"] = true
+	tc, c := newTestTorrent(cm, 10)
+	pc.conns = tc
+	t.Cleanup(tc.Close)
+
+	// Only tracker peers which aren't banned may be used
+	addrs := testAddrs(SourceTracker, 1, 2)
+	addrs = append(addrs, testAddrs(SourceUnknown, 3)...)
+	addrs = append(addrs, testAddrs(SourceDHT, 4)...)
+	addrs = append(addrs, testAddrs(SourcePEX, 5)...)
+	addrs = append(addrs, testAddrs(SourceLSD, 6)...)
+	pc.onPeerCandidates(addrs)
+	for _, slot := range expectDialled(t, c, "10.0.0.1") {
+		slot.Release()
+	}
+
+	// Public torrents use all sources
+	pc.metaInfo.Private = false
+	pc.onPeerCandidates(addrs)
+	for _, slot := range expectDialled(t, c, "10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6") {
+		slot.Release()
+	}
+}
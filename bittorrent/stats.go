@@ -0,0 +1,272 @@
+package bittorrent
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	RATE_INTERVAL = 1 * time.Second // period rates are measured over
+	RATE_WEIGHT = 0.2               // of each new measurement in smoothed rates
+)
+
+// ----------------------------------------------------------------------------------
+// Rate - bytes/sec, smoothed with an exponentially weighted moving average
+// ----------------------------------------------------------------------------------
+
+type Rate struct {
+	rate float64
+	total uint64 // at the last measurement
+	measured time.Time
+}
+
+// Measures the rate given the running total. The first call sets the baseline.
+func (r * Rate) Update(total uint64, now time.Time) {
+	elapsed := now.Sub(r.measured)
+	switch {
+	case r.measured.IsZero():
+	case elapsed < RATE_INTERVAL:
+		return
+	case r.rate == 0:
+		r.rate = float64(total - r.total) / elapsed.Seconds()
+	default:
+		r.rate += RATE_WEIGHT * (float64(total - r.total) / elapsed.Seconds() - r.rate)
+	}
+	r.total, r.measured = total, now
+}
+
+func (r Rate) Get() float64 {
+	return r.rate
+}
+
+// ----------------------------------------------------------------------------------
+// PeerStatistics - kept by each peer & only accessed from the coordinator loop.
+// Payload is block data, protocol everything else sent & received, including block
+// headers. Wasted payload arrived unrequested or after it was cancelled, redundant
+// payload was already downloaded from another peer. Neither counts as downloaded, so
+// rates used by the choker & request pipeline only reflect useful payload.
+// ----------------------------------------------------------------------------------
+
+type Statistics struct {
+	totalBytesDownloaded uint64
+	totalBytesUploaded uint64
+	totalBytesWritten uint64
+	protocolDownloaded uint64
+	protocolUploaded uint64
+	wasted uint64
+	redundant uint64
+	downloadRate, uploadRate Rate
+}
+
+// Measures payload rates
+func (s * Statistics) Update(now time.Time) {
+	s.downloadRate.Update(s.totalBytesDownloaded, now)
+	s.uploadRate.Update(s.totalBytesUploaded, now)
+}
+
+func (s * Statistics) Downloaded(n uint) {
+	s.totalBytesDownloaded += uint64(n)
+}
+
+func (s * Statistics) Uploaded(n uint) {
+	s.totalBytesUploaded += uint64(n)
+}
+
+func (s * Statistics) Written(n uint) {
+	s.totalBytesWritten += uint64(n)
+}
+
+func (s * Statistics) Wasted(n uint) {
+	s.wasted += uint64(n)
+}
+
+func (s * Statistics) Redundant(n uint) {
+	s.redundant += uint64(n)
+}
+
+// Counts protocol bytes of a message received. Block payload is counted once handled.
+func (s * Statistics) Received(msg ProtocolMessage) {
+	s.protocolDownloaded += protocolBytes(msg)
+}
+
+// Counts a message sent
+func (s * Statistics) Sent(msg ProtocolMessage) {
+	if b, ok := msg.(*BlockMessage); ok {
+		s.Uploaded(uint(len(b.Block())))
+	}
+	s.protocolUploaded += protocolBytes(msg)
+}
+
+func (s Statistics) DownloadRate() float64 {
+	return s.downloadRate.Get()
+}
+
+func (s Statistics) UploadRate() float64 {
+	return s.uploadRate.Get()
+}
+
+func (s Statistics) Snapshot() TransferStats {
+	return TransferStats {
+		Downloaded : s.totalBytesDownloaded,
+		Uploaded : s.totalBytesUploaded,
+		ProtocolDownloaded : s.protocolDownloaded,
+		ProtocolUploaded : s.protocolUploaded,
+		Wasted : s.wasted,
+		Redundant : s.redundant,
+		DownloadRate : s.DownloadRate(),
+		UploadRate : s.UploadRate(),
+	}
+}
+
+// Returns bytes on the wire, less any block payload
+func protocolBytes(msg ProtocolMessage) uint64 {
+	n := 4 + uint64(msg.Len()) // length prefix
+	if b, ok := msg.(*BlockMessage); ok {
+		n -= uint64(len(b.Block()))
+	}
+	return n
+}
+
+// ----------------------------------------------------------------------------------
+// Snapshots - read-only copies of statistics, safe to use from any goroutine
+// ----------------------------------------------------------------------------------
+
+type TransferStats struct {
+	Downloaded, Uploaded uint64                 // useful payload
+	ProtocolDownloaded, ProtocolUploaded uint64 // all else
+	Wasted uint64                               // payload unrequested or cancelled
+	Redundant uint64                            // payload downloaded more than once
+	Corrupt uint64                              // payload failing hash checks
+	DownloadRate, UploadRate float64            // payload bytes/sec, smoothed
+}
+
+func (ts * TransferStats) add(o TransferStats) {
+	ts.Downloaded += o.Downloaded
+	ts.Uploaded += o.Uploaded
+	ts.ProtocolDownloaded += o.ProtocolDownloaded
+	ts.ProtocolUploaded += o.ProtocolUploaded
+	ts.Wasted += o.Wasted
+	ts.Redundant += o.Redundant
+	ts.Corrupt += o.Corrupt
+	ts.DownloadRate += o.DownloadRate
+	ts.UploadRate += o.UploadRate
+}
+
+type PeerStats struct {
+	TransferStats
+	Address string
+	Source PeerSource
+	Choked bool   // by the remote
+	Choking bool  // the remote
+	Snubbed bool
+}
+
+type TorrentStats struct {
+	TransferStats
+	InfoHash []byte
+	Left uint64 // bytes still to verify
+	Peers []PeerStats
+}
+
+// Fills in the transfer totals of a tracker announce
+func (ts TorrentStats) Announce(req *TrackerRequest) {
+	req.Uploaded, req.Downloaded = ts.Uploaded, ts.Downloaded
+	req.Left, req.Corrupt = ts.Left, ts.Corrupt
+}
+
+type SessionStats struct {
+	TransferStats
+	Torrents []TorrentStats
+}
+
+// ----------------------------------------------------------------------------------
+// Torrent statistics - measured by the coordinator every RATE_INTERVAL
+// ----------------------------------------------------------------------------------
+
+type torrentStatistics struct {
+	mu sync.Mutex
+	snapshot TorrentStats
+	closed TransferStats     // totals of peers since closed
+	downloadRate, uploadRate Rate
+}
+
+// Returns the latest statistics of this torrent & its peers
+func (pc * PeerCoordinator) Statistics() TorrentStats {
+	pc.stats.mu.Lock()
+	defer pc.stats.mu.Unlock()
+	return pc.stats.snapshot
+}
+
+// Measures rates & takes a snapshot for other goroutines
+func (pc * PeerCoordinator) updateStatistics(now time.Time) {
+	ts := TorrentStats { InfoHash : pc.metaInfo.InfoHash, TransferStats : pc.stats.closed }
+	for _, p := range pc.peers {
+		p.Statistics().Update(now)
+		ps := PeerStats {
+			TransferStats : p.Statistics().Snapshot(),
+			Address : p.id.address,
+			Source : p.source,
+			Choked : p.state.localChoke,
+			Choking : p.state.remoteChoke,
+			Snubbed : p.snubbed,
+		}
+		ts.add(ps.TransferStats)
+		ts.Peers = append(ts.Peers, ps)
+	}
+	for _, piece := range pc.pieceMap.pieces {
+		if !piece.IsComplete() {
+			ts.Left += uint64(piece.Length())
+		}
+	}
+
+	// Torrent rates include closed peers
+	pc.stats.downloadRate.Update(ts.Downloaded, now)
+	pc.stats.uploadRate.Update(ts.Uploaded, now)
+	ts.DownloadRate, ts.UploadRate = pc.stats.downloadRate.Get(), pc.stats.uploadRate.Get()
+	ts.Corrupt = pc.Corrupt()
+
+	pc.stats.mu.Lock()
+	pc.stats.snapshot = ts
+	pc.stats.mu.Unlock()
+}
+
+// Keeps the totals of closing peers
+func (pc * PeerCoordinator) onPeerClosed(p *Peer) {
+	ts := p.Statistics().Snapshot()
+	ts.DownloadRate, ts.UploadRate = 0, 0
+	pc.stats.closed.add(ts)
+}
+
+// ----------------------------------------------------------------------------------
+// SessionStatistics - aggregates every torrent sharing it
+// ----------------------------------------------------------------------------------
+
+type SessionStatistics struct {
+	mu sync.Mutex
+	torrents []*PeerCoordinator
+}
+
+func NewSessionStatistics() *SessionStatistics {
+	return &SessionStatistics{}
+}
+
+func (ss * SessionStatistics) register(pc *PeerCoordinator) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.torrents = append(ss.torrents, pc)
+}
+
+// Returns the latest statistics of every torrent & their totals
+func (ss * SessionStatistics) Snapshot() SessionStats {
+	ss.mu.Lock()
+	torrents := append([]*PeerCoordinator(nil), ss.torrents...)
+	ss.mu.Unlock()
+
+	var s SessionStats
+	for _, pc := range torrents {
+		ts := pc.Statistics()
+		s.add(ts.TransferStats)
+		s.Torrents = append(s.Torrents, ts)
+	}
+	return s
+}
@@ -0,0 +1,124 @@
+package bittorrent
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	var r Rate
+	start := time.Now()
+	r.Update(1000, start) // baseline
+	r.Update(3000, start.Add(RATE_INTERVAL / 2))
+	if r.Get() != 0 {
+		t.Errorf("Measured before interval: %v", r.Get())
+	}
+
+	// Converges on a steady rate
+	for i := 1; i <= 50; i++ {
+		r.Update(uint64(1000 + i * 2000), start.Add(time.Duration(i) * time.Second))
+	}
+	if math.Abs(r.Get() - 2000) > 1 {
+		t.Errorf("Expected: 2000, Actual: %v", r.Get())
+	}
+}
+
+func TestPeerStatistics(t *testing.T) {
+	tp := newTestPeer(false)
+	tp.state.bitfield.Set(1)
+	tp.state.localChoke = false
+	TakeBlocks([]*Piece { tp.pieceMap.Piece(1) }, 1, tp.Peer)
+	tp.flush()
+
+	tp.HandleMessage(Block(1, 0, make([]byte, _16KB)))      // requested
+	tp.HandleMessage(Block(1, _16KB, make([]byte, _16KB)))  // never requested
+	tp.HandleMessage(Block(0, 0, make([]byte, _16KB)))      // have already
+	tp.HandleMessage(Have(1))
+	tp.flush()
+
+	ts := tp.Statistics().Snapshot()
+	if ts.Downloaded != uint64(_16KB) || ts.Wasted != uint64(_16KB) || ts.Redundant != uint64(_16KB) {
+		t.Errorf("Unexpected payload: %+v", ts)
+	}
+	if ts.ProtocolDownloaded != 3 * 13 + 9 {
+		t.Errorf("Expected: %v protocol bytes received, Actual: %v", 3 * 13 + 9, ts.ProtocolDownloaded)
+	}
+
+	// Bitfield, unchoke & request sent, only the requested block written
+	if ts.ProtocolUploaded != 6 + 5 + 17 || len(tp.disk) != 1 {
+		t.Errorf("Expected: %v protocol bytes sent & 1 write, Actual: %v & %v", 6 + 5 + 17, ts.ProtocolUploaded, len(tp.disk))
+	}
+}
+
+func TestPeerDownloadRateUsefulOnly(t *testing.T) {
+	tp := newTestPeer(false)
+	tp.state.bitfield.Set(1)
+	tp.state.localChoke = false
+	TakeBlocks([]*Piece { tp.pieceMap.Piece(1) }, 1, tp.Peer)
+	tp.flush()
+
+	start := time.Now()
+	tp.Statistics().Update(start) // baseline
+	tp.HandleMessage(Block(1, 0, make([]byte, _16KB)))      // requested
+	tp.HandleMessage(Block(1, _16KB, make([]byte, _16KB)))  // never requested
+	tp.HandleMessage(Block(0, 0, make([]byte, _16KB)))      // have already
+	tp.flush()
+
+	tp.Statistics().Update(start.Add(time.Second))
+	if rate := tp.Statistics().DownloadRate(); rate != float64(_16KB) {
+		t.Errorf("Expected: %v, Actual: %v", _16KB, rate)
+	}
+}
+
+func TestSessionStatistics(t *testing.T) {
+	ss := NewSessionStatistics()
+	var pcs []*PeerCoordinator
+	for i := 0; i < 2; i++ {
+		pc := newTestVerifyCoordinator()
+		pc.peers = newTestChokePeers(2)
+		pc.peers[0].Statistics().Downloaded(100)
+		pc.peers[1].Statistics().Uploaded(10)
+		pc.pieceMap.Piece(0).Verified()
+		ss.register(pc)
+		pcs = append(pcs, pc)
+	}
+	pcs[1].corrupt = 5
+
+	// Totals kept once peers close
+	pcs[0].peers[0].closed = true
+	pcs[0].removeClosedPeers()
+	for _, pc := range pcs {
+		pc.updateStatistics(time.Now())
+	}
+
+	ts := pcs[0].Statistics()
+	if ts.Downloaded != 100 || ts.Uploaded != 10 || len(ts.Peers) != 1 || ts.Left != uint64(2 * _16KB) {
+		t.Errorf("Unexpected torrent statistics: %+v", ts)
+	}
+	s := ss.Snapshot()
+	if len(s.Torrents) != 2 || s.Downloaded != 200 || s.Uploaded != 20 || s.Corrupt != 5 {
+		t.Errorf("Unexpected session statistics: %+v", s.TransferStats)
+	}
+
+	req := &TrackerRequest{}
+	s.Torrents[1].Announce(req)
+	if req.Downloaded != 100 || req.Uploaded != 10 || req.Left != uint64(2 * _16KB) || req.Corrupt != 5 {
+		t.Errorf("Unexpected announce: %+v", req)
+	}
+}
+
+func TestAnnounceBeforeFirstMeasurement(t *testing.T) {
+	mi := newTestMetaInfo()
+	pc, err := NewPeerCoordinator(mi, t.TempDir(), nil, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pc.Close)
+
+	req := &TrackerRequest{}
+	pc.Statistics().Announce(req)
+	if req.Left != mi.TotalLength() {
+		t.Errorf("Expected: %v left, Actual: %v", mi.TotalLength(), req.Left)
+	}
+}
@@ -0,0 +1,110 @@
+package bittorrent
+
+import "time"
+
+var (
+	SUPER_SEED_INTERVAL = 1 * time.Second
+)
+
+// ----------------------------------------------------------------------------------
+// Super seeding (BEP 16) - as the only seed, avoids uploading the same pieces over &
+// over. Peers never see our bitfield. Instead each is offered a single rare piece via
+// Have & only offered another once the first has been seen propagating, i.e. more
+// peers besides it have the piece than when it was offered.
+// ----------------------------------------------------------------------------------
+
+type SuperSeeder struct {
+	offers map[*Peer]*superSeedOffer
+}
+
+type superSeedOffer struct {
+	index uint32
+	others uint32 // peers, other than the one offered it, having the piece at the time
+}
+
+func NewSuperSeeder() *SuperSeeder {
+	return &SuperSeeder { offers : make(map[*Peer]*superSeedOffer) }
+}
+
+// Offers a piece to each peer without one or whose piece has propagated
+func (s * SuperSeeder) Run(peers []*Peer, pieceMap *PieceMap) {
+	current := make(map[*Peer]*superSeedOffer, len(peers))
+	offered := make(map[uint32]bool)
+	for _, p := range peers {
+		if o, ok := s.offers[p]; ok && !p.closed {
+			current[p] = o
+			offered[o.index] = true
+		}
+	}
+
+	for _, p := range peers {
+		if p.closed || !p.hidden {
+			continue
+		}
+		if o, ok := current[p]; ok && othersHaving(p, pieceMap.Piece(o.index)) <= o.others {
+			continue
+		}
+		if piece := s.pick(p, pieceMap, offered); piece != nil {
+			current[p] = &superSeedOffer { piece.index, othersHaving(p, piece) }
+			offered[piece.index] = true
+			p.localQ.Add(Have(piece.index))
+		}
+	}
+	s.offers = current
+}
+
+// Picks the rarest piece the peer doesn't have, preferring those not offered to others
+func (s * SuperSeeder) pick(p *Peer, pieceMap *PieceMap, offered map[uint32]bool) *Piece {
+	var best *Piece
+	for _, piece := range pieceMap.pieces {
+		if !piece.IsComplete() || p.state.bitfield.Have(piece.index) {
+			continue
+		}
+		if best == nil || offered[best.index] && !offered[piece.index] ||
+		   offered[best.index] == offered[piece.index] && piece.Availability() < best.Availability() {
+			best = piece
+		}
+	}
+	return best
+}
+
+// Returns the number of connected peers other than p which have the piece
+func othersHaving(p *Peer, piece *Piece) uint32 {
+	n := piece.Availability()
+	if p.state.bitfield.Have(piece.index) {
+		n--
+	}
+	return n
+}
+
+// Withholds the pieces we have from the remote, so they can be offered one at a time.
+// Must be called before the peer first processes messages.
+func (p * Peer) HidePieces() {
+	other := make([]ProtocolMessage, 0, len(p.localQ.other) + 1)
+	if p.state.fast {
+		other = append(other, HaveNone)
+	}
+	for _, msg := range p.localQ.other {
+		switch msg.(type) {
+		case *BitfieldMessage, *HaveAllMessage, *HaveNoneMessage, *HaveMessage, *AllowedFastMessage:
+		default:
+			other = append(other, msg)
+		}
+	}
+	p.localQ.other = other
+	p.hidden = true
+}
+
+// Tells the remote of every piece we have once no longer super seeding
+func (p * Peer) RevealPieces() {
+	if !p.hidden {
+		return
+	}
+	bits := p.pieceMap.Bitfield()
+	for i := uint32(0); i < bits.Size(); i++ {
+		if bits.Have(i) {
+			p.localQ.Add(Have(i))
+		}
+	}
+	p.hidden = false
+}
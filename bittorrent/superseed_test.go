@@ -0,0 +1,90 @@
+package bittorrent
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestPeerHidePieces(t *testing.T) {
+	mi := &MetaInfo { PieceLength : _16KB, Hashes : make([][]byte, 4), InfoHash : testInfoHash[:] }
+	mi.Files = []MetaInfoFile { { Length : 4 * uint64(_16KB) } }
+	pieceMap := NewPieceMap(4, mi.PieceLength, mi.TotalLength())
+	for i := uint32(0); i < 4; i++ {
+		pieceMap.Piece(i).Verified()
+	}
+
+	id := PeerIdentity { id : remotePeerId, address : "10.0.0.1:6881", reserved : supportedReserved }
+	tp := &testPeer { out : make(chan ProtocolMessage, 50), disk : make(chan DiskMessage, 50) }
+	tp.Peer = NewPeer(id, SourceTracker, nil, tp.out, tp.disk, mi, pieceMap, nil,
+		log.New(ioutil.Discard, "", 0), func(error) {},
+		func(*Peer, uint32, uint32, uint32) {}, NewExtensions(0))
+	tp.HidePieces()
+
+	msgs := tp.flush()
+	if len(msgs) == 0 || msgs[0] != HaveNone {
+		t.Fatalf("Expected: HaveNone first, Actual: %v", msgs)
+	}
+	for _, msg := range msgs[1:] {
+		switch msg.(type) {
+		case *HaveAllMessage, *BitfieldMessage, *HaveMessage, *AllowedFastMessage:
+			t.Errorf("Pieces revealed: %v", msg)
+		}
+	}
+
+	// All pieces announced once turned off
+	tp.RevealPieces()
+	if msgs := tp.flush(); len(msgs) != 4 {
+		t.Errorf("Expected: 4 haves, Actual: %v", msgs)
+	}
+}
+
+func offers(peers []*Peer) [][]uint32 {
+	haves := make([][]uint32, len(peers))
+	for i, p := range peers {
+		for _, msg := range p.localQ.other {
+			haves[i] = append(haves[i], msg.(*HaveMessage).Index())
+		}
+		p.localQ.other = nil
+	}
+	return haves
+}
+
+func TestSuperSeeder(t *testing.T) {
+	pieceMap := NewPieceMap(4, _16KB, uint64(4 * _16KB))
+	for i := uint32(0); i < 4; i++ {
+		pieceMap.Piece(i).Verified()
+	}
+	pieceMap.Inc(0)
+	pieceMap.Inc(0)
+	peers := newTestChokePeers(3)
+	for _, p := range peers {
+		p.pieceMap = pieceMap
+		p.logger = log.New(ioutil.Discard, "", 0)
+		p.hidden = true
+	}
+	s := NewSuperSeeder()
+
+	// Each offered a different rare piece
+	s.Run(peers, pieceMap)
+	haves := offers(peers)
+	for i, want := range []uint32 { 1, 2, 3 } {
+		if len(haves[i]) != 1 || haves[i][0] != want {
+			t.Errorf("Peer %v - Expected: %v, Actual: %v", i, want, haves[i])
+		}
+	}
+
+	// Downloading it isn't enough...
+	peers[0].Have(1)
+	s.Run(peers, pieceMap)
+	if haves := offers(peers); len(haves[0]) != 0 {
+		t.Errorf("Offered before piece propagated: %v", haves[0])
+	}
+
+	// ...it must be seen elsewhere
+	peers[1].Have(1)
+	s.Run(peers, pieceMap)
+	if haves := offers(peers); len(haves[0]) != 1 || haves[0][0] != 0 || len(haves[1]) != 0 {
+		t.Errorf("Expected: 0 offered to peer 0 only, Actual: %v", haves)
+	}
+}
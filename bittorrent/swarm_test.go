@@ -0,0 +1,166 @@
+package bittorrent
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/g-dx/chimera/memnet"
+)
+
+// Reports each peer whose extended handshake is received
+type swarmWatcher struct {
+	peers chan string
+}
+
+func (sw * swarmWatcher) Name() string { return "chimera_test" }
+func (sw * swarmWatcher) OnMessage(p *Peer, payload []byte) error { return nil }
+
+func (sw * swarmWatcher) OnHandshake(p *Peer, hs *ExtendedHandshake) {
+	sw.peers <- string(p.id.id)
+}
+
+type swarmPeer struct {
+	pc *PeerCoordinator
+	id string
+	addr PeerAddress
+	watcher *swarmWatcher
+}
+
+func newTestMetaInfo() *MetaInfo {
+	return &MetaInfo {
+		PieceLength : 16 * 1024,
+		Hashes : make([][]byte, 4),
+		Files : []MetaInfoFile { { Name : "swarm", Length : 64 * 1024 } },
+		InfoHash : testInfoHash[:],
+	}
+}
+
+// Creates coordinators for size hosts (10.0.0.1, 10.0.0.2, ...) on the network
+func newTestSwarm(t *testing.T, n *memnet.Network, size int) []*swarmPeer {
+	mi := newTestMetaInfo()
+	peers := make([]*swarmPeer, size)
+	for i := range peers {
+		host := n.Host(fmt.Sprintf("10.0.0.%v", i + 1))
+		l, err := host.Listen(6881)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := NewPeerListenerOn(l, nil, EncryptionPreferred, 0, nil, nil)
+		t.Cleanup(pl.Close)
+
+		id := fmt.Sprintf("-CH0001-swarmpeer%03d", i)
+		sw := &swarmWatcher { make(chan string, size) }
+		pc, err := NewPeerCoordinator(mi, t.TempDir(), nil, Config {
+			PeerId : []byte(id),
+			Port : 6881,
+			Encryption : EncryptionPreferred,
+			Dialer : host,
+			Listener : pl,
+			Extensions : []ExtensionHandler { sw },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := PeerAddress { Id : id, Ip : host.IP(), Port : 6881, Source : SourceTracker }
+		peers[i] = &swarmPeer { pc, id, addr, sw }
+	}
+	t.Cleanup(n.Close) // before log directories are removed
+	return peers
+}
+
+// Asserts each peer completes handshakes with exactly the expected peers
+func assertSwarm(t *testing.T, peers []*swarmPeer, expected map[int][]int) {
+	for i, p := range peers {
+		var want []string
+		for _, j := range expected[i] {
+			want = append(want, peers[j].id)
+		}
+		sort.Strings(want)
+
+		var got []string
+		timeout := time.After(10 * time.Second)
+	wait:
+		for len(got) < len(want) {
+			select {
+			case id := <- p.watcher.peers:
+				got = append(got, id)
+			case <- timeout:
+				break wait
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v - Expected: %v, Actual: %v", p.addr.Ip, want, got)
+		}
+	}
+}
+
+func TestSwarmConnects(t *testing.T) {
+	n := memnet.New(1, memnet.Link { Latency : 5 * time.Millisecond, Bandwidth : 1 << 20, Loss : 0.01 })
+	peers := newTestSwarm(t, n, 8)
+
+	// Each peer dials those created before it
+	expected := make(map[int][]int)
+	for i, p := range peers {
+		var addrs []PeerAddress
+		for j := range peers {
+			if j < i {
+				addrs = append(addrs, peers[j].addr)
+			}
+			if j != i {
+				expected[i] = append(expected[i], j)
+			}
+		}
+		p.pc.AddPeers(addrs)
+	}
+	assertSwarm(t, peers, expected)
+}
+
+func TestSwarmRefused(t *testing.T) {
+	n := memnet.New(1, memnet.Link { Latency : 5 * time.Millisecond })
+	n.SetLink("10.0.0.1", "10.0.0.2", memnet.Link { Refuse : true })
+	peers := newTestSwarm(t, n, 3)
+
+	peers[1].pc.AddPeers([]PeerAddress { peers[0].addr })
+	peers[2].pc.AddPeers([]PeerAddress { peers[0].addr, peers[1].addr })
+	assertSwarm(t, peers, map[int][]int {
+		0 : { 2 },
+		1 : { 2 },
+		2 : { 0, 1 },
+	})
+}
+
+func TestSwarmCoordinatorClose(t *testing.T) {
+	n := memnet.New(1, memnet.Link { Latency : 5 * time.Millisecond })
+	peers := newTestSwarm(t, n, 2)
+	peers[1].pc.AddPeers([]PeerAddress { peers[0].addr })
+	assertSwarm(t, peers, map[int][]int { 0 : { 1 }, 1 : { 0 } })
+
+	// Callers never block once closed
+	peers[1].pc.Close()
+	peers[1].pc.Close()
+	added := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			peers[1].pc.AddPeers([]PeerAddress { peers[0].addr })
+			peers[1].pc.SetSuperSeeding(i % 2 == 0)
+		}
+		close(added)
+	}()
+	select {
+	case <- added:
+	case <- time.After(time.Second):
+		t.Fatal("AddPeers or SetSuperSeeding blocked after close")
+	}
+
+	// Remote sees the connection dropped
+	deadline := time.Now().Add(5 * time.Second)
+	for conns, _ := peers[0].pc.conns.Len(); conns != 0; conns, _ = peers[0].pc.conns.Len() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected: 0 connections, Actual: %v", conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
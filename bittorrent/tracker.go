@@ -6,8 +6,16 @@ import (
 	"github.com/g-dx/chimera/bencode"
 	"strconv"
 	"errors"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"fmt"
+	"time"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"runtime"
 )
 
 // Request & response dictionary keys
@@ -20,14 +28,21 @@ const (
 	interval    = "interval"
 	failure     = "failure"
 	left        = "left"
+	uploaded    = "uploaded"
+	downloaded  = "downloaded"
+	corrupt     = "corrupt"
 	peers       = "peers"
 )
 
 type TrackerRequest struct {
-	Url       string
-	InfoHash  []byte
-	NumWanted uint
-	Left      uint64 // Must be 64-bit for large files
+	Url        string
+	InfoHash   []byte
+	PeerId     []byte // nil = PeerId
+	NumWanted  uint
+	Uploaded   uint64 // payload bytes
+	Downloaded uint64 // payload bytes
+	Left       uint64 // Must be 64-bit for large files
+	Corrupt    uint64 // bytes discarded by failed hash checks
 }
 
 type TrackerResponse struct {
@@ -38,17 +53,184 @@ type TrackerResponse struct {
 type PeerAddress struct {
 	Id, Ip string
 	Port uint
+	Source PeerSource
 }
 
-func QueryTracker(req *TrackerRequest) (*TrackerResponse, error) {
+var (
+	DefaultTrackerTimeout = 30 * time.Second
+	DefaultUserAgent = "Chimera/0001"
 
-	// Build url & GET
-	resp, err := http.Get(buildUrl(req))
+	// Used by coordinators configured without a tracker client
+	DefaultTrackerClient = newDefaultTrackerClient()
+
+	errNoRootCAs = errors.New("No certificates found in root CA file")
+)
+
+// ----------------------------------------------------------------------------------
+// TrackerConfig - settings for contacting trackers
+// ----------------------------------------------------------------------------------
+
+type TrackerConfig struct {
+
+	// Maximum duration of a single tracker request (0 = DefaultTrackerTimeout)
+	Timeout time.Duration
+
+	// Proxy URL, supported schemes are http, https & socks5 (empty = no proxy)
+	Proxy string
+
+	// PEM encoded root CAs used in place of the system pool (optional)
+	RootCAFile string
+
+	// PEM encoded client certificate & key (optional)
+	CertFile, KeyFile string
+
+	// User-Agent header sent with every request (empty = DefaultUserAgent)
+	UserAgent string
+
+	// Extra headers & cookies, keyed by tracker host (i.e. "tracker.example.com:443").
+	// Hosts without a port match both the default HTTP & HTTPS ports.
+	Headers map[string]http.Header
+	Cookies map[string][]*http.Cookie
+}
+
+// ----------------------------------------------------------------------------------
+// TrackerClient - HTTP(S) client used to query trackers
+// ----------------------------------------------------------------------------------
+
+type TrackerClient struct {
+	client *http.Client
+	userAgent string
+	headers map[string]http.Header
+}
+
+func NewTrackerClient(cfg TrackerConfig) (*TrackerClient, error) {
+
+	// Build TLS config
+	tlsConfig := &tls.Config{}
+	if cfg.RootCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errNoRootCAs
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{ cert }
+	}
+
+	// Build transport
+	transport := &http.Transport{
+		Proxy : http.ProxyFromEnvironment,
+		TLSClientConfig : tlsConfig,
+		TLSHandshakeTimeout : 10 * time.Second,
+	}
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	// Add cookies for each tracker. Cookies are always stored against the root
+	// path so they are sent with every announce & scrape.
+	jar, _ := cookiejar.New(nil) // Never returns an error
+	for host, cookies := range cfg.Cookies {
+		jar.SetCookies(&url.URL{ Scheme : "http", Host : host, Path : "/" }, cookies)
+		jar.SetCookies(&url.URL{ Scheme : "https", Host : host, Path : "/" }, cookies)
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTrackerTimeout
+	}
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+
+	// Key headers as they are looked up
+	headers := make(map[string]http.Header, len(cfg.Headers))
+	for host, h := range cfg.Headers {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			headers[strings.ToLower(host)] = h
+			continue
+		}
+		for _, port := range []string { "80", "443" } {
+			headers[net.JoinHostPort(strings.ToLower(host), port)] = h
+		}
+	}
+
+	return &TrackerClient{
+		client : &http.Client{ Transport : transport, Jar : jar, Timeout : timeout },
+		userAgent : userAgent,
+		headers : headers,
+	}, nil
+}
+
+// The default config reads no files so never fails
+func newDefaultTrackerClient() *TrackerClient {
+	tc, err := NewTrackerClient(TrackerConfig{})
+	if err != nil {
+		panic(err)
+	}
+	return tc
+}
+
+// Returns host:port of a tracker URL, adding the default port for the scheme if missing
+func trackerHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+func (tc *TrackerClient) Query(ctx context.Context, req *TrackerRequest) (tr *TrackerResponse, err error) {
+
+	// Build request
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", buildUrl(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range tc.headers[trackerHost(httpReq.URL)] {
+		for _, v := range vs {
+			httpReq.Header.Add(k, v)
+		}
+	}
+	httpReq.Header.Set("User-Agent", tc.userAgent)
+
+	// GET
+	resp, err := tc.client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	// Recover from any missing or malformed keys & return error
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
 	// Parse response
 	bdata, err := bencode.DecodeAsDict(resp.Body)
 	if err != nil {
@@ -64,10 +246,9 @@ func QueryTracker(req *TrackerRequest) (*TrackerResponse, error) {
 	// Parse response
 	return &TrackerResponse{
 		Interval       : uint(i(bdata, interval)),
-		MinInterval    : uint(i(bdata, minInterval)),
+		MinInterval    : uint(optI(bdata, minInterval)),
 		PeerAddresses  : toPeerAddresses(bdata[peers]),
 	}, nil
-
 }
 
 func buildUrl(req *TrackerRequest) string {
@@ -78,7 +259,13 @@ func buildUrl(req *TrackerRequest) string {
 	params[infoHash] = string(req.InfoHash)
 	params[numWanted] = strconv.FormatUint(uint64(req.NumWanted), 10)
 	params[peerId] = string(PeerId)
+	if req.PeerId != nil {
+		params[peerId] = string(req.PeerId)
+	}
+	params[uploaded] = strconv.FormatUint(req.Uploaded, 10)
+	params[downloaded] = strconv.FormatUint(req.Downloaded, 10)
 	params[left] = strconv.FormatUint(req.Left, 10)
+	params[corrupt] = strconv.FormatUint(req.Corrupt, 10)
 
 	// Join params
 	pairs := make([]string, 0, len(params))
@@ -108,6 +295,7 @@ func toPeerAddresses(v interface {}) []PeerAddress {
 					Id : "unknown",
 					Ip : fmt.Sprintf("%d.%d.%d.%d", buf[0], buf[1], buf[2], buf[3]),
 					Port : (uint(buf[4]) << 8 & 0xFF00) + uint(buf[5]),
+					Source : SourceTracker,
 				})
 		}
 
@@ -120,6 +308,7 @@ func toPeerAddresses(v interface {}) []PeerAddress {
 					Id : bs(dict, "peer id"),
 					Ip : bs(dict, "ip"),
 					Port: uint(i(dict, "port")),
+					Source : SourceTracker,
 				})
 		}
 	default:
@@ -130,5 +319,9 @@ func toPeerAddresses(v interface {}) []PeerAddress {
 }
 
 func (pa PeerAddress) GetIpAndPort() string {
-	return fmt.Sprintf("%v:%d", pa.Ip, pa.Port)
+	return net.JoinHostPort(pa.Ip, strconv.FormatUint(uint64(pa.Port), 10))
+}
+
+func (pa PeerAddress) String() string {
+	return fmt.Sprintf("%v (%v)", pa.GetIpAndPort(), pa.Source)
 }
@@ -0,0 +1,194 @@
+package bittorrent
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTrackerResponse = "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"
+
+func testTrackerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(testTrackerResponse))
+}
+
+func queryTestTracker(t *testing.T, cfg TrackerConfig, url string) (*TrackerResponse, error) {
+	tc, err := NewTrackerClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc.Query(context.Background(), &TrackerRequest { Url : url, InfoHash : testInfoHash[:] })
+}
+
+func assertTestTrackerResponse(t *testing.T, tr *TrackerResponse, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Interval != 1800 || len(tr.PeerAddresses) != 1 || tr.PeerAddresses[0].GetIpAndPort() != "10.0.0.1:6881" {
+		t.Errorf("Unexpected response: %+v", tr)
+	}
+}
+
+func TestTrackerTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(testTrackerHandler))
+	defer ts.Close()
+
+	// Unknown CA
+	if _, err := queryTestTracker(t, TrackerConfig{}, ts.URL + "/announce"); err == nil {
+		t.Error("Expected certificate error")
+	}
+
+	// Trusted CA
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block { Type : "CERTIFICATE", Bytes : ts.Certificate().Raw }
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := queryTestTracker(t, TrackerConfig { RootCAFile : ca }, ts.URL + "/announce")
+	assertTestTrackerResponse(t, tr, err)
+
+	// No certificates in file
+	if err := ioutil.WriteFile(ca, []byte("none"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTrackerClient(TrackerConfig { RootCAFile : ca }); err != errNoRootCAs {
+		t.Errorf("Expected: %v, Actual: %v", errNoRootCAs, err)
+	}
+}
+
+func TestTrackerProxy(t *testing.T) {
+	hosts := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.URL.Host
+		testTrackerHandler(w, r)
+	}))
+	defer proxy.Close()
+
+	tr, err := queryTestTracker(t, TrackerConfig { Proxy : proxy.URL }, "http://tracker.invalid/announce")
+	assertTestTrackerResponse(t, tr, err)
+	if host := <- hosts; host != "tracker.invalid" {
+		t.Errorf("Expected: tracker.invalid, Actual: %v", host)
+	}
+}
+
+func TestTrackerHeadersAndCookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		switch {
+		case r.Header.Get("X-Api-Key") != "secret": http.Error(w, "missing header", http.StatusForbidden)
+		case r.Header.Get("User-Agent") != "test/1": http.Error(w, "wrong user agent", http.StatusForbidden)
+		case err != nil || c.Value != "abc": http.Error(w, "missing cookie", http.StatusForbidden)
+		default: testTrackerHandler(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	tr, err := queryTestTracker(t, TrackerConfig {
+		UserAgent : "test/1",
+		Headers : map[string]http.Header { u.Host : { "X-Api-Key" : { "secret" } } },
+		Cookies : map[string][]*http.Cookie { u.Host : { { Name : "session", Value : "abc" } } },
+	}, ts.URL + "/announce")
+	assertTestTrackerResponse(t, tr, err)
+}
+
+func TestTrackerHeadersDefaultPorts(t *testing.T) {
+	tc, err := NewTrackerClient(TrackerConfig {
+		Headers : map[string]http.Header {
+			"Tracker.Example.com" : { "X-Any" : { "1" } },
+			"other.example.com:8080" : { "X-Other" : { "1" } },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url, host, header string
+	} {
+		{ "https://tracker.example.com/announce", "tracker.example.com:443", "X-Any" },
+		{ "http://TRACKER.example.com/announce", "tracker.example.com:80", "X-Any" },
+		{ "http://tracker.example.com:443/announce", "tracker.example.com:443", "X-Any" },
+		{ "http://other.example.com:8080/announce", "other.example.com:8080", "X-Other" },
+		{ "http://other.example.com/announce", "other.example.com:80", "" },
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		host := trackerHost(u)
+		if host != test.host {
+			t.Errorf("%v - Expected: %v, Actual: %v", test.url, test.host, host)
+		}
+		h := tc.headers[host]
+		if (test.header == "") != (h == nil) || (h != nil && h.Get(test.header) != "1") {
+			t.Errorf("%v - Expected: %v, Actual: %v", test.url, test.header, h)
+		}
+	}
+}
+
+func TestTrackerContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <- r.Context().Done():
+		case <- release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tc, err := NewTrackerClient(TrackerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50 * time.Millisecond, cancel)
+	_, err = tc.Query(ctx, &TrackerRequest { Url : ts.URL + "/announce", InfoHash : testInfoHash[:] })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected: %v, Actual: %v", context.Canceled, err)
+	}
+}
+
+func TestCoordinatorAnnounce(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("User-Agent") != "test/1": http.Error(w, "wrong user agent", http.StatusForbidden)
+		case r.URL.Query().Get(left) != "65536": http.Error(w, "wrong left", http.StatusBadRequest)
+		case r.URL.Query().Get(peerId) != string(localPeerId): http.Error(w, "wrong peer id", http.StatusBadRequest)
+		case r.URL.Path == "/hung":
+			select {
+			case <- r.Context().Done():
+			case <- release:
+			}
+		default: testTrackerHandler(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tc, err := NewTrackerClient(TrackerConfig { UserAgent : "test/1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := NewPeerCoordinator(newTestMetaInfo(), t.TempDir(), nil, Config { PeerId : localPeerId, Tracker : tc })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Configured client & peer id are used
+	tr, err := pc.Announce(ts.URL + "/announce", 50)
+	assertTestTrackerResponse(t, tr, err)
+
+	// Closing gives up on a hung tracker
+	time.AfterFunc(50 * time.Millisecond, pc.Close)
+	if _, err := pc.Announce(ts.URL + "/hung", 50); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected: %v, Actual: %v", context.Canceled, err)
+	}
+}
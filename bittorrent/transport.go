@@ -0,0 +1,55 @@
+package bittorrent
+
+import (
+	"net"
+	"time"
+
+	"github.com/g-dx/chimera/utp"
+)
+
+// ----------------------------------------------------------------------------------
+// Dialer & Listener - the transport peer connections are made over. Allows peers to
+// be connected through a proxy, over uTP or over an in-memory network when testing.
+// ----------------------------------------------------------------------------------
+
+type Dialer interface {
+	DialTimeout(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// Satisfied by net.Listener
+type Listener interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// Returns a dialer which connects through the proxy if given, otherwise over uTP if
+// a socket is given & the remote supports it, otherwise TCP
+func NewDialer(us *utp.Socket, proxy *Proxy) Dialer {
+	switch {
+	case proxy != nil:
+		return proxy // uTP can't be proxied
+	case us != nil:
+		return utpDialer { us }
+	default:
+		return tcpDialer {}
+	}
+}
+
+type tcpDialer struct {}
+
+func (tcpDialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Falls back to TCP if the remote doesn't respond over uTP
+type utpDialer struct {
+	us *utp.Socket
+}
+
+func (d utpDialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if conn, err := d.us.DialTimeout(addr, min(timeout, UTP_DIAL_TIMEOUT)); err == nil {
+		return conn, nil
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
@@ -0,0 +1,139 @@
+package bittorrent
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	MAX_HASH_FAILURES = 3 // failed pieces a peer may contribute to before being banned
+
+	errBanned = errors.New("Banned for sending corrupt data")
+)
+
+// ----------------------------------------------------------------------------------
+// Piece verification - every piece is SHA-1 checked once all its blocks are written.
+// Pieces which fail are downloaded again & peers which repeatedly contribute to
+// failed pieces are banned.
+//
+// Smart ban - the hash of each block received is kept for failed pieces. Once the
+// piece is downloaded again & passes, blocks which differ from the good data identify
+// exactly which peers sent corrupt data. They are banned & the others forgiven.
+// ----------------------------------------------------------------------------------
+
+// Returns the number of bytes discarded by failed hash checks, to be reported to
+// trackers as corrupt
+func (pc * PeerCoordinator) Corrupt() uint64 {
+	return atomic.LoadUint64(&pc.corrupt)
+}
+
+// Checks pieces already on disk so they are not downloaded again. Pieces only in newly
+// created files are skipped.
+func (pc * PeerCoordinator) verifyExisting(da *DiskAccess) {
+	for i := uint32(0); i < uint32(len(pc.metaInfo.Hashes)); i++ {
+		if da.Existed(i) {
+			pc.disk <- DiskVerify(i, PeerIdentity{})
+		}
+	}
+}
+
+func (pc * PeerCoordinator) onBlockWritten(dwr *DiskWriteResult) {
+	piece := pc.pieceMap.Piece(dwr.index)
+	piece.BlockDone(dwr.begin, BlockSource { dwr.begin, dwr.id.address, dwr.hash })
+	if piece.IsDownloaded() {
+		msg := DiskVerify(dwr.index, dwr.id)
+		go func() { pc.disk <- msg }() // disk may be waiting to send us results
+	}
+}
+
+func (pc * PeerCoordinator) onPieceVerified(dvr *DiskVerifyResult) {
+	piece := pc.pieceMap.Piece(dvr.index)
+	switch {
+
+	// Downloaded or found on disk, tell everyone we have it, unless super seeding them
+	case dvr.ok && !piece.IsComplete():
+		piece.Verified()
+		for _, p := range pc.peers {
+			if !p.hidden {
+				p.localQ.Add(Have(dvr.index))
+			}
+		}
+		pc.smartBan(dvr)
+
+	// Download failed, existing data which fails is simply downloaded
+	case !dvr.ok && piece.IsDownloaded():
+		pc.logger.Printf("Piece %v failed hash check\n", dvr.index)
+		atomic.AddUint64(&pc.corrupt, uint64(piece.Length()))
+		sources := piece.Reset()
+		pc.failed[dvr.index] = append(pc.failed[dvr.index], sources...)
+		for _, addr := range contributors(sources) {
+			pc.onHashFailure(addr)
+		}
+	}
+}
+
+// Records a failed piece against the peer at addr, banning it if a repeat offender
+func (pc * PeerCoordinator) onHashFailure(addr string) {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if pc.hashFailures[ip]++; pc.hashFailures[ip] >= MAX_HASH_FAILURES {
+		pc.ban(ip)
+	}
+}
+
+// Compares blocks of earlier failed attempts at a piece with the good data. Peers
+// which sent differing blocks are banned, the others had nothing to do with the failure.
+func (pc * PeerCoordinator) smartBan(dvr *DiskVerifyResult) {
+	sources, ok := pc.failed[dvr.index]
+	if !ok {
+		return
+	}
+	delete(pc.failed, dvr.index)
+
+	bad := make(map[string]bool)
+	for _, src := range sources {
+		if src.hash != dvr.hashes[src.begin/_16KB] {
+			bad[src.from] = true
+		}
+	}
+	for _, addr := range contributors(sources) {
+		ip, _, err := net.SplitHostPort(addr)
+		switch {
+		case err != nil:
+		case bad[addr]:
+			pc.ban(ip)
+		case pc.hashFailures[ip] > 0:
+			pc.hashFailures[ip]--
+		}
+	}
+}
+
+// Disconnects & never again connects to any peer at the IP
+func (pc * PeerCoordinator) ban(ip string) {
+	if pc.banned[ip] {
+		return
+	}
+	pc.logger.Printf("Banning [%v]: %v\n", ip, errBanned)
+	pc.banned[ip] = true
+	for _, p := range pc.peers {
+		if host, _, err := net.SplitHostPort(p.id.address); err == nil && host == ip {
+			p.Close(errBanned)
+		}
+	}
+}
+
+// Returns the distinct addresses blocks came from
+func contributors(sources []BlockSource) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, src := range sources {
+		if !seen[src.from] {
+			seen[src.from] = true
+			addrs = append(addrs, src.from)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,158 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskVerify(t *testing.T) {
+	data := make([]byte, 3 * _16KB)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	good := sha1.Sum(data[:2 * _16KB])
+	last := sha1.Sum(data[2 * _16KB:])
+	mi := &MetaInfo {
+		PieceLength : 2 * _16KB,
+		Hashes : [][]byte { good[:], last[:] },
+		Files : []MetaInfoFile { { Name : "a", Length : uint64(len(data)) } },
+	}
+	in := make(chan DiskMessage)
+	out := make(chan DiskMessageResult)
+	if _, err := NewDiskAccess(mi, in, out, t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for begin := uint32(0); begin < uint32(len(data)); begin += _16KB {
+		in <- DiskWrite(Block(begin / (2 * _16KB), begin % (2 * _16KB), data[begin:begin+_16KB]), PeerIdentity{})
+		diskResult(t, out)
+	}
+
+	// Last piece is shorter
+	for i := uint32(0); i < 2; i++ {
+		in <- DiskVerify(i, PeerIdentity{})
+		if res, ok := diskResult(t, out).(*DiskVerifyResult); !ok || !res.ok || res.index != i {
+			t.Errorf("Piece %v - Expected: verified, Actual: %v", i, res)
+		} else if off := i * 2 * _16KB; res.hashes[0] != sha1.Sum(data[off:off+_16KB]) {
+			t.Errorf("Piece %v - Unexpected block hashes: %x", i, res.hashes)
+		}
+	}
+
+	// Corrupt block
+	in <- DiskWrite(Block(0, _16KB, make([]byte, _16KB)), PeerIdentity{})
+	diskResult(t, out)
+	in <- DiskVerify(0, PeerIdentity{})
+	if res, ok := diskResult(t, out).(*DiskVerifyResult); !ok || res.ok {
+		t.Errorf("Expected: hash failure, Actual: %v", res)
+	}
+}
+
+func newTestVerifyCoordinator() *PeerCoordinator {
+	mi := &MetaInfo { PieceLength : 2 * _16KB, Hashes : make([][]byte, 2) }
+	mi.Files = []MetaInfoFile { { Length : 4 * uint64(_16KB) } }
+	return &PeerCoordinator {
+		metaInfo : mi,
+		pieceMap : NewPieceMap(2, mi.PieceLength, mi.TotalLength()),
+		logger : log.New(ioutil.Discard, "", 0),
+		disk : make(chan DiskMessage, 10),
+		hashFailures : make(map[string]int),
+		banned : make(map[string]bool),
+		failed : make(map[uint32][]BlockSource),
+	}
+}
+
+// Writes both blocks of piece 0, from a & b, & returns the verify request
+func writeTestPiece(t *testing.T, pc *PeerCoordinator, a, b string) *DiskVerifyMessage {
+	return writeTestBlocks(t, pc, a, testBlockHash(0), b, testBlockHash(1))
+}
+
+func testBlockHash(n byte) [sha1.Size]byte {
+	return sha1.Sum([]byte { n })
+}
+
+func writeTestBlocks(t *testing.T, pc *PeerCoordinator, a string, ah [sha1.Size]byte,
+	b string, bh [sha1.Size]byte) *DiskVerifyMessage {
+	pc.onDiskMessageResult(&DiskWriteResult { PeerIdentity { address : a }, 0, 0, _16KB, ah })
+	pc.onDiskMessageResult(&DiskWriteResult { PeerIdentity { address : b }, 0, _16KB, _16KB, bh })
+	if !pc.pieceMap.Piece(0).IsDownloaded() {
+		t.Fatal("Piece not awaiting verification")
+	}
+	return (<- pc.disk).(*DiskVerifyMessage)
+}
+
+func TestPieceVerified(t *testing.T) {
+	pc := newTestVerifyCoordinator()
+	msg := writeTestPiece(t, pc, "10.0.0.1:6881", "10.0.0.2:6881")
+	pc.onDiskMessageResult(&DiskVerifyResult { msg.id, msg.index, true, nil })
+	if !pc.pieceMap.Piece(0).IsComplete() || pc.Corrupt() != 0 {
+		t.Errorf("Expected: complete, Actual: %v, %v corrupt", pc.pieceMap.Piece(0).state, pc.Corrupt())
+	}
+}
+
+func TestPieceHashFailure(t *testing.T) {
+	pc := newTestVerifyCoordinator()
+	for i := 1; i <= MAX_HASH_FAILURES; i++ {
+		msg := writeTestPiece(t, pc, "10.0.0.1:6881", "10.0.0.2:6882")
+		pc.onDiskMessageResult(&DiskVerifyResult { msg.id, msg.index, false, nil })
+
+		// Downloaded again & counted as corrupt
+		piece := pc.pieceMap.Piece(0)
+		if !piece.BlocksNeeded() || len(piece.TakeBlocks(2)) != 2 {
+			t.Fatalf("Expected: all blocks needed, Actual: %v", piece.blocks)
+		}
+		if pc.Corrupt() != uint64(i) * uint64(2 * _16KB) {
+			t.Errorf("Expected: %v corrupt, Actual: %v", uint64(i) * uint64(2 * _16KB), pc.Corrupt())
+		}
+		pc.pieceMap.ReturnBlocks([]*RequestMessage { Request(0, 0, _16KB), Request(0, _16KB, _16KB) })
+
+		banned := i == MAX_HASH_FAILURES
+		if pc.banned["10.0.0.1"] != banned || pc.banned["10.0.0.2"] != banned {
+			t.Errorf("Failure %v - Expected banned: %v, Actual: %v", i, banned, pc.banned)
+		}
+	}
+
+	// Failures on existing data are not held against anyone
+	pc.onDiskMessageResult(&DiskVerifyResult { PeerIdentity{}, 1, false, nil })
+	if pc.Corrupt() != uint64(MAX_HASH_FAILURES) * uint64(2 * _16KB) {
+		t.Errorf("Unexpected corrupt count: %v", pc.Corrupt())
+	}
+
+	// Reported to trackers
+	pc.updateStatistics(time.Now())
+	req := &TrackerRequest { Url : "http://tracker.example.com/announce" }
+	pc.Statistics().Announce(req)
+	corrupt := fmt.Sprintf("corrupt=%v", pc.Corrupt())
+	if req.Corrupt != pc.Corrupt() || !strings.Contains(buildUrl(req), corrupt) {
+		t.Errorf("Expected: %v, Actual: %v", corrupt, buildUrl(req))
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	pc := newTestVerifyCoordinator()
+	good := [][sha1.Size]byte { testBlockHash(0), testBlockHash(1) }
+
+	// Fails, a having sent a corrupt first block
+	msg := writeTestBlocks(t, pc, "10.0.0.1:6881", testBlockHash(2), "10.0.0.2:6881", good[1])
+	pc.onDiskMessageResult(&DiskVerifyResult { msg.id, msg.index, false, nil })
+	if len(pc.banned) != 0 || pc.hashFailures["10.0.0.1"] != 1 || pc.hashFailures["10.0.0.2"] != 1 {
+		t.Fatalf("Expected: both suspected, Actual: %v, %v", pc.hashFailures, pc.banned)
+	}
+	pc.pieceMap.Piece(0).TakeBlocks(2)
+
+	// Passes once downloaded from b & c, so only a is banned
+	msg = writeTestBlocks(t, pc, "10.0.0.2:6881", good[0], "10.0.0.3:6881", good[1])
+	pc.onDiskMessageResult(&DiskVerifyResult { msg.id, msg.index, true, good })
+	if !pc.banned["10.0.0.1"] || pc.banned["10.0.0.2"] || pc.banned["10.0.0.3"] {
+		t.Errorf("Expected: 10.0.0.1 banned, Actual: %v", pc.banned)
+	}
+	if pc.hashFailures["10.0.0.2"] != 0 {
+		t.Errorf("Expected: 10.0.0.2 forgiven, Actual: %v", pc.hashFailures)
+	}
+	if _, ok := pc.failed[0]; ok {
+		t.Error("Failed blocks kept after piece passed")
+	}
+}
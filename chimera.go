@@ -44,24 +44,6 @@ func main() {
 //	_, err = json.MarshalIndent(metaInfo, "", " ")
 //	fmt.Printf("Decoded Data:\n%v\n", metaInfo)
 
-	// Create request
-	req := &bittorrent.TrackerRequest{
-		Url : metaInfo.Announce,
-		InfoHash : metaInfo.InfoHash,
-		NumWanted : 50,
-		Left : metaInfo.TotalLength(),
-	}
-
-//	reqJson, err := json.MarshalIndent(req, "", " ")
-//	fmt.Printf("Params:%v\n", reqJson)
-
-	_, err = bittorrent.QueryTracker(req)
-	if err != nil {
-		fmt.Println("Error: ", err)
-		return
-	}
-	fmt.Printf("Tracker Respose: %+v\n ")
-
 	// Create log directory
 	dir := fmt.Sprintf("/Users/Dakeyras/.chimera/%v [...%x]",
 		               time.Now().Format("2006-01-02 15.04.05"),
@@ -71,22 +53,26 @@ func main() {
 		fmt.Printf("Failed to create torrent dir: %v\n", err)
 	}
 
-//	tr := make(chan *bittorrent.TrackerResponse)
-//	pc, err := bittorrent.NewPeerCoordinator(metaInfo, dir, tr)
-//	if err != nil {
-//		fmt.Printf("Failed to create coordinator: %v\n", err)
-//		return
-//	}
-//
-//	// Send tracker response
-//	tr <- resp
-//
-//	// Wait until everything is finished
-//	pc.AwaitDone()
+	tr := make(chan *bittorrent.TrackerResponse, 1)
+	pc, err := bittorrent.NewPeerCoordinator(metaInfo, dir, tr, bittorrent.Config{})
+	if err != nil {
+		fmt.Printf("Failed to create coordinator: %v\n", err)
+		return
+	}
 
-//	fmt.Printf("No of CPUs: %v\n", runtime.NumCPU())
+	// Announce, reporting transferred, left & corrupt bytes
+	resp, err := pc.Announce(metaInfo.Announce, 50)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return
+	}
+	fmt.Printf("Tracker Respose: %+v\n", resp)
+
+	// Send tracker response
+	tr <- resp
 
-	dIn := make(chan bittorrent.DiskMessage)
-	dOut := make(chan bittorrent.DiskMessageResult)
-	_, err = bittorrent.NewDiskAccess(metaInfo, dIn, dOut, dir, nil)
+	// Wait until everything is finished
+	pc.AwaitDone()
+
+//	fmt.Printf("No of CPUs: %v\n", runtime.NumCPU())
 }
@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const swarmSize = 16
+
+func newTestNode(t *testing.T, stateFile string) *Node {
+	n, err := NewNode(Config {
+		Addr : "127.0.0.1:0",
+		StateFile : stateFile,
+		QueryTimeout : 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func newTestSwarm(t *testing.T) []*Node {
+	nodes := make([]*Node, swarmSize)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, "")
+		t.Cleanup(func() { nodes[i].Close() })
+	}
+	for _, n := range nodes[1:] {
+		n.Bootstrap([]string { nodes[0].Addr().String() })
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newTestSwarm(t)
+	for i, n := range nodes {
+		if n.Len() == 0 {
+			t.Errorf("Node %v has an empty routing table", i)
+		}
+	}
+	if nodes[0].Len() < K {
+		t.Errorf("Bootstrap node knows %v nodes, expected at least %v", nodes[0].Len(), K)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestSwarm(t)
+	infoHash := sha1.Sum([]byte("chimera"))
+
+	if _, err := nodes[3].Announce(infoHash[:], 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[swarmSize-1].GetPeers(infoHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if p.IP.IsLoopback() && p.Port == 6881 {
+			return
+		}
+	}
+	t.Errorf("Announced peer not found, got: %v", peers)
+}
+
+func TestGetPeersInvalidInfoHash(t *testing.T) {
+	n := newTestNode(t, "")
+	defer n.Close()
+	if _, err := n.GetPeers([]byte("short")); err != errInvalidInfoHash {
+		t.Errorf("Expected: %v, Actual: %v", errInvalidInfoHash, err)
+	}
+}
+
+func TestStatePersisted(t *testing.T) {
+	nodes := newTestSwarm(t)
+	stateFile := filepath.Join(t.TempDir(), "dht.dat")
+
+	n := newTestNode(t, stateFile)
+	n.Bootstrap([]string { nodes[0].Addr().String() })
+	id, size := n.Id(), n.Len()
+	if size == 0 {
+		t.Fatal("Routing table is empty")
+	}
+	n.Close()
+
+	restored := newTestNode(t, stateFile)
+	defer restored.Close()
+	if restored.Id() != id {
+		t.Errorf("Expected id: %v, Actual: %v", id, restored.Id())
+	}
+	if restored.Len() != size {
+		t.Errorf("Expected %v nodes, Actual: %v", size, restored.Len())
+	}
+}
+
+func TestTokens(t *testing.T) {
+	nodes := newTestSwarm(t)
+	tm := nodes[0].tokens
+	ip := nodes[1].Addr().IP
+
+	token := tm.token(ip)
+	tm.rotate()
+	if !tm.valid(token, ip) {
+		t.Error("Token from previous secret rejected")
+	}
+	tm.rotate()
+	if tm.valid(token, ip) {
+		t.Error("Expired token accepted")
+	}
+}
+
+func TestRandomIdInBucket(t *testing.T) {
+	self := NewNodeId()
+	for i := 0; i < numBuckets; i++ {
+		if n := self.CommonPrefixLen(randomIdInBucket(self, i)); n != i {
+			t.Errorf("Expected prefix length: %v, Actual: %v", i, n)
+		}
+	}
+}
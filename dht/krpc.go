@@ -0,0 +1,185 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"github.com/g-dx/chimera/bencode"
+)
+
+// KRPC message keys & values
+const (
+	keyTransaction = "t"
+	keyType        = "y"
+	keyQuery       = "q"
+	keyArgs        = "a"
+	keyResponse    = "r"
+	keyError       = "e"
+
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+
+	keyId          = "id"
+	keyTarget      = "target"
+	keyInfoHash    = "info_hash"
+	keyToken       = "token"
+	keyNodes       = "nodes"
+	keyValues      = "values"
+	keyPort        = "port"
+	keyImpliedPort = "implied_port"
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+const (
+	compactNodeLength = idLength + 6
+	compactPeerLength = 6
+)
+
+var (
+	errMalformedMessage = errors.New("Malformed KRPC message")
+)
+
+// A decoded KRPC message
+type message map[string]interface{}
+
+func decodeMessage(buf []byte) (message, error) {
+	dict, err := bencode.DecodeAsDict(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	m := message(dict)
+	if _, ok := m.str(keyTransaction); !ok {
+		return nil, errMalformedMessage
+	}
+	if _, ok := m.str(keyType); !ok {
+		return nil, errMalformedMessage
+	}
+	return m, nil
+}
+
+func (m message) str(key string) (string, bool) {
+	v, ok := m[key].(string)
+	return v, ok
+}
+
+func (m message) integer(key string) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+func (m message) dict(key string) (message, bool) {
+	v, ok := m[key].(map[string]interface{})
+	return message(v), ok
+}
+
+func (m message) list(key string) ([]interface{}, bool) {
+	v, ok := m[key].([]interface{})
+	return v, ok
+}
+
+func (m message) id(key string) (NodeId, bool) {
+	s, ok := m.str(key)
+	if !ok {
+		return NodeId{}, false
+	}
+	return NodeIdFrom(s)
+}
+
+// Returns a description of a KRPC error message
+func (m message) err() error {
+	e, ok := m.list(keyError)
+	if !ok || len(e) != 2 {
+		return errMalformedMessage
+	}
+	return fmt.Errorf("KRPC error %v: %v", e[0], e[1])
+}
+
+func newQuery(tx, method string, args map[string]interface{}) map[string]interface{} {
+	return map[string]interface{} {
+		keyTransaction : tx,
+		keyType        : typeQuery,
+		keyQuery       : method,
+		keyArgs        : args,
+	}
+}
+
+func newResponse(tx string, values map[string]interface{}) map[string]interface{} {
+	return map[string]interface{} {
+		keyTransaction : tx,
+		keyType        : typeResponse,
+		keyResponse    : values,
+	}
+}
+
+func newError(tx string, code int, msg string) map[string]interface{} {
+	return map[string]interface{} {
+		keyTransaction : tx,
+		keyType        : typeError,
+		keyError       : []interface{} { code, msg },
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////
+// Compact node info: <id><ip><port> & compact peer info: <ip><port>
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+func encodeNodes(contacts []contact) string {
+	buf := make([]byte, 0, len(contacts) * compactNodeLength)
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, c.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(c.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(s string) []contact {
+	contacts := make([]contact, 0, len(s) / compactNodeLength)
+	for buf := []byte(s); len(buf) >= compactNodeLength; buf = buf[compactNodeLength:] {
+		var c contact
+		copy(c.id[:], buf)
+		c.addr = &net.UDPAddr {
+			IP : net.IPv4(buf[20], buf[21], buf[22], buf[23]),
+			Port : int(binary.BigEndian.Uint16(buf[24:26])),
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts
+}
+
+func encodePeer(ip net.IP, port int) (string, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return "", false
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port))), true
+}
+
+func decodePeer(s string) (*net.TCPAddr, bool) {
+	if len(s) != compactPeerLength {
+		return nil, false
+	}
+	return &net.TCPAddr {
+		IP : net.IPv4(s[0], s[1], s[2], s[3]),
+		Port : int(s[4]) << 8 | int(s[5]),
+	}, true
+}
@@ -0,0 +1,601 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"github.com/g-dx/chimera/bencode"
+)
+
+var (
+	DefaultBootstrap = []string {
+		"router.bittorrent.com:6881",
+		"router.utorrent.com:6881",
+		"dht.transmissionbt.com:6881",
+	}
+	DefaultQueryTimeout = 5 * time.Second
+	MaintenancePeriod = 1 * time.Minute
+
+	errClosed = errors.New("DHT node closed")
+	errTimeout = errors.New("DHT query timed out")
+	errInvalidInfoHash = errors.New("Invalid info_hash length")
+)
+
+const (
+	alpha = 3 // concurrent queries per lookup round
+	maxLookupRounds = 20
+	stateId = "id"
+	stateNodes = "nodes"
+)
+
+// ----------------------------------------------------------------------------------
+// Config - DHT node settings
+// ----------------------------------------------------------------------------------
+
+type Config struct {
+
+	// UDP address to listen on, i.e. ":6881"
+	Addr string
+
+	// Nodes (host:port) used to join the DHT, i.e. DefaultBootstrap (optional)
+	Bootstrap []string
+
+	// File used to persist our id & routing table across restarts (optional)
+	StateFile string
+
+	// Duration to wait for a query response (0 = DefaultQueryTimeout)
+	QueryTimeout time.Duration
+
+	Logger *log.Logger
+}
+
+// ----------------------------------------------------------------------------------
+// Node - a mainline DHT (BEP 5) node
+// ----------------------------------------------------------------------------------
+
+type transaction struct {
+	addr *net.UDPAddr
+	c chan message
+}
+
+type Node struct {
+	id NodeId
+	conn *net.UDPConn
+	table *RoutingTable
+	tokens *tokenManager
+	store *peerStore
+	timeout time.Duration
+	stateFile string
+	logger *log.Logger
+
+	// Outstanding queries & nodes currently being checked for liveness
+	mu sync.Mutex
+	txs map[string]*transaction
+	nextTx uint16
+	checking map[NodeId]bool
+
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+func NewNode(cfg Config) (*Node, error) {
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	timeout := cfg.QueryTimeout
+	if timeout == 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	// Restore previous id & routing table if available
+	id := NewNodeId()
+	var saved []contact
+	if cfg.StateFile != "" {
+		stateId, contacts, err := loadState(cfg.StateFile)
+		if err == nil {
+			id, saved = stateId, contacts
+		} else if !os.IsNotExist(err) {
+			logger.Printf("Failed to load DHT state: %v\n", err)
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node {
+		id : id,
+		conn : conn,
+		table : NewRoutingTable(id),
+		tokens : newTokenManager(),
+		store : newPeerStore(),
+		timeout : timeout,
+		stateFile : cfg.StateFile,
+		logger : logger,
+		txs : make(map[string]*transaction),
+		checking : make(map[NodeId]bool),
+		done : make(chan struct{}),
+	}
+
+	// Saved nodes are questionable until they respond
+	for _, c := range saved {
+		n.table.add(c.id, c.addr, time.Time{})
+	}
+
+	go n.readLoop()
+	go n.maintenanceLoop()
+	if len(cfg.Bootstrap) > 0 {
+		go n.Bootstrap(cfg.Bootstrap)
+	}
+	return n, nil
+}
+
+func (n * Node) Id() NodeId {
+	return n.id
+}
+
+func (n * Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Returns the number of nodes in the routing table
+func (n * Node) Len() int {
+	return n.table.Len()
+}
+
+func (n * Node) Close() error {
+	err := errClosed
+	n.closeOnce.Do(func() {
+		close(n.done)
+		if n.stateFile != "" {
+			if err := n.Save(n.stateFile); err != nil {
+				n.logger.Printf("Failed to save DHT state: %v\n", err)
+			}
+		}
+		err = n.conn.Close()
+	})
+	return err
+}
+
+// Populates the routing table from the given nodes (host:port) & then searches for
+// nodes close to our own id.
+func (n * Node) Bootstrap(addrs []string) {
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			n.logger.Printf("Can't resolve bootstrap node [%v]: %v\n", a, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.query(addr, methodFindNode, map[string]interface{} { keyTarget : string(n.id[:]) })
+		}()
+	}
+	wg.Wait()
+	n.lookup(n.id, methodFindNode)
+}
+
+func (n * Node) Ping(addr *net.UDPAddr) error {
+	_, err := n.query(addr, methodPing, map[string]interface{} {})
+	return err
+}
+
+// Searches the DHT for peers of the given torrent
+func (n * Node) GetPeers(infoHash []byte) ([]*net.TCPAddr, error) {
+	target, ok := NodeIdFrom(string(infoHash))
+	if !ok {
+		return nil, errInvalidInfoHash
+	}
+	return n.lookup(target, methodGetPeers).peers, nil
+}
+
+// Searches the DHT for peers of the given torrent & announces that we accept
+// connections for it on the given port.
+func (n * Node) Announce(infoHash []byte, port int) ([]*net.TCPAddr, error) {
+	target, ok := NodeIdFrom(string(infoHash))
+	if !ok {
+		return nil, errInvalidInfoHash
+	}
+	res := n.lookup(target, methodGetPeers)
+
+	// Announce to the closest nodes which gave us a token
+	var wg sync.WaitGroup
+	for _, c := range res.closest {
+		token, ok := res.tokens[c.addr.String()]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			n.query(addr, methodAnnouncePeer, map[string]interface{} {
+				keyInfoHash : string(infoHash),
+				keyPort : port,
+				keyToken : token,
+			})
+		}(c.addr)
+	}
+	wg.Wait()
+	return res.peers, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////
+// Iterative lookup
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+type lookupResult struct {
+	peers []*net.TCPAddr
+	closest []contact // responding nodes, closest first
+	tokens map[string]string // node address -> announce token
+}
+
+func (n * Node) lookup(target NodeId, method string) *lookupResult {
+
+	res := &lookupResult { tokens : make(map[string]string) }
+	shortlist := n.table.Closest(target, K)
+	seen := make(map[string]bool)
+	for _, c := range shortlist {
+		seen[c.addr.String()] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	peers := make(map[string]bool)
+
+	var mu sync.Mutex
+	for round := 0; round < maxLookupRounds; round++ {
+
+		// Query up to alpha of the K closest responsive nodes not yet queried
+		sort.Slice(shortlist, func(i, j int) bool {
+			return target.Closer(shortlist[i].id, shortlist[j].id)
+		})
+		batch := make([]contact, 0, alpha)
+		considered := 0
+		for _, c := range shortlist {
+			addr := c.addr.String()
+			if failed[addr] {
+				continue
+			}
+			if considered++; considered > K || len(batch) == alpha {
+				break
+			}
+			if !queried[addr] {
+				queried[addr] = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c contact) {
+				defer wg.Done()
+				args := map[string]interface{} { keyTarget : string(target[:]) }
+				if method == methodGetPeers {
+					args = map[string]interface{} { keyInfoHash : string(target[:]) }
+				}
+				r, err := n.query(c.addr, method, args)
+
+				mu.Lock()
+				defer mu.Unlock()
+				addr := c.addr.String()
+				if err != nil {
+					failed[addr] = true
+					return
+				}
+				c.id, _ = r.id(keyId)
+				res.closest = append(res.closest, c)
+				if token, ok := r.str(keyToken); ok {
+					res.tokens[addr] = token
+				}
+				if values, ok := r.list(keyValues); ok {
+					for _, v := range values {
+						s, _ := v.(string)
+						if peer, ok := decodePeer(s); ok && !peers[s] {
+							peers[s] = true
+							res.peers = append(res.peers, peer)
+						}
+					}
+				}
+				if nodes, ok := r.str(keyNodes); ok {
+					for _, nc := range decodeNodes(nodes) {
+						if a := nc.addr.String(); !seen[a] && nc.id != n.id {
+							seen[a] = true
+							shortlist = append(shortlist, nc)
+						}
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	sort.Slice(res.closest, func(i, j int) bool {
+		return target.Closer(res.closest[i].id, res.closest[j].id)
+	})
+	if len(res.closest) > K {
+		res.closest = res.closest[:K]
+	}
+	return res
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////
+// KRPC I/O
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (n * Node) query(addr *net.UDPAddr, method string, args map[string]interface{}) (message, error) {
+
+	// Register transaction
+	t := &transaction { addr : addr, c : make(chan message, 1) }
+	n.mu.Lock()
+	n.nextTx++
+	tx := string([]byte { byte(n.nextTx >> 8), byte(n.nextTx) })
+	n.txs[tx] = t
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.txs, tx)
+		n.mu.Unlock()
+	}()
+
+	args[keyId] = string(n.id[:])
+	if err := n.send(newQuery(tx, method, args), addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.timeout)
+	defer timer.Stop()
+	select {
+	case m := <- t.c:
+		if y, _ := m.str(keyType); y == typeError {
+			return nil, m.err()
+		}
+		r, ok := m.dict(keyResponse)
+		if !ok {
+			n.table.Failed(addr)
+			return nil, errMalformedMessage
+		}
+		id, ok := r.id(keyId)
+		if !ok {
+			n.table.Failed(addr)
+			return nil, errMalformedMessage
+		}
+		n.seen(id, addr)
+		return r, nil
+
+	case <- timer.C:
+		n.table.Failed(addr)
+		return nil, errTimeout
+
+	case <- n.done:
+		return nil, errClosed
+	}
+}
+
+func (n * Node) send(m map[string]interface{}, addr *net.UDPAddr) error {
+	buf, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteToUDP(buf, addr)
+	return err
+}
+
+func (n * Node) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			n.logger.Printf("DHT read error: %v\n", err)
+			continue
+		}
+
+		m, err := decodeMessage(buf[:size])
+		if err != nil {
+			continue // Ignore garbage
+		}
+		switch y, _ := m.str(keyType); y {
+		case typeQuery: n.handleQuery(m, addr)
+		case typeResponse, typeError: n.handleResponse(m, addr)
+		}
+	}
+}
+
+func (n * Node) handleResponse(m message, addr *net.UDPAddr) {
+	tx, _ := m.str(keyTransaction)
+	n.mu.Lock()
+	t, ok := n.txs[tx]
+	if ok && t.addr.IP.Equal(addr.IP) && t.addr.Port == addr.Port {
+		delete(n.txs, tx)
+	} else {
+		ok = false
+	}
+	n.mu.Unlock()
+
+	if ok {
+		t.c <- m // Buffered, never blocks
+	}
+}
+
+func (n * Node) handleQuery(m message, addr *net.UDPAddr) {
+	tx, _ := m.str(keyTransaction)
+	method, _ := m.str(keyQuery)
+	args, ok := m.dict(keyArgs)
+	if !ok {
+		n.send(newError(tx, errProtocol, "Missing arguments"), addr)
+		return
+	}
+	id, ok := args.id(keyId)
+	if !ok {
+		n.send(newError(tx, errProtocol, "Invalid id"), addr)
+		return
+	}
+	n.seen(id, addr)
+
+	r := map[string]interface{} { keyId : string(n.id[:]) }
+	switch method {
+	case methodPing:
+
+	case methodFindNode:
+		target, ok := args.id(keyTarget)
+		if !ok {
+			n.send(newError(tx, errProtocol, "Invalid target"), addr)
+			return
+		}
+		r[keyNodes] = encodeNodes(n.table.Closest(target, K))
+
+	case methodGetPeers:
+		infoHash, ok := args.id(keyInfoHash)
+		if !ok {
+			n.send(newError(tx, errProtocol, "Invalid info_hash"), addr)
+			return
+		}
+		r[keyToken] = n.tokens.token(addr.IP)
+		if values := n.store.get(infoHash); len(values) > 0 {
+			r[keyValues] = values
+		} else {
+			r[keyNodes] = encodeNodes(n.table.Closest(infoHash, K))
+		}
+
+	case methodAnnouncePeer:
+		infoHash, ok := args.id(keyInfoHash)
+		if !ok {
+			n.send(newError(tx, errProtocol, "Invalid info_hash"), addr)
+			return
+		}
+		token, _ := args.str(keyToken)
+		if !n.tokens.valid(token, addr.IP) {
+			n.send(newError(tx, errProtocol, "Bad token"), addr)
+			return
+		}
+		port := addr.Port
+		if implied, _ := args.integer(keyImpliedPort); implied == 0 {
+			p, ok := args.integer(keyPort)
+			if !ok || p <= 0 || p > 65535 {
+				n.send(newError(tx, errProtocol, "Invalid port"), addr)
+				return
+			}
+			port = int(p)
+		}
+		if peer, ok := encodePeer(addr.IP, port); ok {
+			n.store.add(infoHash, peer)
+		}
+
+	default:
+		n.send(newError(tx, errMethodUnknown, "Method Unknown"), addr)
+		return
+	}
+	n.send(newResponse(tx, r), addr)
+}
+
+// Adds the node to the routing table & checks any questionable node it may replace
+func (n * Node) seen(id NodeId, addr *net.UDPAddr) {
+	old := n.table.Seen(id, addr)
+	if old == nil {
+		return
+	}
+
+	n.mu.Lock()
+	busy := n.checking[old.id]
+	n.checking[old.id] = true
+	n.mu.Unlock()
+	if busy {
+		return
+	}
+
+	go func() {
+		defer func() {
+			n.mu.Lock()
+			delete(n.checking, old.id)
+			n.mu.Unlock()
+		}()
+		for i := 0; i < maxFailures; i++ {
+			if n.Ping(old.addr) == nil {
+				return
+			}
+		}
+		n.table.Seen(id, addr) // Old node is now bad & will be replaced
+	}()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////
+// Maintenance & persistence
+////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (n * Node) maintenanceLoop() {
+	ticker := time.NewTicker(MaintenancePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- n.done:
+			return
+		case <- ticker.C:
+			n.tokens.maybeRotate()
+			n.store.expire()
+			for _, target := range n.table.StaleTargets(questionableAfter) {
+				n.lookup(target, methodFindNode)
+			}
+			if n.stateFile != "" {
+				if err := n.Save(n.stateFile); err != nil {
+					n.logger.Printf("Failed to save DHT state: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// Writes our id & all nodes which are not bad to the given file
+func (n * Node) Save(path string) error {
+	buf, err := bencode.EncodeBytes(map[string]interface{} {
+		stateId : string(n.id[:]),
+		stateNodes : encodeNodes(n.table.Closest(n.id, numBuckets * K)),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write & then rename so a crash never leaves a partial file
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadState(path string) (NodeId, []contact, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	dict, err := bencode.DecodeAsDict(bytes.NewReader(buf))
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	m := message(dict)
+	id, ok := m.id(stateId)
+	if !ok {
+		return NodeId{}, nil, errMalformedMessage
+	}
+	nodes, _ := m.str(stateNodes)
+	return id, decodeNodes(nodes), nil
+}
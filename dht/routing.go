@@ -0,0 +1,265 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	K = 8 // bucket size & number of nodes returned from lookups
+	idLength = 20
+	numBuckets = idLength * 8
+	questionableAfter = 15 * time.Minute
+	maxFailures = 2
+)
+
+// ----------------------------------------------------------------------------------
+// NodeId - 160-bit identifier shared by nodes & info hashes
+// ----------------------------------------------------------------------------------
+
+type NodeId [idLength]byte
+
+func NewNodeId() NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	return id
+}
+
+func NodeIdFrom(s string) (NodeId, bool) {
+	var id NodeId
+	if len(s) != idLength {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+func (id NodeId) Distance(other NodeId) NodeId {
+	var d NodeId
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Returns true if a is closer to this id than b
+func (id NodeId) Closer(a, b NodeId) bool {
+	for i := range id {
+		da, db := id[i] ^ a[i], id[i] ^ b[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// Returns the number of leading bits shared with other
+func (id NodeId) CommonPrefixLen(other NodeId) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			n := 0
+			for ; x & 0x80 == 0; x <<= 1 {
+				n++
+			}
+			return i*8 + n
+		}
+	}
+	return numBuckets
+}
+
+func (id NodeId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ----------------------------------------------------------------------------------
+// contact - a remote node in the routing table
+// ----------------------------------------------------------------------------------
+
+type contact struct {
+	id NodeId
+	addr *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (c contact) isGood() bool {
+	return c.failures == 0 && time.Since(c.lastSeen) < questionableAfter
+}
+
+func (c contact) isBad() bool {
+	return c.failures >= maxFailures
+}
+
+type bucket struct {
+	contacts []*contact // least recently seen first
+	lastChanged time.Time
+}
+
+func (b * bucket) find(id NodeId) int {
+	for i, c := range b.contacts {
+		if c.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ----------------------------------------------------------------------------------
+// RoutingTable - k-buckets indexed by the length of prefix shared with our id
+// ----------------------------------------------------------------------------------
+
+type RoutingTable struct {
+	self NodeId
+	buckets [numBuckets]bucket
+	mu sync.Mutex
+}
+
+func NewRoutingTable(self NodeId) *RoutingTable {
+	return &RoutingTable { self : self }
+}
+
+func (rt * RoutingTable) bucketFor(id NodeId) *bucket {
+	i := rt.self.CommonPrefixLen(id)
+	if i >= numBuckets {
+		return nil
+	}
+	return &rt.buckets[i]
+}
+
+// Records that a node was seen. If the node's bucket is full & has no bad nodes the
+// least recently seen questionable node is returned so that it may be pinged. Once it
+// has been marked as failed a later call will replace it.
+func (rt * RoutingTable) Seen(id NodeId, addr *net.UDPAddr) *contact {
+	return rt.add(id, addr, time.Now())
+}
+
+func (rt * RoutingTable) add(id NodeId, addr *net.UDPAddr, seen time.Time) *contact {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucketFor(id)
+	if b == nil {
+		return nil // ourself
+	}
+
+	// Known node - move to end
+	if i := b.find(id); i != -1 {
+		c := b.contacts[i]
+		c.addr = addr
+		if seen.After(c.lastSeen) {
+			c.lastSeen = seen
+			c.failures = 0
+		}
+		b.contacts = append(append(b.contacts[:i], b.contacts[i+1:]...), c)
+		b.lastChanged = time.Now()
+		return nil
+	}
+
+	// Space available
+	c := &contact { id : id, addr : addr, lastSeen : seen }
+	if len(b.contacts) < K {
+		b.contacts = append(b.contacts, c)
+		b.lastChanged = time.Now()
+		return nil
+	}
+
+	// Replace a bad node or ask for the oldest questionable node to be checked
+	for i, old := range b.contacts {
+		if old.isBad() {
+			b.contacts = append(append(b.contacts[:i], b.contacts[i+1:]...), c)
+			b.lastChanged = time.Now()
+			return nil
+		}
+	}
+	for _, old := range b.contacts {
+		if !old.isGood() {
+			questionable := *old
+			return &questionable
+		}
+	}
+	return nil
+}
+
+// Records a failed query to the node at the given address
+func (rt * RoutingTable) Failed(addr *net.UDPAddr) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for i := range rt.buckets {
+		for _, c := range rt.buckets[i].contacts {
+			if c.addr.String() == addr.String() {
+				c.failures++
+			}
+		}
+	}
+}
+
+// Returns up to n known nodes which are not bad, closest to the target first
+func (rt * RoutingTable) Closest(target NodeId, n int) []contact {
+	contacts := rt.filter(func(c *contact) bool { return !c.isBad() })
+	sort.Slice(contacts, func(i, j int) bool {
+		return target.Closer(contacts[i].id, contacts[j].id)
+	})
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Returns all known nodes
+func (rt * RoutingTable) Contacts() []contact {
+	return rt.filter(func(c *contact) bool { return true })
+}
+
+func (rt * RoutingTable) Len() int {
+	return len(rt.Contacts())
+}
+
+func (rt * RoutingTable) filter(p func(*contact) bool) []contact {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	contacts := make([]contact, 0, K)
+	for i := range rt.buckets {
+		for _, c := range rt.buckets[i].contacts {
+			if p(c) {
+				contacts = append(contacts, *c)
+			}
+		}
+	}
+	return contacts
+}
+
+// Returns a random id within each non-empty bucket which has not changed recently
+func (rt * RoutingTable) StaleTargets(d time.Duration) []NodeId {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	targets := make([]NodeId, 0)
+	for i := range rt.buckets {
+		b := &rt.buckets[i]
+		if len(b.contacts) > 0 && time.Since(b.lastChanged) > d {
+			targets = append(targets, randomIdInBucket(rt.self, i))
+		}
+	}
+	return targets
+}
+
+// Builds an id sharing exactly n prefix bits with self
+func randomIdInBucket(self NodeId, n int) NodeId {
+	id := NewNodeId()
+	for i := 0; i < n/8; i++ {
+		id[i] = self[i]
+	}
+
+	// Copy remaining prefix bits, flip bit n & keep random suffix
+	byteIndex, bit := n/8, uint(n%8)
+	mask := byte(0xFF) << (8-bit)
+	flip := byte(0x80) >> bit
+	id[byteIndex] = (self[byteIndex] & mask) | ((self[byteIndex] ^ flip) & flip) | (id[byteIndex] &^ (mask | flip))
+	return id
+}
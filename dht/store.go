@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tokenRotationPeriod = 5 * time.Minute
+	peerExpiry = 30 * time.Minute
+	maxPeersPerTorrent = 1000
+	maxTorrents = 10000
+	maxValues = 50 // peers per get_peers response, keeps packet within a single MTU
+)
+
+// ----------------------------------------------------------------------------------
+// tokenManager - issues & validates announce tokens. A token is the SHA-1 hash of
+// the requester's IP & a secret which changes every five minutes. Tokens issued
+// with the previous secret are still accepted.
+// ----------------------------------------------------------------------------------
+
+type tokenManager struct {
+	secret, prev []byte
+	rotated time.Time
+	mu sync.Mutex
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager {}
+	tm.rotate()
+	tm.prev = tm.secret
+	return tm
+}
+
+func (tm * tokenManager) rotate() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	tm.prev, tm.secret = tm.secret, secret
+	tm.rotated = time.Now()
+}
+
+func (tm * tokenManager) maybeRotate() {
+	tm.mu.Lock()
+	due := time.Since(tm.rotated) > tokenRotationPeriod
+	tm.mu.Unlock()
+	if due {
+		tm.rotate()
+	}
+}
+
+func (tm * tokenManager) token(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return makeToken(tm.secret, ip)
+}
+
+func (tm * tokenManager) valid(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return token == makeToken(tm.secret, ip) || token == makeToken(tm.prev, ip)
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.To16())
+	return string(h.Sum(nil)[:8])
+}
+
+// ----------------------------------------------------------------------------------
+// peerStore - peers announced to us, keyed by info hash
+// ----------------------------------------------------------------------------------
+
+type peerStore struct {
+	peers map[NodeId]map[string]time.Time // info hash -> compact peer -> last announce
+	mu sync.Mutex
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore { peers : make(map[NodeId]map[string]time.Time) }
+}
+
+func (ps * peerStore) add(infoHash NodeId, peer string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers, ok := ps.peers[infoHash]
+	if !ok {
+		if len(ps.peers) >= maxTorrents {
+			return
+		}
+		peers = make(map[string]time.Time)
+		ps.peers[infoHash] = peers
+	}
+	if _, ok := peers[peer]; ok || len(peers) < maxPeersPerTorrent {
+		peers[peer] = time.Now()
+	}
+}
+
+func (ps * peerStore) get(infoHash NodeId) []interface{} {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// NOTE: Map iteration order gives us a different selection each time
+	values := make([]interface{}, 0, maxValues)
+	for peer := range ps.peers[infoHash] {
+		values = append(values, peer)
+		if len(values) == maxValues {
+			break
+		}
+	}
+	return values
+}
+
+func (ps * peerStore) expire() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for infoHash, peers := range ps.peers {
+		for peer, t := range peers {
+			if time.Since(t) > peerExpiry {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(ps.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package memnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errReset = errors.New("connection reset by peer")
+)
+
+// ----------------------------------------------------------------------------------
+// Conn - one end of a reliable, ordered connection. Each direction transmits at the
+// link bandwidth & delivers after its latency, plus a retransmit timeout for every
+// time a segment is lost. Implements net.Conn.
+// ----------------------------------------------------------------------------------
+
+type Conn struct {
+	n *Network
+	local, remote *Addr
+	in, out *pipe
+	closeOnce sync.Once
+}
+
+func newConnPair(n *Network, link Link, local, remote *Addr) (*Conn, *Conn) {
+	up, down := newPipe(n, link), newPipe(n, link)
+	return &Conn { n : n, local : local, remote : remote, in : down, out : up },
+		   &Conn { n : n, local : remote, remote : local, in : up, out : down }
+}
+
+func (c * Conn) Read(b []byte) (int, error) {
+	n, err := c.in.read(b)
+	if err != nil && err != io.EOF {
+		err = &net.OpError { Op : "read", Net : network, Source : c.local, Addr : c.remote, Err : err }
+	}
+	return n, err
+}
+
+func (c * Conn) Write(b []byte) (int, error) {
+	n, err := c.out.write(b)
+	if err != nil {
+		err = &net.OpError { Op : "write", Net : network, Source : c.local, Addr : c.remote, Err : err }
+	}
+	return n, err
+}
+
+// Closes both directions. Data already written is still delivered to the remote,
+// which then reads EOF.
+func (c * Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.in.closeReader()
+		c.out.closeWriter()
+		c.n.remove(c)
+	})
+	return nil
+}
+
+func (c * Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c * Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c * Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c * Conn) SetReadDeadline(t time.Time) error {
+	c.in.mu.Lock()
+	c.in.readDeadline = t
+	c.in.mu.Unlock()
+	signal(c.in.readWake)
+	return nil
+}
+
+func (c * Conn) SetWriteDeadline(t time.Time) error {
+	c.out.mu.Lock()
+	c.out.writeDeadline = t
+	c.out.mu.Unlock()
+	signal(c.out.writeWake)
+	return nil
+}
+
+// ----------------------------------------------------------------------------------
+// pipe - a single direction of a connection
+// ----------------------------------------------------------------------------------
+
+type segment struct {
+	data []byte
+	at time.Time // when readable
+}
+
+type pipe struct {
+	n *Network
+	link Link
+
+	mu sync.Mutex
+	segments []segment
+	free time.Time // when the link can transmit the next segment
+	last time.Time // latest delivery, segments are delivered in order
+	readDeadline, writeDeadline time.Time
+	readerClosed, writerClosed bool
+
+	readWake, writeWake chan struct{}
+}
+
+func newPipe(n *Network, link Link) *pipe {
+	return &pipe {
+		n : n,
+		link : link,
+		readWake : make(chan struct{}, 1),
+		writeWake : make(chan struct{}, 1),
+	}
+}
+
+func (p * pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.readerClosed {
+			return 0, net.ErrClosed
+		}
+		now := time.Now()
+		if expired(p.readDeadline, now) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		// Copy everything delivered so far
+		n := 0
+		for n < len(b) && len(p.segments) > 0 && !p.segments[0].at.After(now) {
+			c := copy(b[n:], p.segments[0].data)
+			n += c
+			if p.segments[0].data = p.segments[0].data[c:]; len(p.segments[0].data) == 0 {
+				p.segments = p.segments[1:]
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if len(p.segments) == 0 && p.writerClosed {
+			return 0, io.EOF
+		}
+
+		// Wait for the next delivery, more data or a change of state
+		var at time.Time
+		if len(p.segments) > 0 {
+			at = p.segments[0].at
+		}
+		p.mu.Unlock()
+		wait(p.readWake, earliest(at, p.readDeadline))
+		p.mu.Lock()
+	}
+}
+
+func (p * pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if p.writerClosed {
+			return written, net.ErrClosed
+		}
+		if p.readerClosed {
+			return written, errReset
+		}
+		now := time.Now()
+		if expired(p.writeDeadline, now) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		// Wait until the previous segment has been transmitted
+		if p.free.After(now) {
+			free := p.free
+			p.mu.Unlock()
+			wait(p.writeWake, earliest(free, p.writeDeadline))
+			p.mu.Lock()
+			continue
+		}
+
+		seg := make([]byte, min(segmentSize, len(b) - written))
+		copy(seg, b[written:])
+		p.free = now
+		if p.link.Bandwidth > 0 {
+			p.free = now.Add(time.Duration(len(seg)) * time.Second / time.Duration(p.link.Bandwidth))
+		}
+		p.n.mu.Lock()
+		lost := p.n.losses(p.link)
+		p.n.mu.Unlock()
+		at := p.free.Add(p.link.Latency + time.Duration(lost) * p.link.retransmitTimeout())
+		if at.Before(p.last) {
+			at = p.last
+		}
+		p.last = at
+		p.segments = append(p.segments, segment { seg, at })
+		written += len(seg)
+		signal(p.readWake)
+	}
+	return written, nil
+}
+
+func (p * pipe) closeReader() {
+	p.mu.Lock()
+	p.readerClosed = true
+	p.segments = nil
+	p.mu.Unlock()
+	signal(p.readWake)
+	signal(p.writeWake)
+}
+
+func (p * pipe) closeWriter() {
+	p.mu.Lock()
+	p.writerClosed = true
+	p.mu.Unlock()
+	signal(p.readWake)
+	signal(p.writeWake)
+}
+
+// ----------------------------------------------------------------------------------
+// Helpers
+// ----------------------------------------------------------------------------------
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Blocks until woken or the given time (zero = no limit)
+func wait(wake chan struct{}, until time.Time) {
+	if until.IsZero() {
+		<- wake
+		return
+	}
+	t := time.NewTimer(time.Until(until))
+	defer t.Stop()
+	select {
+	case <- wake:
+	case <- t.C:
+	}
+}
+
+func expired(deadline, now time.Time) bool {
+	return !deadline.IsZero() && !now.Before(deadline)
+}
+
+// Returns the earliest non-zero time
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
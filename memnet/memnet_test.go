@@ -0,0 +1,115 @@
+package memnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPair(t *testing.T, link Link) (net.Conn, net.Conn) {
+	n := New(1, link)
+	t.Cleanup(n.Close)
+	l, err := n.Host("10.0.0.1").Listen(6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := n.Host("10.0.0.2").DialTimeout("10.0.0.1:6881", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// Writes data on one connection & returns the time taken for it all to be read on the other
+func transfer(t *testing.T, w, r net.Conn, size int) time.Duration {
+	data := make([]byte, size)
+	rand.Read(data)
+	start := time.Now()
+	go w.Write(data)
+	buf := make([]byte, size)
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("Data corrupted")
+	}
+	return time.Since(start)
+}
+
+func TestLatency(t *testing.T) {
+	c, s := newTestPair(t, Link { Latency : 50 * time.Millisecond })
+	if d := transfer(t, c, s, 100); d < 50 * time.Millisecond {
+		t.Errorf("Expected: >= 50ms, Actual: %v", d)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	c, s := newTestPair(t, Link { Bandwidth : 100 * 1024 })
+	if d := transfer(t, s, c, 20 * 1024); d < 180 * time.Millisecond {
+		t.Errorf("Expected: >= 200ms, Actual: %v", d)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	c, s := newTestPair(t, Link { Loss : 0.2 })
+	if d := transfer(t, c, s, 50 * segmentSize); d < MIN_RETRANSMIT_TIMEOUT {
+		t.Errorf("Expected: >= %v, Actual: %v", MIN_RETRANSMIT_TIMEOUT, d)
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	n := New(1, Link {})
+	defer n.Close()
+	if _, err := n.Host("10.0.0.1").Listen(6881); err != nil {
+		t.Fatal(err)
+	}
+	n.SetLink("10.0.0.1", "10.0.0.2", Link { Refuse : true })
+
+	tests := []struct {
+		from, to string
+		ok bool
+	} {
+		{ "10.0.0.2", "10.0.0.1:6881", false },
+		{ "10.0.0.3", "10.0.0.1:6881", true },
+		{ "10.0.0.3", "10.0.0.1:6882", false },
+	}
+	for _, test := range tests {
+		c, err := n.Host(test.from).DialTimeout(test.to, time.Second)
+		if (err == nil) != test.ok {
+			t.Errorf("%v -> %v - Expected: %v, Actual: %v", test.from, test.to, test.ok, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+func TestCloseAndDeadlines(t *testing.T) {
+	c, s := newTestPair(t, Link { Latency : 10 * time.Millisecond })
+
+	// Reads time out
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("Expected timeout, Actual: %v", err)
+	}
+	s.SetReadDeadline(time.Time{})
+
+	// Pending data is delivered before EOF
+	c.Write([]byte("bye"))
+	c.Close()
+	buf, err := io.ReadAll(s)
+	if err != nil || string(buf) != "bye" {
+		t.Errorf("Expected: bye, Actual: %q, %v", buf, err)
+	}
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Error("Expected write to closed connection to fail")
+	}
+}
@@ -0,0 +1,326 @@
+package memnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	MIN_RETRANSMIT_TIMEOUT = 200 * time.Millisecond
+	CONNECT_RETRY_TIMEOUT = 1 * time.Second // before a lost connect is retried
+
+	errRefused = errors.New("connection refused")
+	errNetworkClosed = errors.New("network closed")
+	errAddressInUse = errors.New("address already in use")
+)
+
+const (
+	network = "memnet"
+	segmentSize = 1460 // unit of loss & retransmission
+	acceptBacklog = 128
+	firstEphemeralPort = 49152
+)
+
+// ----------------------------------------------------------------------------------
+// Link - characteristics of the path between two hosts, applied to each direction
+// of every connection independently
+// ----------------------------------------------------------------------------------
+
+type Link struct {
+
+	// One way delay
+	Latency time.Duration
+
+	// Bytes per second (0 = unlimited)
+	Bandwidth int
+
+	// Probability [0, 1) a segment or connect is lost & must be retransmitted
+	Loss float64
+
+	// Connects are refused
+	Refuse bool
+}
+
+// Time before a lost segment is resent
+func (l Link) retransmitTimeout() time.Duration {
+	return max(4 * l.Latency, MIN_RETRANSMIT_TIMEOUT)
+}
+
+// ----------------------------------------------------------------------------------
+// Network - in-memory hosts connected by emulated links. Loss is drawn from a source
+// seeded at creation so runs performing the same operations see the same losses.
+// ----------------------------------------------------------------------------------
+
+type Network struct {
+	mu sync.Mutex
+	rand *rand.Rand
+	link Link
+	links map[[2]string]Link // between two addresses, lowest first
+	hosts map[string]*Host
+	conns map[*Conn]bool
+	closed bool
+}
+
+// Creates a network whose hosts are connected by the given link unless overridden
+func New(seed int64, link Link) *Network {
+	return &Network {
+		rand : rand.New(rand.NewSource(seed)),
+		link : link,
+		links : make(map[[2]string]Link),
+		hosts : make(map[string]*Host),
+		conns : make(map[*Conn]bool),
+	}
+}
+
+// Sets the link between two hosts, in both directions
+func (n * Network) SetLink(a, b string, l Link) {
+	n.mu.Lock()
+	n.links[linkKey(a, b)] = l
+	n.mu.Unlock()
+}
+
+// Returns the host with the given IP address, creating it if necessary
+func (n * Network) Host(ip string) *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h, ok := n.hosts[ip]
+	if !ok {
+		h = &Host {
+			n : n,
+			ip : ip,
+			listeners : make(map[int]*Listener),
+			nextPort : firstEphemeralPort,
+		}
+		n.hosts[ip] = h
+	}
+	return h
+}
+
+// Closes every listener & connection. Further connects fail.
+func (n * Network) Close() {
+	n.mu.Lock()
+	n.closed = true
+	var ls []*Listener
+	for _, h := range n.hosts {
+		for _, l := range h.listeners {
+			ls = append(ls, l)
+		}
+	}
+	var cs []*Conn
+	for c := range n.conns {
+		cs = append(cs, c)
+	}
+	n.mu.Unlock()
+
+	for _, l := range ls {
+		l.Close()
+	}
+	for _, c := range cs {
+		c.Close()
+	}
+}
+
+// NOTE: Must hold n.mu
+func (n * Network) linkBetween(a, b string) Link {
+	if l, ok := n.links[linkKey(a, b)]; ok {
+		return l
+	}
+	return n.link
+}
+
+// Returns the number of times a transmission is lost before succeeding
+// NOTE: Must hold n.mu
+func (n * Network) losses(l Link) int {
+	lost := 0
+	for l.Loss > 0 && n.rand.Float64() < l.Loss {
+		lost++
+	}
+	return lost
+}
+
+func (n * Network) remove(c *Conn) {
+	n.mu.Lock()
+	delete(n.conns, c)
+	n.mu.Unlock()
+}
+
+func linkKey(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string { a, b }
+}
+
+// ----------------------------------------------------------------------------------
+// Host - a single address on the network from which to listen & dial
+// ----------------------------------------------------------------------------------
+
+type Host struct {
+	n *Network
+	ip string
+	listeners map[int]*Listener // guarded by n.mu
+	nextPort int
+}
+
+func (h * Host) IP() string {
+	return h.ip
+}
+
+// Listens on the given port (0 = any free port)
+func (h * Host) Listen(port int) (*Listener, error) {
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, &net.OpError { Op : "listen", Net : network, Err : errNetworkClosed }
+	}
+	if port == 0 {
+		port = h.port()
+	}
+	addr := &Addr { h.ip, port }
+	if _, ok := h.listeners[port]; ok {
+		return nil, &net.OpError { Op : "listen", Net : network, Addr : addr, Err : errAddressInUse }
+	}
+	l := &Listener {
+		h : h,
+		addr : addr,
+		backlog : make(chan *Conn, acceptBacklog),
+		done : make(chan struct{}),
+	}
+	h.listeners[port] = l
+	return l, nil
+}
+
+// Connects to addr (ip:port). Takes a round trip, plus a retry timeout for each lost
+// connect, & fails if the link refuses or nothing is listening.
+func (h * Host) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ip, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	opErr := func(err error) error {
+		return &net.OpError { Op : "dial", Net : network, Addr : &Addr { ip, port }, Err : err }
+	}
+
+	n := h.n
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, opErr(errNetworkClosed)
+	}
+	link := n.linkBetween(h.ip, ip)
+	delay := 2 * link.Latency + time.Duration(n.losses(link)) * CONNECT_RETRY_TIMEOUT
+	n.mu.Unlock()
+
+	if delay > timeout {
+		time.Sleep(timeout)
+		return nil, opErr(os.ErrDeadlineExceeded)
+	}
+	time.Sleep(delay)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var l *Listener
+	if remote, ok := n.hosts[ip]; ok {
+		l = remote.listeners[port]
+	}
+	if n.closed || link.Refuse || l == nil {
+		return nil, opErr(errRefused)
+	}
+
+	local := &Addr { h.ip, h.port() }
+	c, s := newConnPair(n, link, local, l.addr)
+	select {
+	case l.backlog <- s:
+	default:
+		return nil, opErr(errRefused)
+	}
+	n.conns[c] = true
+	n.conns[s] = true
+	return c, nil
+}
+
+// Returns a free port
+// NOTE: Must hold n.mu
+func (h * Host) port() int {
+	for {
+		p := h.nextPort
+		if h.nextPort++; h.nextPort > 65535 {
+			h.nextPort = firstEphemeralPort
+		}
+		if _, ok := h.listeners[p]; !ok {
+			return p
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------
+// Listener - accepts connections to a host & port. Implements net.Listener.
+// ----------------------------------------------------------------------------------
+
+type Listener struct {
+	h *Host
+	addr *Addr
+	backlog chan *Conn
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+func (l * Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <- l.backlog:
+		return c, nil
+	case <- l.done:
+		return nil, &net.OpError { Op : "accept", Net : network, Addr : l.addr, Err : net.ErrClosed }
+	}
+}
+
+// Stops listening & refuses any connections not yet accepted
+func (l * Listener) Close() error {
+	l.closeOnce.Do(func() {
+		n := l.h.n
+		n.mu.Lock()
+		delete(l.h.listeners, l.addr.Port)
+		n.mu.Unlock()
+		close(l.done)
+		for {
+			select {
+			case c := <- l.backlog:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l * Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// ----------------------------------------------------------------------------------
+// Addr - address of an endpoint. Implements net.Addr.
+// ----------------------------------------------------------------------------------
+
+type Addr struct {
+	IP string
+	Port int
+}
+
+func (a * Addr) Network() string {
+	return network
+}
+
+func (a * Addr) String() string {
+	return net.JoinHostPort(a.IP, strconv.Itoa(a.Port))
+}
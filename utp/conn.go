@@ -0,0 +1,572 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errReset = errors.New("uTP connection reset by peer")
+	errTimedOut = errors.New("uTP connection timed out")
+)
+
+const (
+	recvWindow = 1 << 20 // bytes buffered for reading
+	maxOutOfOrder = 1024 // packets held awaiting a missing one
+	maxTransmissions = 6 // attempts to send a packet before giving up
+
+	// LEDBAT congestion control
+	targetDelay = 100 * time.Millisecond
+	maxCwndIncrease = 3000 // bytes per RTT
+	minWindow = maxPayload
+	initialWindow = 4 * maxPayload
+	maxWindow = recvWindow
+
+	initialTimeout = 1 * time.Second
+	minTimeout = 500 * time.Millisecond
+	maxTimeout = 16 * time.Second
+)
+
+// Connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+type packet struct {
+	typ byte
+	seq uint16
+	payload []byte
+	sent time.Time
+	transmissions int
+}
+
+// ----------------------------------------------------------------------------------
+// Conn - a single uTP connection. Implements net.Conn.
+// ----------------------------------------------------------------------------------
+
+type Conn struct {
+	s *Socket
+	raddr net.Addr
+	recvId, sendId uint16
+
+	mu sync.Mutex
+	cond *sync.Cond // signalled on any change of state
+	state int
+	closed bool     // Close called
+	err error       // reason connection was destroyed
+
+	// Send side
+	seq uint16      // next sequence number
+	lastAck uint16  // last ack received, for duplicate detection
+	dupAcks int
+	recovering bool // retransmitting after loss until recoverSeq is acked
+	recoverSeq uint16
+	inflight []*packet
+	inflightBytes int
+	cwnd float64    // congestion window
+	peerWindow int
+	delays delayHistory
+	rtt, rttVar, rto time.Duration
+
+	// Receive side
+	ack uint16      // last sequence number received in order
+	replyMicro uint32
+	readBuf bytes.Buffer
+	outOfOrder map[uint16]*packet
+	outOfOrderBytes int
+	advertised int
+	eof bool
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer *time.Timer
+}
+
+func newConn(s *Socket, raddr net.Addr, recvId, sendId uint16) *Conn {
+	c := &Conn {
+		s : s,
+		raddr : raddr,
+		recvId : recvId,
+		sendId : sendId,
+		state : stateSynSent,
+		cwnd : initialWindow,
+		peerWindow : recvWindow,
+		rto : initialTimeout,
+		outOfOrder : make(map[uint16]*packet),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Initiator - sends SYN & waits for STATE
+func (c * Conn) connect(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq = 1
+	c.lastAck = 0
+	c.send(stSyn, nil)
+
+	deadline := time.Now().Add(timeout)
+	t := time.AfterFunc(timeout, c.broadcast)
+	defer t.Stop()
+	for c.state == stateSynSent {
+		if !time.Now().Before(deadline) {
+			c.destroy(errTimedOut)
+			break
+		}
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.opError("dial", c.err)
+	}
+	return nil
+}
+
+// Receiver - replies to SYN with STATE
+func (c * Conn) accept(syn header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateConnected
+	c.seq = uint16(rand.Intn(1 << 16))
+	c.lastAck = c.seq - 1
+	c.ack = syn.seq
+	c.peerWindow = int(syn.wnd)
+	c.replyMicro = micros(time.Now()) - syn.timestamp
+	c.send(stState, nil)
+}
+
+func (c * Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.opError("read", c.err)
+		case expired(c.readDeadline):
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		c.cond.Wait()
+	}
+	n, _ := c.readBuf.Read(b)
+	c.maybeUpdateWindow()
+	return n, nil
+}
+
+// Blocks until all of b is sent or within the send window
+func (c * Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for n < len(b) {
+		switch {
+		case c.closed:
+			return n, c.opError("write", net.ErrClosed)
+		case c.err != nil:
+			return n, c.opError("write", c.err)
+		case expired(c.writeDeadline):
+			return n, c.opError("write", os.ErrDeadlineExceeded)
+		}
+
+		// Always allow one packet in flight so a closed window is probed
+		size := len(b) - n
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if c.inflightBytes > 0 && c.inflightBytes + size > c.sendWindow() {
+			c.cond.Wait()
+			continue
+		}
+		c.send(stData, append([]byte(nil), b[n:n+size]...))
+		n += size
+	}
+	return n, nil
+}
+
+// Sends FIN once all written data & returns immediately. The connection is released
+// when FIN is acknowledged or retransmission fails.
+func (c * Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.state == stateConnected {
+		c.send(stFin, nil)
+		c.state = stateFinSent
+	} else {
+		c.destroy(nil)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c * Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c * Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c * Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c * Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c * Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c * Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), c.broadcast)
+}
+
+func (c * Conn) broadcast() {
+	c.mu.Lock()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c * Conn) opError(op string, err error) error {
+	return &net.OpError { Op : op, Net : "utp", Source : c.LocalAddr(), Addr : c.raddr, Err : err }
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// ----------------------------------------------------------------------------------
+// Protocol - all below must hold c.mu
+// ----------------------------------------------------------------------------------
+
+func (c * Conn) send(typ byte, payload []byte) {
+	p := &packet { typ : typ, seq : c.seq, payload : payload }
+	if typ != stState {
+		c.seq++
+		c.inflight = append(c.inflight, p)
+		c.inflightBytes += len(payload)
+	}
+	c.transmit(p)
+}
+
+func (c * Conn) transmit(p *packet) {
+	p.sent = time.Now()
+	p.transmissions++
+
+	// SYN is sent on the id we receive on
+	connId := c.sendId
+	if p.typ == stSyn {
+		connId = c.recvId
+	}
+	c.advertised = c.window()
+	h := header {
+		typ : p.typ,
+		connId : connId,
+		timestamp : micros(p.sent),
+		timestampDiff : c.replyMicro,
+		wnd : uint32(c.advertised),
+		seq : p.seq,
+		ack : c.ack,
+	}
+	c.s.write(h.marshal(p.payload), c.raddr)
+}
+
+func (c * Conn) receive(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == stateClosed {
+		return
+	}
+	now := time.Now()
+	c.replyMicro = micros(now) - h.timestamp
+	c.peerWindow = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.destroy(errReset)
+		return
+	case stSyn:
+		c.send(stState, nil) // Our reply was lost
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ack = h.seq - 1
+	}
+
+	c.onAck(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.onData(h, payload)
+	}
+	if c.state == stateFinSent && len(c.inflight) == 0 {
+		c.destroy(nil)
+	}
+}
+
+func (c * Conn) onAck(h header, now time.Time) {
+
+	// Remove all packets up to & including ack
+	n, acked, retransmitted := 0, 0, false
+	var last *packet
+	for len(c.inflight) > 0 && !seqLess(h.ack, c.inflight[0].seq) {
+		last = c.inflight[0]
+		c.inflight = c.inflight[1:]
+		c.inflightBytes -= len(last.payload)
+		acked += len(last.payload)
+		retransmitted = retransmitted || last.transmissions > 1
+		n++
+	}
+
+	// Karn's algorithm - don't sample if the ack could be for a retransmission. Packets
+	// held by the remote while waiting for a retransmission aren't sampled either.
+	if last != nil && !retransmitted {
+		c.updateRtt(now.Sub(last.sent))
+	}
+
+	// Duplicate acks - assume next packet lost & resend it. Fewer than three are
+	// required when there aren't enough packets in flight to generate them.
+	switch {
+	case n == 0 && h.typ == stState && h.ack == c.lastAck && len(c.inflight) > 0:
+		c.dupAcks++
+		if c.dupAcks == dupAckThreshold(len(c.inflight)) && !c.recovering {
+			c.onLoss()
+			c.transmit(c.inflight[0])
+		}
+
+	// Partial ack during recovery - next packet was also lost
+	case n > 0 && c.recovering && seqLess(h.ack, c.recoverSeq):
+		c.dupAcks = 0
+		if len(c.inflight) > 0 {
+			c.transmit(c.inflight[0])
+		}
+
+	case n > 0:
+		c.dupAcks = 0
+		c.recovering = false
+	}
+	c.lastAck = h.ack
+
+	if acked > 0 && h.timestampDiff != 0 {
+		c.updateWindow(acked, h.timestampDiff, now)
+	}
+}
+
+func (c * Conn) onData(h header, payload []byte) {
+	switch {
+	case h.seq == c.ack+1:
+		c.deliver(h.typ, payload)
+		for {
+			p, ok := c.outOfOrder[c.ack+1]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, p.seq)
+			c.outOfOrderBytes -= len(p.payload)
+			c.deliver(p.typ, p.payload)
+		}
+
+	case seqLess(c.ack+1, h.seq) && h.seq - c.ack < maxOutOfOrder:
+		if _, ok := c.outOfOrder[h.seq]; !ok {
+			c.outOfOrder[h.seq] = &packet { typ : h.typ, seq : h.seq, payload : payload }
+			c.outOfOrderBytes += len(payload)
+		}
+	}
+
+	// Always ack, duplicates included, as the previous ack may have been lost
+	c.send(stState, nil)
+}
+
+func (c * Conn) deliver(typ byte, payload []byte) {
+	c.ack++
+	switch {
+	case typ == stFin:
+		c.eof = true
+	case !c.eof && !c.closed:
+		c.readBuf.Write(payload)
+	}
+}
+
+func (c * Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	// Retransmit oldest unacknowledged packet
+	if len(c.inflight) > 0 && now.Sub(c.inflight[0].sent) > c.rto {
+		p := c.inflight[0]
+		if p.transmissions >= maxTransmissions {
+			c.destroy(errTimedOut)
+			return
+		}
+		c.onLoss()
+		c.cwnd = minWindow
+		c.rto *= 2
+		if c.rto > maxTimeout {
+			c.rto = maxTimeout
+		}
+		c.transmit(p)
+	}
+	c.maybeUpdateWindow()
+}
+
+// Tells the remote once its send window reopens as the last ack may have been lost
+func (c * Conn) maybeUpdateWindow() {
+	if c.state != stateSynSent && c.advertised < maxPayload && c.window() >= maxPayload {
+		c.send(stState, nil)
+	}
+}
+
+func dupAckThreshold(inflight int) int {
+	switch {
+	case inflight > 3: return 3
+	case inflight > 1: return inflight - 1
+	default: return 1
+	}
+}
+
+func (c * Conn) destroy(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.inflight = nil
+	c.inflightBytes = 0
+	for _, t := range []*time.Timer { c.readTimer, c.writeTimer } {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.cond.Broadcast()
+	c.s.remove(c)
+}
+
+// Receive space available to the remote
+func (c * Conn) window() int {
+	if w := recvWindow - c.readBuf.Len() - c.outOfOrderBytes; w > 0 {
+		return w
+	}
+	return 0
+}
+
+func (c * Conn) sendWindow() int {
+	if int(c.cwnd) < c.peerWindow {
+		return int(c.cwnd)
+	}
+	return c.peerWindow
+}
+
+func (c * Conn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4 * c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+// LEDBAT - grows the window while queuing delay is below target & shrinks it above
+func (c * Conn) updateWindow(acked int, delay uint32, now time.Time) {
+	c.delays.add(delay, now)
+	ourDelay := time.Duration(delay - c.delays.base()) * time.Microsecond
+	offTarget := float64(targetDelay - ourDelay) / float64(targetDelay)
+	windowFactor := math.Min(float64(acked), c.cwnd) / math.Max(c.cwnd, float64(acked))
+	c.cwnd = math.Max(minWindow, math.Min(maxWindow, c.cwnd + maxCwndIncrease * offTarget * windowFactor))
+}
+
+// Halves the window & retransmits unacknowledged packets as acks arrive until all
+// packets sent so far are acknowledged
+func (c * Conn) onLoss() {
+	c.cwnd = math.Max(minWindow, c.cwnd / 2)
+	c.recovering = true
+	c.recoverSeq = c.seq - 1
+}
+
+// ----------------------------------------------------------------------------------
+// delayHistory - minimum one way delay seen over the last two minutes, which is taken
+// as the delay with empty queues
+// ----------------------------------------------------------------------------------
+
+type delayHistory struct {
+	mins [2]uint32 // previous & current minute
+	start time.Time
+}
+
+func (dh * delayHistory) add(delay uint32, now time.Time) {
+	switch {
+	case dh.start.IsZero():
+		dh.mins = [2]uint32 { delay, delay }
+		dh.start = now
+	case now.Sub(dh.start) > time.Minute:
+		dh.mins = [2]uint32 { dh.mins[1], delay }
+		dh.start = now
+	case delay < dh.mins[1]:
+		dh.mins[1] = delay
+	}
+}
+
+func (dh delayHistory) base() uint32 {
+	if dh.mins[0] < dh.mins[1] {
+		return dh.mins[0]
+	}
+	return dh.mins[1]
+}
@@ -0,0 +1,106 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types
+const (
+	stData byte = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+const (
+	version = 1
+	headerLen = 20
+	maxPacketSize = 1400 // keeps packets within a typical path MTU
+	maxPayload = maxPacketSize - headerLen
+)
+
+var (
+	errShortPacket = errors.New("uTP packet too short")
+	errBadPacket = errors.New("Invalid uTP packet type or version")
+)
+
+// ----------------------------------------------------------------------------------
+// header - uTP (BEP 29) packet header, big endian
+//
+//  0       4       8               16              24              32
+//  +-------+-------+---------------+---------------+---------------+
+//  | type  | ver   | extension     | connection_id                 |
+//  +-------+-------+---------------+---------------+---------------+
+//  | timestamp_microseconds                                        |
+//  +---------------+---------------+---------------+---------------+
+//  | timestamp_difference_microseconds                             |
+//  +---------------+---------------+---------------+---------------+
+//  | wnd_size                                                      |
+//  +---------------+---------------+---------------+---------------+
+//  | seq_nr                        | ack_nr                        |
+//  +---------------+---------------+---------------+---------------+
+//
+// ----------------------------------------------------------------------------------
+
+type header struct {
+	typ byte
+	connId uint16
+	timestamp, timestampDiff uint32 // microseconds
+	wnd uint32
+	seq, ack uint16
+}
+
+func (h header) marshal(payload []byte) []byte {
+	b := make([]byte, headerLen + len(payload))
+	b[0] = h.typ << 4 | version
+	b[1] = 0 // no extensions
+	binary.BigEndian.PutUint16(b[2:], h.connId)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+	copy(b[headerLen:], payload)
+	return b
+}
+
+// Parses a packet, skipping any extensions (i.e. selective ack) as they are not used
+func parsePacket(b []byte) (header, []byte, error) {
+	if len(b) < headerLen {
+		return header{}, nil, errShortPacket
+	}
+	h := header {
+		typ : b[0] >> 4,
+		connId : binary.BigEndian.Uint16(b[2:]),
+		timestamp : binary.BigEndian.Uint32(b[4:]),
+		timestampDiff : binary.BigEndian.Uint32(b[8:]),
+		wnd : binary.BigEndian.Uint32(b[12:]),
+		seq : binary.BigEndian.Uint16(b[16:]),
+		ack : binary.BigEndian.Uint16(b[18:]),
+	}
+	if b[0] & 0x0F != version || h.typ > stSyn {
+		return header{}, nil, errBadPacket
+	}
+
+	// Extension chain: <next extension><len><data...>
+	ext, payload := b[1], b[headerLen:]
+	for ext != 0 {
+		if len(payload) < 2 || len(payload) < 2 + int(payload[1]) {
+			return header{}, nil, errShortPacket
+		}
+		ext, payload = payload[0], payload[2+int(payload[1]):]
+	}
+	return h, payload, nil
+}
+
+// Returns true if sequence number a is before b, allowing for wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a - b) < 0
+}
+
+func micros(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Microsecond))
+}
@@ -0,0 +1,263 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultDialTimeout = 3 * time.Second
+
+	errNotListening = errors.New("uTP socket is not accepting connections")
+)
+
+const (
+	acceptBacklog = 32
+	tickInterval = 50 * time.Millisecond // retransmission timer resolution
+	maxDatagramSize = 64 * 1024
+)
+
+type connKey struct {
+	addr string
+	id uint16 // connection id of packets we receive
+}
+
+// ----------------------------------------------------------------------------------
+// Socket - a UDP socket carrying any number of uTP connections. Implements
+// net.Listener if created with Listen.
+// ----------------------------------------------------------------------------------
+
+type Socket struct {
+	pc net.PacketConn
+	backlog chan *Conn // nil if not accepting
+	dedicated bool     // closed along with its only connection
+
+	mu sync.Mutex
+	conns map[connKey]*Conn
+	closed bool
+
+	done chan struct{}
+}
+
+// Listens on the given UDP address, i.e. ":6881", for incoming connections. The
+// socket may also be used to dial out.
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(pc, true), nil
+}
+
+func newSocket(pc net.PacketConn, accept bool) *Socket {
+	s := &Socket {
+		pc : pc,
+		conns : make(map[connKey]*Conn),
+		done : make(chan struct{}),
+	}
+	if accept {
+		s.backlog = make(chan *Conn, acceptBacklog)
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Connects to the given address from a new socket which is closed with the connection
+func DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket(pc, false)
+	s.dedicated = true
+	c, err := s.DialTimeout(addr, timeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connects to the given address from this socket
+func (s * Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Choose an unused receive id. Initiator sends on id+1.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, &net.OpError { Op : "dial", Net : "utp", Addr : raddr, Err : net.ErrClosed }
+	}
+	key := connKey { raddr.String(), uint16(rand.Intn(1 << 16)) }
+	for s.conns[key] != nil {
+		key.id++
+	}
+	c := newConn(s, raddr, key.id, key.id+1)
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	if err := c.connect(timeout); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s * Socket) Accept() (net.Conn, error) {
+	if s.backlog == nil {
+		return nil, &net.OpError { Op : "accept", Net : "utp", Addr : s.Addr(), Err : errNotListening }
+	}
+	select {
+	case c := <- s.backlog:
+		return c, nil
+	case <- s.done:
+		return nil, &net.OpError { Op : "accept", Net : "utp", Addr : s.Addr(), Err : net.ErrClosed }
+	}
+}
+
+func (s * Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Closes the socket & immediately terminates all connections
+func (s * Socket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	conns := s.snapshot()
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		c.destroy(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	return s.pc.Close()
+}
+
+// NOTE: Must hold s.mu
+func (s * Socket) snapshot() []*Conn {
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (s * Socket) remove(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, connKey { c.raddr.String(), c.recvId })
+	empty := len(s.conns) == 0
+	s.mu.Unlock()
+
+	if s.dedicated && empty {
+		s.Close()
+	}
+}
+
+func (s * Socket) write(b []byte, addr net.Addr) {
+	s.pc.WriteTo(b, addr) // Lost packets are retransmitted
+}
+
+func (s * Socket) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <- s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte(nil), payload...), addr)
+	}
+}
+
+func (s * Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	c, ok := s.lookup(h, addr)
+
+	// New incoming connection - SYN carries the initiator's receive id
+	accepted := false
+	if !ok && h.typ == stSyn && s.backlog != nil && !s.closed {
+		c = newConn(s, addr, h.connId+1, h.connId)
+		s.conns[connKey { addr.String(), c.recvId }] = c
+		accepted = true
+	}
+	s.mu.Unlock()
+
+	switch {
+	case accepted:
+		c.accept(h)
+		select {
+		case s.backlog <- c:
+		default:
+			c.mu.Lock()
+			c.destroy(errNotListening) // Backlog full, remote will retry
+			c.mu.Unlock()
+		}
+	case ok:
+		c.receive(h, payload)
+	case h.typ != stReset:
+		s.write(header { typ : stReset, connId : h.connId, ack : h.seq }.marshal(nil), addr)
+	}
+}
+
+// NOTE: Must hold s.mu
+func (s * Socket) lookup(h header, addr net.Addr) (*Conn, bool) {
+	switch h.typ {
+	case stSyn:
+		c, ok := s.conns[connKey { addr.String(), h.connId+1 }]
+		return c, ok
+
+	case stReset:
+		// Reset echoes the id we sent on which is one either side of our receive id
+		for _, id := range []uint16 { h.connId-1, h.connId+1 } {
+			if c, ok := s.conns[connKey { addr.String(), id }]; ok && c.sendId == h.connId {
+				return c, true
+			}
+		}
+		return nil, false
+
+	default:
+		c, ok := s.conns[connKey { addr.String(), h.connId }]
+		return c, ok
+	}
+}
+
+func (s * Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- s.done:
+			return
+		case now := <- ticker.C:
+			s.mu.Lock()
+			conns := s.snapshot()
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Drops a proportion of outgoing packets
+type lossyConn struct {
+	net.PacketConn
+	loss float64
+	mu sync.Mutex
+	r *mrand.Rand
+}
+
+func (lc * lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	lc.mu.Lock()
+	drop := lc.r.Float64() < lc.loss
+	lc.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return lc.PacketConn.WriteTo(b, addr)
+}
+
+func newTestSocket(t *testing.T, loss float64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSocket(&lossyConn { PacketConn : pc, loss : loss, r : mrand.New(mrand.NewSource(1)) }, true)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func accept(t *testing.T, s *Socket) <-chan net.Conn {
+	c := make(chan net.Conn, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		c <- conn
+	}()
+	return c
+}
+
+// Sends data in both directions at once & checks it arrives intact
+func assertTransfer(t *testing.T, a, b net.Conn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	var wg sync.WaitGroup
+	for _, pair := range [][2]net.Conn { { a, b }, { b, a } } {
+		w, r := pair[0], pair[1]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := w.Write(data); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf, data) {
+				t.Error("Data corrupted in transfer")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		loss float64
+		size int
+	} {
+		{ 0, 1024 * 1024 },
+		{ 0.1, 64 * 1024 },
+	}
+	for _, test := range tests {
+		listener, dialer := newTestSocket(t, test.loss), newTestSocket(t, test.loss)
+		accepted := accept(t, listener)
+
+		a, err := dialer.DialTimeout(listener.Addr().String(), DefaultDialTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := <- accepted
+		assertTransfer(t, a, b, test.size)
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestCloseSendsEOF(t *testing.T) {
+	listener := newTestSocket(t, 0)
+	accepted := accept(t, listener)
+
+	a, err := DialTimeout(listener.Addr().String(), DefaultDialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <- accepted
+	a.Write([]byte("chimera"))
+	a.Close()
+
+	buf, err := io.ReadAll(b)
+	if err != nil || string(buf) != "chimera" {
+		t.Errorf("Expected: chimera, EOF, Actual: %q, %v", buf, err)
+	}
+	if _, err := a.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected: %v, Actual: %v", net.ErrClosed, err)
+	}
+	b.Close()
+}
+
+func TestReadDeadline(t *testing.T) {
+	listener := newTestSocket(t, 0)
+	accepted := accept(t, listener)
+
+	a, err := DialTimeout(listener.Addr().String(), DefaultDialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer (<- accepted).Close()
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = a.Read(make([]byte, 1))
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Errorf("Expected timeout, Actual: %v", err)
+	}
+}
+
+func TestDialNoListener(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSocket(pc, false)
+	defer s.Close()
+
+	if _, err := DialTimeout(s.Addr().String(), 200 * time.Millisecond); err == nil {
+		t.Error("Expected dial to fail")
+	}
+}
+
+func TestParsePacketExtensions(t *testing.T) {
+	h := header { typ : stData, connId : 7, seq : 1, ack : 2 }
+	b := h.marshal([]byte("payload"))
+
+	// Insert a selective ack extension before payload
+	b[1] = 1
+	b = append(b[:headerLen], append([]byte { 0, 4, 0xFF, 0xFF, 0xFF, 0xFF }, b[headerLen:]...)...)
+
+	parsed, payload, err := parsePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != h || string(payload) != "payload" {
+		t.Errorf("Expected: %v %q, Actual: %v %q", h, "payload", parsed, payload)
+	}
+}